@@ -7,7 +7,17 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/rgynn/dice/pkg/api"
+	"github.com/rgynn/dice/pkg/fair"
+	"github.com/rgynn/dice/pkg/middleware"
 	"github.com/rgynn/dice/pkg/session"
 	"github.com/spf13/cobra"
 )
@@ -18,6 +28,30 @@ type Client struct {
 	SessionID       *string
 	NumPlayers      *int
 	DurationSeconds *int
+	MinRoll         *int
+	MaxRoll         *int
+	Dice            *string
+	TiePolicy       *string
+	Webhooks        *[]string
+	Need            *bool
+	Greed           *bool
+	Pass            *bool
+	ClientSeed      *string
+	JSON            *bool
+	ServerSeedHash  *string
+	State           *string
+	Creator         *string
+	CreatedAfter    *string
+	CreatedBefore   *string
+	Cursor          *string
+	Limit           *int
+	AdminToken      *string
+	APIKey          *string
+	Tenant          *string
+	Scopes          *[]string
+	WS              *bool
+	NoWait          *bool
+	IdempotencyKey  *string
 	http.Client
 }
 
@@ -37,13 +71,103 @@ var rollcmd = &cobra.Command{
 	Run: roll,
 }
 
+var listcmd = &cobra.Command{
+	Use: "list",
+	Run: list,
+}
+
+var cancelcmd = &cobra.Command{
+	Use:   "cancel",
+	Short: "cancel a session without a winner, only the creator or an admin may do this",
+	Run:   cancel,
+}
+
+var closecmd = &cobra.Command{
+	Use:   "close",
+	Short: "close a session now with whoever rolled, only the creator or an admin may do this",
+	Run:   closeSession,
+}
+
+var statuscmd = &cobra.Command{
+	Use: "status",
+	Run: status,
+}
+
+var resultcmd = &cobra.Command{
+	Use:   "result",
+	Short: "show the result of a session you rolled in without waiting, pending while it is open",
+	Run:   result,
+}
+
+var keygencmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "generate an api key, give the key to its holder and add the printed entry to the server's API_KEYS_FILE",
+	Run:   keygen,
+}
+
+var verifycmd = &cobra.Command{
+	Use:   "verify [file]",
+	Short: "verify a closed session, fetched with --session or read from the json output of roll (stdin when no file is given)",
+	Args:  cobra.MaximumNArgs(1),
+	Run:   verify,
+}
+
 func init() {
 
 	client.URL = rootcmd.PersistentFlags().String("url", "http://localhost:3000", "url to dice rolling service")
 	client.NumPlayers = newcmd.Flags().Int("num", 2, "number of players per session")
 	client.DurationSeconds = newcmd.Flags().Int("duration", 10, "session duration in seconds")
+	client.MinRoll = newcmd.Flags().Int("min", 0, "lowest possible roll, inclusive (default 1)")
+	client.MaxRoll = newcmd.Flags().Int("max", 0, "highest possible roll, inclusive (default server max)")
+	client.Dice = newcmd.Flags().String("dice", "", "dice expression to roll, e.g. 2d6+3, 4d6kh3 or 1d10!")
+	client.TiePolicy = newcmd.Flags().String("tie", "first", "how to resolve equal highest rolls: first, reroll or split")
+	client.Webhooks = newcmd.Flags().StringArray("webhook", nil, "url to post the signed result to when the session closes, may be repeated")
 	client.Username = rollcmd.Flags().String("user", "", "username, must be unique per session")
 	client.SessionID = rollcmd.Flags().String("session", "", "session id to roll for")
+	client.Need = rollcmd.Flags().Bool("need", false, "roll need, beats every greed roll")
+	client.Greed = rollcmd.Flags().Bool("greed", false, "roll greed")
+	client.Pass = rollcmd.Flags().Bool("pass", false, "pass on the roll")
+	client.ClientSeed = rollcmd.Flags().String("seed", "", "client seed mixed into the roll (default derived from --idempotency-key, else random)")
+	client.WS = rollcmd.Flags().Bool("ws", false, "roll over a websocket, showing other players' rolls as they arrive")
+	client.NoWait = rollcmd.Flags().Bool("no-wait", false, "return right after rolling, fetch the result later with the result command")
+	client.JSON = rollcmd.Flags().Bool("json", false, "print the raw result, including the proof used by verify")
+	client.ServerSeedHash = verifycmd.Flags().String("hash", "", "server seed hash returned when the session was created")
+	newcmd.Flags().StringVar(client.Username, "user", "", "username of the session creator")
+	client.IdempotencyKey = newcmd.Flags().String("idempotency-key", "", "retrying with the same key creates the session only once")
+	rollcmd.Flags().StringVar(client.IdempotencyKey, "idempotency-key", "", "retrying with the same key rolls only once and gets the same result")
+	client.State = listcmd.Flags().String("state", "", "only list sessions in this state: open or closed")
+	client.Creator = listcmd.Flags().String("creator", "", "only list sessions created by this user")
+	client.CreatedAfter = listcmd.Flags().String("after", "", "only list sessions created after this time (RFC3339)")
+	client.CreatedBefore = listcmd.Flags().String("before", "", "only list sessions created before this time (RFC3339)")
+	client.Cursor = listcmd.Flags().String("cursor", "", "cursor of the page to list, printed after the previous page")
+	client.Limit = listcmd.Flags().Int("limit", 0, "max number of sessions to list (default server limit)")
+	client.AdminToken = rootcmd.PersistentFlags().String("admin-token", os.Getenv("DICE_ADMIN_TOKEN"), "admin token, defaults to env variable DICE_ADMIN_TOKEN")
+	client.APIKey = rootcmd.PersistentFlags().String("api-key", os.Getenv("DICE_API_KEY"), "api key, defaults to env variable DICE_API_KEY")
+	client.Tenant = rootcmd.PersistentFlags().String("tenant", os.Getenv("DICE_TENANT"), "tenant the sessions belong to, defaults to env variable DICE_TENANT")
+	client.Transport = apiKeyTransport{http.DefaultTransport}
+	keygencmd.Flags().StringVar(client.Username, "user", "", "username the key is issued to")
+	client.Scopes = keygencmd.Flags().StringSlice("scope", []string{string(middleware.ScopeSessionCreate), string(middleware.ScopeSessionRoll)}, "scopes of the key: session:create, session:roll or admin")
+	for _, cmd := range []*cobra.Command{cancelcmd, closecmd} {
+		cmd.Flags().StringVar(client.SessionID, "session", "", "session id")
+		cmd.Flags().StringVar(client.Username, "user", "", "username of the session creator")
+		if err := cmd.MarkFlagRequired("session"); err != nil {
+			log.Fatal(err)
+		}
+	}
+	statuscmd.Flags().StringVar(client.SessionID, "session", "", "session id to show")
+	resultcmd.Flags().StringVar(client.SessionID, "session", "", "session id you rolled in")
+	resultcmd.Flags().StringVar(client.Username, "user", "", "username you rolled with")
+	resultcmd.Flags().BoolVar(client.JSON, "json", false, "print the raw result, including the proof used by verify")
+	for _, flag := range []string{"session", "user"} {
+		if err := resultcmd.MarkFlagRequired(flag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	verifycmd.Flags().StringVar(client.SessionID, "session", "", "session id to verify")
+
+	if err := statuscmd.MarkFlagRequired("session"); err != nil {
+		log.Fatal(err)
+	}
 
 	if err := rollcmd.MarkFlagRequired("user"); err != nil {
 		log.Fatal(err)
@@ -55,6 +179,41 @@ func init() {
 
 	rootcmd.AddCommand(newcmd)
 	rootcmd.AddCommand(rollcmd)
+	rootcmd.AddCommand(cancelcmd)
+	rootcmd.AddCommand(closecmd)
+	rootcmd.AddCommand(listcmd)
+	rootcmd.AddCommand(statuscmd)
+	rootcmd.AddCommand(resultcmd)
+	rootcmd.AddCommand(verifycmd)
+	rootcmd.AddCommand(keygencmd)
+}
+
+// apiKeyTransport sends the api key, when given, with every request.
+type apiKeyTransport struct {
+	http.RoundTripper
+}
+
+func (t apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if *client.APIKey != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+*client.APIKey)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// sessionsURL is where the sessions of the tenant are found.
+func (client *Client) sessionsURL() string {
+	if *client.Tenant == "" {
+		return *client.URL + "/sessions"
+	}
+	return fmt.Sprintf("%s/t/%s/sessions", *client.URL, url.PathEscape(*client.Tenant))
+}
+
+// setIdempotencyKey sends --idempotency-key, when given, with the request.
+func (client *Client) setIdempotencyKey(req *http.Request) {
+	if *client.IdempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", *client.IdempotencyKey)
+	}
 }
 
 func main() {
@@ -66,19 +225,35 @@ func main() {
 func newSession(cmd *cobra.Command, args []string) {
 
 	type request struct {
-		NumPlayers      *int `json:"num_players"`
-		DurationSeconds *int `json:"duration_seconds"`
+		Creator         *string   `json:"creator,omitempty"`
+		NumPlayers      *int      `json:"num_players"`
+		DurationSeconds *int      `json:"duration_seconds"`
+		MinRoll         *int      `json:"min_roll,omitempty"`
+		MaxRoll         *int      `json:"max_roll,omitempty"`
+		Dice            *string   `json:"dice,omitempty"`
+		TiePolicy       *string   `json:"tie_policy,omitempty"`
+		Webhooks        *[]string `json:"webhooks,omitempty"`
 	}
 
-	reqbody, err := json.Marshal(&request{NumPlayers: client.NumPlayers, DurationSeconds: client.DurationSeconds})
+	reqbody, err := json.Marshal(&request{
+		Creator:         client.Username,
+		NumPlayers:      client.NumPlayers,
+		DurationSeconds: client.DurationSeconds,
+		MinRoll:         client.MinRoll,
+		MaxRoll:         client.MaxRoll,
+		Dice:            client.Dice,
+		TiePolicy:       client.TiePolicy,
+		Webhooks:        client.Webhooks,
+	})
 	if err != nil {
 		log.Fatalf("failed to marshal new session request body: %v", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/sessions", *client.URL), bytes.NewReader(reqbody))
+	req, err := http.NewRequest(http.MethodPost, client.sessionsURL(), bytes.NewReader(reqbody))
 	if err != nil {
 		log.Fatalf("Failed to create new session request: %v", err)
 	}
+	client.setIdempotencyKey(req)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -91,20 +266,79 @@ func newSession(cmd *cobra.Command, args []string) {
 	}
 	defer resp.Body.Close()
 
+	failOnProblem(resp, body)
+
 	var sess session.Session
 	if err := json.Unmarshal(body, &sess); err != nil {
 		log.Fatalf("Failed to unmarshal response body when trying to create new session: %v", err)
 	}
 
+	log.Printf("Server seed hash: %s", sess.ServerSeedHash)
 	fmt.Println(sess.ID)
 }
 
 func roll(cmd *cobra.Command, args []string) {
 
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/sessions/%s/%s", *client.URL, *client.SessionID, *client.Username), nil)
+	type request struct {
+		Type       session.RollType `json:"type,omitempty"`
+		ClientSeed string           `json:"client_seed"`
+	}
+
+	var rollTypes []session.RollType
+	if *client.Need {
+		rollTypes = append(rollTypes, session.RollTypeNeed)
+	}
+	if *client.Greed {
+		rollTypes = append(rollTypes, session.RollTypeGreed)
+	}
+	if *client.Pass {
+		rollTypes = append(rollTypes, session.RollTypePass)
+	}
+	if len(rollTypes) > 1 {
+		log.Fatal("Only one of --need, --greed and --pass can be used")
+	}
+
+	// A retry with the same idempotency key must send the same body, so the
+	// seed is derived from the key rather than drawn anew.
+	rollreq := request{ClientSeed: *client.ClientSeed}
+	if rollreq.ClientSeed == "" && *client.IdempotencyKey != "" {
+		rollreq.ClientSeed = fair.Hash(*client.IdempotencyKey)
+	}
+	if rollreq.ClientSeed == "" {
+		seed, err := fair.NewSeed()
+		if err != nil {
+			log.Fatal(err)
+		}
+		rollreq.ClientSeed = seed
+	}
+	if len(rollTypes) == 1 {
+		rollreq.Type = rollTypes[0]
+	}
+
+	if *client.WS && *client.NoWait {
+		log.Fatal("Only one of --ws and --no-wait can be used")
+	}
+
+	if *client.WS {
+		rollWebSocket(rollreq.Type, rollreq.ClientSeed)
+		return
+	}
+
+	reqbody, err := json.Marshal(&rollreq)
+	if err != nil {
+		log.Fatalf("failed to marshal roll request body: %v", err)
+	}
+
+	rollurl := fmt.Sprintf("%s/%s/%s", client.sessionsURL(), *client.SessionID, *client.Username)
+	if *client.NoWait {
+		rollurl += "?wait=false"
+	}
+
+	req, err := http.NewRequest(http.MethodPost, rollurl, bytes.NewReader(reqbody))
 	if err != nil {
 		log.Fatalf("Failed to create new session request: %v", err)
 	}
+	client.setIdempotencyKey(req)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -117,14 +351,29 @@ func roll(cmd *cobra.Command, args []string) {
 	}
 	defer resp.Body.Close()
 
-	switch resp.StatusCode {
-	case http.StatusInternalServerError:
-		log.Fatal(string(body))
+	failOnProblem(resp, body)
+
+	if *client.JSON {
+		fmt.Println(string(body))
+		return
+	}
+
+	if resp.StatusCode == http.StatusAccepted {
+		type accepted struct {
+			Your      session.Roll `json:"your"`
+			ResultURL string       `json:"result_url"`
+		}
+		var response accepted
+		if err := json.Unmarshal(body, &response); err != nil {
+			log.Fatalf("Failed to unmarshal response body from roll: %v", err)
+		}
+		log.Printf("You rolled: %s, result pending at: %s%s", formatRoll(response.Your), *client.URL, response.ResultURL)
+		return
 	}
 
 	type respo struct {
-		Your   session.Roll `json:"your"`
-		Winner session.Roll `json:"winner"`
+		Your session.Roll `json:"your"`
+		session.Result
 	}
 
 	var response respo
@@ -132,9 +381,480 @@ func roll(cmd *cobra.Command, args []string) {
 		log.Fatalf("Failed to unmarshal response body from roll: %v", err)
 	}
 
-	if response.Winner.PlayerID == *client.Username {
-		log.Printf("You won with: %d", response.Your.Roll)
+	printResult(response.Your, response.Result)
+}
+
+func rollWebSocket(rollType session.RollType, clientSeed string) {
+
+	wsurl, err := url.Parse(fmt.Sprintf("%s/%s/ws", client.sessionsURL(), *client.SessionID))
+	if err != nil {
+		log.Fatalf("Failed to parse websocket url: %v", err)
+	}
+	switch wsurl.Scheme {
+	case "https":
+		wsurl.Scheme = "wss"
+	default:
+		wsurl.Scheme = "ws"
+	}
+
+	header := http.Header{}
+	if *client.APIKey != "" {
+		header.Set("Authorization", "Bearer "+*client.APIKey)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(wsurl.String(), header)
+	if err != nil {
+		if resp != nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			failOnProblem(resp, body)
+		}
+		log.Fatalf("Failed to connect to session websocket: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(&api.WSMessage{
+		Type:       api.WSMessageRoll,
+		PlayerID:   *client.Username,
+		RollType:   rollType,
+		ClientSeed: clientSeed,
+	}); err != nil {
+		log.Fatalf("Failed to send roll: %v", err)
+	}
+
+	var your session.Roll
+	for {
+		var msg api.WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				fail(api.CodeShuttingDown, err.Error())
+			}
+			log.Fatalf("Failed to read from session websocket: %v", err)
+		}
+		switch msg.Type {
+		case api.WSMessageError:
+			fail(msg.Code, msg.Error)
+		case api.WSMessageRolled:
+			your = *msg.Roll
+			log.Printf("You rolled: %s", formatRoll(your))
+		case string(session.EventPlayerRolled):
+			if msg.Roll.PlayerID != *client.Username {
+				log.Printf("%s rolled: %s", msg.Roll.PlayerID, formatRoll(*msg.Roll))
+			}
+		case string(session.EventSessionClosed):
+			if *client.JSON {
+				body, err := json.Marshal(msg.Result)
+				if err != nil {
+					log.Fatalf("Failed to marshal result: %v", err)
+				}
+				fmt.Println(string(body))
+				return
+			}
+			if msg.Result.Proof != nil {
+				for _, roll := range msg.Result.Proof.Rolls {
+					if roll.PlayerID == *client.Username {
+						your = roll
+					}
+				}
+			}
+			printResult(your, *msg.Result)
+			return
+		}
+	}
+}
+
+func printResult(your session.Roll, result session.Result) {
+
+	if len(result.Tied) > 0 {
+		log.Printf("Tied highest roll: %s", formatRolls(result.Tied))
+	}
+	for _, tiebreak := range result.TieBreaks {
+		log.Printf("Tie break round %d: %s", tiebreak.Round, formatRolls(tiebreak.Rolls))
+	}
+
+	switch {
+	case result.Cancelled:
+		log.Printf("Session was cancelled, you rolled: %s", formatRoll(your))
+	case result.Winner.PlayerID == "":
+		log.Printf("Nobody won, you rolled: %s", formatRoll(your))
+	case result.Shared && containsPlayer(result.Tied, *client.Username):
+		log.Printf("You share the win with: %s", formatRoll(your))
+	case result.Shared:
+		log.Printf("%s share the win with: %s, you rolled: %s", formatPlayers(result.Tied), formatRoll(result.Winner), formatRoll(your))
+	case result.Winner.PlayerID == *client.Username:
+		log.Printf("You won with: %s", formatRoll(result.Winner))
+	default:
+		log.Printf("%s won with: %s, you rolled: %s", result.Winner.PlayerID, formatRoll(result.Winner), formatRoll(your))
+	}
+}
+
+func result(cmd *cobra.Command, args []string) {
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s/results/%s", client.sessionsURL(), *client.SessionID, *client.Username), nil)
+	if err != nil {
+		log.Fatalf("Failed to create result request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatalf("Failed to get result: %v", err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("Failed to read response body when getting result: %v", err)
+	}
+	defer resp.Body.Close()
+
+	failOnProblem(resp, body)
+
+	var response session.PlayerResult
+	if err := json.Unmarshal(body, &response); err != nil {
+		log.Fatalf("Failed to unmarshal response body from result: %v", err)
+	}
+
+	if response.Pending {
+		log.Printf("Session %s is still open, result pending", *client.SessionID)
+		return
+	}
+
+	if *client.JSON {
+		body, err := json.Marshal(response.Result)
+		if err != nil {
+			log.Fatalf("Failed to marshal result: %v", err)
+		}
+		fmt.Println(string(body))
+		return
+	}
+
+	var your session.Roll
+	if response.Your != nil {
+		your = *response.Your
+	}
+	printResult(your, *response.Result)
+}
+
+func list(cmd *cobra.Command, args []string) {
+
+	query := url.Values{}
+	for key, value := range map[string]string{
+		"state":          *client.State,
+		"creator":        *client.Creator,
+		"created_after":  *client.CreatedAfter,
+		"created_before": *client.CreatedBefore,
+		"cursor":         *client.Cursor,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	if *client.Limit > 0 {
+		query.Set("limit", strconv.Itoa(*client.Limit))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s?%s", client.sessionsURL(), query.Encode()), nil)
+	if err != nil {
+		log.Fatalf("Failed to create list sessions request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatalf("Failed to list sessions: %v", err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("Failed to read response body when listing sessions: %v", err)
+	}
+	defer resp.Body.Close()
+
+	failOnProblem(resp, body)
+
+	var sessions session.List
+	if err := json.Unmarshal(body, &sessions); err != nil {
+		log.Fatalf("Failed to unmarshal response body from list sessions: %v", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATE\tCREATOR\tPLAYERS\tCREATED\tREMAINING\tWINNER")
+	for _, status := range sessions.Sessions {
+		winner := ""
+		if status.Result != nil {
+			winner = status.Result.Winner.PlayerID
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d/%d\t%s\t%ds\t%s\n",
+			status.ID,
+			status.State,
+			status.Creator,
+			len(status.Players),
+			status.MaxNumPlayers,
+			status.CreatedAt.Local().Format(time.RFC3339),
+			status.RemainingSeconds,
+			winner,
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if sessions.NextCursor != "" {
+		log.Printf("More sessions available, use --cursor %s", sessions.NextCursor)
+	}
+}
+
+func cancel(cmd *cobra.Command, args []string) {
+	sessionAction(http.MethodDelete, fmt.Sprintf("%s/%s", client.sessionsURL(), *client.SessionID))
+	log.Printf("Session %s cancelled", *client.SessionID)
+}
+
+func closeSession(cmd *cobra.Command, args []string) {
+	sessionAction(http.MethodPost, fmt.Sprintf("%s/%s/close", client.sessionsURL(), *client.SessionID))
+	status(cmd, args)
+}
+
+func sessionAction(method, url string) {
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		log.Fatalf("Failed to create session request: %v", err)
+	}
+	req.Header.Set("X-Player-ID", *client.Username)
+	if *client.AdminToken != "" {
+		req.Header.Set("X-Admin-Token", *client.AdminToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatalf("Failed to send session request: %v", err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("Failed to read response body from session request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	failOnProblem(resp, body)
+}
+
+func status(cmd *cobra.Command, args []string) {
+
+	status := getStatus(*client.SessionID)
+
+	log.Printf("Session %s is %s", status.ID, status.State)
+	if status.State == session.StateCancelled {
+		return
+	}
+	log.Printf("Players rolled: %d/%d %s", len(status.Players), status.MaxNumPlayers, strings.Join(status.Players, ", "))
+	if status.State == session.StateOpen {
+		log.Printf("Expires at: %s (%ds remaining)", status.ExpiresAt.Local().Format(time.RFC3339), status.RemainingSeconds)
+		return
+	}
+	if status.Result == nil {
+		return
+	}
+	if status.Result.Proof != nil {
+		log.Printf("Rolls: %s", formatRolls(status.Result.Proof.Rolls))
+	}
+	for _, tiebreak := range status.Result.TieBreaks {
+		log.Printf("Tie break round %d: %s", tiebreak.Round, formatRolls(tiebreak.Rolls))
+	}
+	switch {
+	case status.Result.Winner.PlayerID == "":
+		log.Printf("Nobody won")
+	case status.Result.Shared:
+		log.Printf("%s share the win with: %s", formatPlayers(status.Result.Tied), formatRoll(status.Result.Winner))
+	default:
+		log.Printf("%s won with: %s", status.Result.Winner.PlayerID, formatRoll(status.Result.Winner))
+	}
+}
+
+func getStatus(sessionID string) *session.Status {
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s", client.sessionsURL(), sessionID), nil)
+	if err != nil {
+		log.Fatalf("Failed to create session status request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatalf("Failed to get session status: %v", err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("Failed to read response body when getting session status: %v", err)
+	}
+	defer resp.Body.Close()
+
+	failOnProblem(resp, body)
+
+	var status session.Status
+	if err := json.Unmarshal(body, &status); err != nil {
+		log.Fatalf("Failed to unmarshal response body from session status: %v", err)
+	}
+
+	return &status
+}
+
+func verify(cmd *cobra.Command, args []string) {
+
+	var result session.Result
+	if *client.SessionID != "" {
+		status := getStatus(*client.SessionID)
+		if status.Result == nil {
+			log.Fatalf("Session %s is still %s", status.ID, status.State)
+		}
+		result = *status.Result
+	} else {
+		input := os.Stdin
+		if len(args) == 1 {
+			f, err := os.Open(args[0])
+			if err != nil {
+				log.Fatalf("Failed to open result file: %v", err)
+			}
+			defer f.Close()
+			input = f
+		}
+
+		body, err := ioutil.ReadAll(input)
+		if err != nil {
+			log.Fatalf("Failed to read result: %v", err)
+		}
+
+		if err := json.Unmarshal(body, &result); err != nil {
+			log.Fatalf("Failed to unmarshal result: %v", err)
+		}
+	}
+
+	if result.Proof != nil && *client.ServerSeedHash != "" && result.Proof.ServerSeedHash != *client.ServerSeedHash {
+		log.Fatalf("Server seed hash %s does not match the one committed at creation: %s", result.Proof.ServerSeedHash, *client.ServerSeedHash)
+	}
+
+	if err := session.Verify(result); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Verified %d rolls, %s won with: %s", len(result.Proof.Rolls), result.Winner.PlayerID, formatRoll(result.Winner))
+}
+
+// Exit codes tell scripts why a command failed, log.Fatal exits with 1.
+const (
+	exitInvalid     = 2
+	exitNotFound    = 3
+	exitConflict    = 4
+	exitForbidden   = 5
+	exitUnavailable = 6
+)
+
+// problemMessages explain the problems the server answers with, problems
+// without a message are explained by their detail.
+var problemMessages = map[string]struct {
+	Message  string
+	ExitCode int
+}{
+	api.CodeSessionNotFound:       {"Session not found, it may have expired", exitNotFound},
+	api.CodeTenantNotFound:        {"Tenant not found, see --tenant", exitNotFound},
+	api.CodePlayerNotFound:        {"You have not rolled in this session", exitNotFound},
+	api.CodeSessionClosed:         {"Session is already closed", exitConflict},
+	api.CodePlayerAlreadyRolled:   {"You already rolled in this session", exitConflict},
+	api.CodeMaxNumPlayersReached:  {"Session is full", exitConflict},
+	api.CodeMaxNumSessionsReached: {"Server has too many open sessions, try again later", exitUnavailable},
+	api.CodeForbidden:             {"Only the session creator or an admin may do this", exitForbidden},
+	api.CodeUnauthorized:          {"Missing or invalid api key, see --api-key", exitForbidden},
+	api.CodeInsufficientScope:     {"Your api key is not allowed to do this", exitForbidden},
+	api.CodePlayerMismatch:        {"Your api key is not allowed to act as this user", exitForbidden},
+	api.CodeShuttingDown:          {"Server is shutting down, try again shortly", exitUnavailable},
+	api.CodeRateLimited:           {"Too many requests, try again in a moment", exitUnavailable},
+	api.CodeNotEnoughPlayers:      {"", exitInvalid},
+	api.CodeTooManyPlayers:        {"", exitInvalid},
+	api.CodeInvalidDuration:       {"", exitInvalid},
+	api.CodeInvalidRollRange:      {"", exitInvalid},
+	api.CodeInvalidTiePolicy:      {"", exitInvalid},
+	api.CodeInvalidRollType:       {"", exitInvalid},
+	api.CodeInvalidDice:           {"", exitInvalid},
+	api.CodeInvalidWebhook:        {"", exitInvalid},
+	api.CodeWebhooksDisabled:      {"", exitInvalid},
+	api.CodeInvalidCursor:         {"", exitInvalid},
+	api.CodeInvalidIdempotencyKey: {"", exitInvalid},
+	api.CodeIdempotencyKeyReused:  {"Idempotency key was already used for another request, retry with the same flags or use a new key", exitConflict},
+	"bad_request":                 {"", exitInvalid},
+}
+
+// failOnProblem exits explaining the problem when the response is an error.
+func failOnProblem(resp *http.Response, body []byte) {
+	if resp.StatusCode < http.StatusBadRequest {
+		return
+	}
+	var problem api.Problem
+	if err := json.Unmarshal(body, &problem); err != nil || problem.Code == "" {
+		log.Fatalf("Unexpected response: %s %s", resp.Status, body)
+	}
+	fail(problem.Code, problem.Detail)
+}
+
+func fail(code, detail string) {
+	explained, ok := problemMessages[code]
+	if !ok {
+		log.Fatal(detail)
+	}
+	if explained.Message == "" {
+		log.Print(detail)
 	} else {
-		log.Printf("%s won with: %d, you rolled: %d", response.Winner.PlayerID, response.Winner.Roll, response.Your.Roll)
+		log.Print(explained.Message)
+	}
+	os.Exit(explained.ExitCode)
+}
+
+func containsPlayer(rolls []session.Roll, playerID string) bool {
+	for _, roll := range rolls {
+		if roll.PlayerID == playerID {
+			return true
+		}
+	}
+	return false
+}
+
+func formatPlayers(rolls []session.Roll) string {
+	players := make([]string, len(rolls))
+	for i, roll := range rolls {
+		players[i] = roll.PlayerID
+	}
+	return strings.Join(players, ", ")
+}
+
+func formatRolls(rolls []session.Roll) string {
+	formatted := make([]string, len(rolls))
+	for i, roll := range rolls {
+		formatted[i] = fmt.Sprintf("%s %s", roll.PlayerID, formatRoll(roll))
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func formatRoll(roll session.Roll) string {
+	formatted := fmt.Sprintf("%d", roll.Roll)
+	if len(roll.Dice) > 0 {
+		formatted = fmt.Sprintf("%s %v", formatted, roll.Dice)
+	}
+	switch roll.Type {
+	case session.RollTypePass:
+		return "pass"
+	case session.RollTypeNeed, session.RollTypeGreed:
+		return fmt.Sprintf("%s (%s)", formatted, roll.Type)
+	}
+	return formatted
+}
+
+func keygen(cmd *cobra.Command, args []string) {
+
+	key, hash := middleware.NewAPIKey()
+	apiKey := middleware.APIKey{Hash: hash, PlayerID: *client.Username}
+	for _, scope := range *client.Scopes {
+		if !middleware.Scope(scope).Valid() {
+			fail("bad_request", fmt.Sprintf("unknown scope: %s", scope))
+		}
+		apiKey.Scopes = append(apiKey.Scopes, middleware.Scope(scope))
+	}
+	entry, err := json.Marshal(&apiKey)
+	if err != nil {
+		log.Fatalf("Failed to marshal api key: %v", err)
 	}
+	fmt.Printf("Key:   %s\nEntry: %s\n", key, entry)
 }
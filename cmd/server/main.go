@@ -1,13 +1,28 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/rgynn/dice/pkg/api"
 	"github.com/rgynn/dice/pkg/config"
+	"github.com/rgynn/dice/pkg/metrics"
 	"github.com/rgynn/dice/pkg/middleware"
+	"github.com/rgynn/dice/pkg/random"
+	"github.com/rgynn/dice/pkg/session"
+	"github.com/rgynn/dice/pkg/session/local"
+	"github.com/rgynn/dice/pkg/session/redis"
+	"github.com/rgynn/dice/pkg/session/sqlite"
+	"github.com/rgynn/dice/pkg/webhook"
 
+	goredis "github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 )
 
@@ -16,23 +31,193 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	svc, err := api.NewService(cfg.MaxNumSessions, cfg.MaxRollNumber)
+	rnd, err := random.New(cfg.Randomness, cfg.RandomSeed, cfg.RandomSequence)
 	if err != nil {
 		log.Fatal(err)
 	}
+	var notifier session.Notifier
+	var webhooks *webhook.Notifier
+	if cfg.WebhookSecret != "" {
+		webhooks = webhook.NewNotifier(cfg.WebhookSecret)
+		webhooks.AllowPrivateAddresses = cfg.WebhookAllowPrivate
+		notifier = webhooks
+	}
+	var tenants session.Tenants
+	if cfg.TenantsFile != "" {
+		if tenants, err = session.LoadTenants(cfg.TenantsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	sessions, err := newKeeper(cfg, tenants, rnd, notifier)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m := metrics.New()
+	observed := metrics.NewKeeper(sessions, m)
+	observed.Tenants = tenants
+	runCtx, stopRun := context.WithCancel(context.Background())
+	defer stopRun()
+	svc, err := api.NewService(runCtx, observed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.IdempotencyTTL > 0 && cfg.IdempotencyMaxKeys > 0 {
+		svc.Idempotency = api.NewIdempotencyCache(cfg.IdempotencyTTL, cfg.IdempotencyMaxKeys)
+	} else {
+		svc.Idempotency = nil
+	}
+	var rateLimits middleware.RateLimits
+	if cfg.RateLimitsFile != "" {
+		if rateLimits, err = middleware.LoadRateLimits(cfg.RateLimitsFile); err != nil {
+			log.Fatal(err)
+		}
+		m.WatchRateLimits(rateLimits)
+	}
+	unauthorized, ok := rateLimits[middleware.UnauthorizedRateLimitRoute]
+	if !ok {
+		unauthorized = middleware.NewRateLimiter(middleware.DefaultUnauthorizedRateLimit)
+	}
+	identity, err := newIdentityMiddleware(cfg, middleware.CountUnauthorized(unauthorized, api.NewErrorResponse))
+	if err != nil {
+		log.Fatal(err)
+	}
+	scoped := func(scope middleware.Scope, h http.HandlerFunc) http.Handler {
+		return middleware.RequireScope(scope, api.NewErrorResponse)(h)
+	}
 	router := mux.NewRouter()
 	router.Use(
 		middleware.RequestIDMiddleware,
+		m.Middleware,
 		middleware.ContextLoggerMiddleware(cfg.LogLevel),
 	)
-	router.HandleFunc("/sessions", svc.NewSessionHandler).Methods(http.MethodPost)
-	router.HandleFunc("/sessions/{sessionID}/{playerID}", svc.NewRollHandler).Methods(http.MethodPost)
+	router.Handle("/metrics", m.Handler()).Methods(http.MethodGet)
+	// The sessions of the default tenant and those of every other tenant.
+	for _, prefix := range []string{"/sessions", "/t/{tenant}/sessions"} {
+		sessionsRouter := router.PathPrefix(prefix).Subrouter()
+		sessionsRouter.Use(middleware.UnauthorizedRateLimitMiddleware(unauthorized, api.NewErrorResponse), identity)
+		if rateLimits != nil {
+			sessionsRouter.Use(middleware.RateLimitMiddleware(rateLimits, api.NewErrorResponse))
+		}
+		// Routes are named for their rate limits in RATE_LIMITS_FILE.
+		sessionsRouter.Handle("", scoped(middleware.ScopeSessionCreate, svc.NewSessionHandler)).Methods(http.MethodPost).Name("create_session")
+		sessionsRouter.HandleFunc("", svc.ListSessionsHandler).Methods(http.MethodGet).Name("list_sessions")
+		sessionsRouter.HandleFunc("/{sessionID}", svc.GetSessionHandler).Methods(http.MethodGet).Name("get_session")
+		sessionsRouter.HandleFunc("/{sessionID}", svc.CancelSessionHandler).Methods(http.MethodDelete).Name("cancel_session")
+		sessionsRouter.HandleFunc("/{sessionID}/close", svc.CloseSessionHandler).Methods(http.MethodPost).Name("close_session")
+		sessionsRouter.HandleFunc("/{sessionID}/events", svc.SessionEventsHandler).Methods(http.MethodGet).Name("session_events")
+		sessionsRouter.HandleFunc("/{sessionID}/ws", svc.SessionWebSocketHandler).Methods(http.MethodGet).Name("session_ws")
+		sessionsRouter.HandleFunc("/{sessionID}/webhooks", svc.WebhookDeliveriesHandler).Methods(http.MethodGet).Name("webhook_deliveries")
+		sessionsRouter.HandleFunc("/{sessionID}/results/{playerID}", svc.GetResultHandler).Methods(http.MethodGet).Name("get_result")
+		sessionsRouter.Handle("/{sessionID}/{playerID}", scoped(middleware.ScopeSessionRoll, svc.NewRollHandler)).Methods(http.MethodPost).Name("roll")
+	}
 	srv := &http.Server{
 		Addr:    cfg.Addr,
 		Handler: router,
 	}
-	log.Printf("Listening on: %s\n", cfg.Addr)
-	if err := srv.ListenAndServe(); err != nil {
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	errC := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on: %s\n", cfg.Addr)
+		errC <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errC:
 		log.Fatal(err)
+	case <-signalCtx.Done():
+	}
+	// A second signal kills the server right away.
+	stopSignals()
+	log.Printf("Shutting down, draining for up to %s\n", cfg.DrainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	if err := svc.Shutdown(ctx); err != nil {
+		log.Printf("Failed to resolve open sessions: %s\n", err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Failed to drain connections: %s\n", err)
+		srv.Close()
+	}
+	// Let the keeper hand over the sessions that closed while shutting down
+	// and their webhooks be delivered before closing it.
+	stopRun()
+	svc.Wait()
+	if webhooks != nil {
+		webhooks.Wait()
+	}
+	if closer, ok := sessions.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Failed to close keeper: %s\n", err)
+		}
+	}
+}
+
+// newIdentityMiddleware identifies callers by API key when API_KEYS_FILE is
+// set, by JWT when JWKS_FILE or JWKS_URL is and otherwise trusts the identity
+// headers. Rejected credentials are answered through onError.
+func newIdentityMiddleware(cfg *config.Data, onError middleware.ErrorFunc) (func(h http.Handler) http.Handler, error) {
+	jwt := cfg.JWKSFile != "" || cfg.JWKSURL != ""
+	switch {
+	case cfg.APIKeysFile != "" && jwt:
+		return nil, errors.New("only one of API_KEYS_FILE and JWKS_FILE or JWKS_URL can be set")
+	case cfg.APIKeysFile != "":
+		keys, err := middleware.LoadAPIKeys(cfg.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		return middleware.APIKeyMiddleware(keys, onError), nil
+	case cfg.JWKSFile != "" && cfg.JWKSURL != "":
+		return nil, errors.New("only one of JWKS_FILE and JWKS_URL can be set")
+	case jwt:
+		var keys *middleware.JWKS
+		var err error
+		if cfg.JWKSFile != "" {
+			keys, err = middleware.NewJWKSFromFile(cfg.JWKSFile)
+		} else {
+			keys, err = middleware.NewJWKSFromURL(context.Background(), cfg.JWKSURL)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return middleware.JWTMiddleware(middleware.JWTConfig{
+			Keys:        keys,
+			Issuer:      cfg.JWTIssuer,
+			Audience:    cfg.JWTAudience,
+			PlayerClaim: cfg.JWTPlayerClaim,
+		}, onError), nil
+	}
+	return middleware.HeaderIdentityMiddleware(cfg.AdminToken), nil
+}
+
+// newKeeper returns the session.Keeper selected by KEEPER, knowing the
+// tenants in TENANTS_FILE besides the default one.
+func newKeeper(cfg *config.Data, tenants session.Tenants, rnd session.Randomness, notifier session.Notifier) (session.Keeper, error) {
+	switch cfg.Keeper {
+	case "local":
+		keeper, err := local.NewKeeper(cfg.MaxNumSessions, cfg.MaxRollNumber, cfg.Retention, rnd, notifier)
+		if err != nil {
+			return nil, err
+		}
+		keeper.Tenants = tenants
+		return keeper, nil
+	case "sqlite":
+		keeper, err := sqlite.NewKeeper(cfg.SQLitePath, cfg.MaxNumSessions, cfg.MaxRollNumber, cfg.Retention, rnd, notifier)
+		if err != nil {
+			return nil, err
+		}
+		keeper.Tenants = tenants
+		return keeper, nil
+	case "redis":
+		opts, err := goredis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		keeper, err := redis.NewKeeper(goredis.NewClient(opts), cfg.MaxNumSessions, cfg.MaxRollNumber, cfg.Retention, rnd, notifier)
+		if err != nil {
+			return nil, err
+		}
+		keeper.Tenants = tenants
+		return keeper, nil
 	}
+	return nil, fmt.Errorf("unknown keeper: %s", cfg.Keeper)
 }
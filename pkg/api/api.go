@@ -1,35 +1,79 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/rgynn/dice/pkg/dice"
+	"github.com/rgynn/dice/pkg/middleware"
 	"github.com/rgynn/dice/pkg/session"
-	"github.com/rgynn/dice/pkg/session/local"
 )
 
+// Service serves the REST API. Idempotency keeps the responses replayed to
+// requests retried with the same Idempotency-Key, nil disables it.
 type Service struct {
-	sessions session.Keeper
+	Idempotency  *IdempotencyCache
+	sessions     session.Keeper
+	done         chan struct{}
+	stopped      chan struct{}
+	shutdownOnce sync.Once
 }
 
-func NewService(maxNumSessions, maxRollNumber int) (*Service, error) {
-	sessions, err := local.NewKeeper(maxNumSessions, maxRollNumber)
-	if err != nil {
-		return nil, err
+// NewService runs the keeper until ctx is done, which should be after Shutdown
+// and once the HTTP server has drained.
+func NewService(ctx context.Context, sessions session.Keeper) (*Service, error) {
+	svc := &Service{
+		Idempotency: NewIdempotencyCache(DefaultIdempotencyTTL, DefaultIdempotencyMaxKeys),
+		sessions:    sessions,
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
 	}
-	go sessions.Run()
-	return &Service{
-		sessions: sessions,
-	}, nil
+	go func() {
+		defer close(svc.stopped)
+		sessions.Run(ctx)
+	}()
+	return svc, nil
+}
+
+// Wait blocks until the keeper's Run has returned, having handled the
+// sessions that closed before the ctx given to NewService was done.
+func (svc *Service) Wait() {
+	<-svc.stopped
+}
+
+// Shutdown stops the keeper from creating sessions and has it resolve or hand
+// off the open ones. Roll handlers still waiting for a result then answer
+// with where to get it later, and event streams end, so the HTTP server can
+// drain.
+func (svc *Service) Shutdown(ctx context.Context) error {
+	err := svc.sessions.Shutdown(ctx)
+	svc.shutdownOnce.Do(func() { close(svc.done) })
+	return err
 }
 
+// NewSessionHandler creates a session, once per Idempotency-Key.
 func (svc *Service) NewSessionHandler(w http.ResponseWriter, r *http.Request) {
+	svc.idempotent(w, r, svc.newSession)
+}
+
+func (svc *Service) newSession(w http.ResponseWriter, r *http.Request) {
 	type request struct {
-		NumPlayers      int `json:"num_players"`
-		DurationSeconds int `json:"duration_seconds"`
+		Creator         string   `json:"creator"`
+		NumPlayers      int      `json:"num_players"`
+		DurationSeconds int      `json:"duration_seconds"`
+		MinRoll         int      `json:"min_roll"`
+		MaxRoll         int      `json:"max_roll"`
+		Dice            string   `json:"dice"`
+		TiePolicy       string   `json:"tie_policy"`
+		Webhooks        []string `json:"webhooks"`
 	}
 	reqbody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -42,12 +86,186 @@ func (svc *Service) NewSessionHandler(w http.ResponseWriter, r *http.Request) {
 		NewErrorResponse(w, r, http.StatusBadRequest, err)
 		return
 	}
-	sess, err := svc.sessions.NewSession(r.Context(), req.NumPlayers, req.DurationSeconds)
+	if identity, err := middleware.IdentityFromContext(r.Context()); err == nil && identity.Verified {
+		if req.Creator == "" {
+			req.Creator = identity.PlayerID
+		}
+		if err := identity.ActAs(req.Creator); err != nil {
+			NewErrorResponse(w, r, http.StatusForbidden, err)
+			return
+		}
+	}
+	opts := session.Options{
+		Creator:            req.Creator,
+		MaxNumPlayers:      req.NumPlayers,
+		MaxDurationSeconds: req.DurationSeconds,
+		MinRoll:            req.MinRoll,
+		MaxRoll:            req.MaxRoll,
+		TiePolicy:          session.TiePolicy(req.TiePolicy),
+		Webhooks:           req.Webhooks,
+	}
+	if req.Dice != "" {
+		if opts.Dice, err = dice.Parse(req.Dice); err != nil {
+			NewErrorResponse(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+	}
+	sess, err := svc.sessions.NewSession(r.Context(), tenant(r), opts)
+	if err != nil {
+		NewErrorResponse(w, r, keeperStatus(err), err)
+		return
+	}
+	body, err := json.Marshal(sess)
 	if err != nil {
 		NewErrorResponse(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	body, err := json.Marshal(sess)
+	NewResponse(w, r, http.StatusOK, body)
+}
+
+func (svc *Service) ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := session.ListOptions{
+		State:   session.State(query.Get("state")),
+		Creator: query.Get("creator"),
+		Cursor:  query.Get("cursor"),
+	}
+	if opts.State != "" && !opts.State.Valid() {
+		NewErrorResponse(w, r, http.StatusBadRequest, fmt.Errorf("invalid state: %s", opts.State))
+		return
+	}
+	var err error
+	if v := query.Get("created_after"); v != "" {
+		if opts.CreatedAfter, err = time.Parse(time.RFC3339, v); err != nil {
+			NewErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if v := query.Get("created_before"); v != "" {
+		if opts.CreatedBefore, err = time.Parse(time.RFC3339, v); err != nil {
+			NewErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil {
+			NewErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+	list, err := svc.sessions.ListSessions(r.Context(), tenant(r), opts)
+	if err != nil {
+		NewErrorResponse(w, r, keeperStatus(err), err)
+		return
+	}
+	body, err := json.Marshal(list)
+	if err != nil {
+		NewErrorResponse(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	NewResponse(w, r, http.StatusOK, body)
+}
+
+func (svc *Service) GetSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["sessionID"]
+	if sessionID == "" {
+		NewErrorResponse(w, r, http.StatusBadRequest, errors.New("no sessionID provided"))
+		return
+	}
+	status, err := svc.sessions.GetSession(r.Context(), tenant(r), sessionID)
+	if err != nil {
+		NewErrorResponse(w, r, keeperStatus(err), err)
+		return
+	}
+	body, err := json.Marshal(status)
+	if err != nil {
+		NewErrorResponse(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	NewResponse(w, r, http.StatusOK, body)
+}
+
+// SessionEventsHandler streams the session's events as Server-Sent Events until it is closed.
+func (svc *Service) SessionEventsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["sessionID"]
+	if sessionID == "" {
+		NewErrorResponse(w, r, http.StatusBadRequest, errors.New("no sessionID provided"))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		NewErrorResponse(w, r, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+	eventC, err := svc.sessions.SubscribeSession(r.Context(), tenant(r), sessionID)
+	if err != nil {
+		NewErrorResponse(w, r, keeperStatus(err), err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case event, ok := <-eventC:
+			if !ok || writeEvent(w, flusher, event) != nil {
+				return
+			}
+		case <-svc.done:
+			// Write what was published before shutting down, e.g. the
+			// session resolving early, and end the stream.
+			for {
+				select {
+				case event, ok := <-eventC:
+					if !ok || writeEvent(w, flusher, event) != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, event session.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+func (svc *Service) CancelSessionHandler(w http.ResponseWriter, r *http.Request) {
+	svc.sessionActionHandler(w, r, svc.sessions.CancelSession)
+}
+
+func (svc *Service) CloseSessionHandler(w http.ResponseWriter, r *http.Request) {
+	svc.sessionActionHandler(w, r, svc.sessions.CloseSession)
+}
+
+func (svc *Service) sessionActionHandler(w http.ResponseWriter, r *http.Request, action func(ctx context.Context, tenant, sessionID string, actor session.Actor) (*session.Status, error)) {
+	sessionID := mux.Vars(r)["sessionID"]
+	if sessionID == "" {
+		NewErrorResponse(w, r, http.StatusBadRequest, errors.New("no sessionID provided"))
+		return
+	}
+	var actor session.Actor
+	if identity, err := middleware.IdentityFromContext(r.Context()); err == nil {
+		actor = session.Actor{PlayerID: identity.PlayerID, Admin: identity.Admin}
+	}
+	status, err := action(r.Context(), tenant(r), sessionID, actor)
+	if err != nil {
+		NewErrorResponse(w, r, keeperStatus(err), err)
+		return
+	}
+	body, err := json.Marshal(status)
 	if err != nil {
 		NewErrorResponse(w, r, http.StatusInternalServerError, err)
 		return
@@ -55,7 +273,41 @@ func (svc *Service) NewSessionHandler(w http.ResponseWriter, r *http.Request) {
 	NewResponse(w, r, http.StatusOK, body)
 }
 
+// WebhookDeliveriesHandler returns every attempt at delivering the session's
+// result to its webhooks, only the session creator or an admin may see them.
+func (svc *Service) WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["sessionID"]
+	if sessionID == "" {
+		NewErrorResponse(w, r, http.StatusBadRequest, errors.New("no sessionID provided"))
+		return
+	}
+	var actor session.Actor
+	if identity, err := middleware.IdentityFromContext(r.Context()); err == nil {
+		actor = session.Actor{PlayerID: identity.PlayerID, Admin: identity.Admin}
+	}
+	deliveries, err := svc.sessions.GetSessionDeliveries(r.Context(), tenant(r), sessionID, actor)
+	if err != nil {
+		NewErrorResponse(w, r, keeperStatus(err), err)
+		return
+	}
+	type response struct {
+		Deliveries []session.Delivery `json:"deliveries"`
+	}
+	body, err := json.Marshal(&response{Deliveries: deliveries})
+	if err != nil {
+		NewErrorResponse(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	NewResponse(w, r, http.StatusOK, body)
+}
+
+// NewRollHandler rolls for a player, once per Idempotency-Key, so a retried
+// roll gets the result of the original.
 func (svc *Service) NewRollHandler(w http.ResponseWriter, r *http.Request) {
+	svc.idempotent(w, r, svc.newRoll)
+}
+
+func (svc *Service) newRoll(w http.ResponseWriter, r *http.Request) {
 	sessionID := mux.Vars(r)["sessionID"]
 	if sessionID == "" {
 		NewErrorResponse(w, r, http.StatusBadRequest, errors.New("no sessionID provided"))
@@ -66,17 +318,136 @@ func (svc *Service) NewRollHandler(w http.ResponseWriter, r *http.Request) {
 		NewErrorResponse(w, r, http.StatusBadRequest, errors.New("no playerID provided"))
 		return
 	}
-	resultC, roll, err := svc.sessions.AddSessionRoll(r.Context(), sessionID, playerID)
+	type request struct {
+		Type       session.RollType `json:"type"`
+		ClientSeed string           `json:"client_seed"`
+	}
+	reqbody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		NewErrorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	defer r.Body.Close()
+	var req request
+	if len(reqbody) > 0 {
+		if err := json.Unmarshal(reqbody, &req); err != nil {
+			NewErrorResponse(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if !req.Type.Valid() {
+		NewErrorResponse(w, r, http.StatusUnprocessableEntity, session.ErrInvalidRollType)
+		return
+	}
+	if err := actAs(r, playerID); err != nil {
+		NewErrorResponse(w, r, http.StatusForbidden, err)
+		return
+	}
+	wait := true
+	if v := r.URL.Query().Get("wait"); v != "" {
+		if wait, err = strconv.ParseBool(v); err != nil {
+			NewErrorResponse(w, r, http.StatusBadRequest, fmt.Errorf("invalid wait: %s", v))
+			return
+		}
+	}
+	resultC, roll, err := svc.sessions.AddSessionRoll(r.Context(), tenant(r), sessionID, playerID, session.RollOptions{
+		Type:       req.Type,
+		ClientSeed: req.ClientSeed,
+	})
+	if err != nil {
+		NewErrorResponse(w, r, keeperStatus(err), err)
+		return
+	}
+	if !wait {
+		newRollAcceptedResponse(w, r, sessionID, playerID, roll)
+		return
+	}
+	var result session.Result
+	select {
+	case result = <-resultC:
+	case <-svc.done:
+		// The session was handed off rather than resolved, unless its result
+		// arrived meanwhile.
+		select {
+		case result = <-resultC:
+		default:
+			newRollAcceptedResponse(w, r, sessionID, playerID, roll)
+			return
+		}
+	}
+	type response struct {
+		Your *session.Roll `json:"your"`
+		session.Result
+	}
+	body, err := json.Marshal(&response{Your: roll, Result: result})
 	if err != nil {
 		NewErrorResponse(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	result := <-resultC
+	NewResponse(w, r, http.StatusOK, body)
+}
+
+// tenant returns the tenant named by the route, routes without one are of the
+// default tenant.
+func tenant(r *http.Request) string {
+	return mux.Vars(r)["tenant"]
+}
+
+// sessionsPath returns the path the sessions of a tenant are found under.
+func sessionsPath(tenant string) string {
+	if tenant == session.DefaultTenant {
+		return "/sessions"
+	}
+	return "/t/" + tenant + "/sessions"
+}
+
+// actAs checks that the caller may roll as the player, only verified
+// identities are held to their own player.
+func actAs(r *http.Request, playerID string) error {
+	identity, err := middleware.IdentityFromContext(r.Context())
+	if err != nil {
+		return nil
+	}
+	if !identity.HasScope(middleware.ScopeSessionRoll) {
+		return middleware.ErrInsufficientScope
+	}
+	return identity.ActAs(playerID)
+}
+
+// newRollAcceptedResponse tells the player where to get the result of its roll once the session closes.
+func newRollAcceptedResponse(w http.ResponseWriter, r *http.Request, sessionID, playerID string, roll *session.Roll) {
 	type response struct {
-		Your   *session.Roll `json:"your"`
-		Winner session.Roll  `json:"winner"`
+		Your      *session.Roll `json:"your"`
+		ResultURL string        `json:"result_url"`
 	}
-	body, err := json.Marshal(&response{Your: roll, Winner: result})
+	resultURL := fmt.Sprintf("%s/%s/results/%s", sessionsPath(tenant(r)), sessionID, playerID)
+	body, err := json.Marshal(&response{Your: roll, ResultURL: resultURL})
+	if err != nil {
+		NewErrorResponse(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Location", resultURL)
+	NewResponse(w, r, http.StatusAccepted, body)
+}
+
+// GetResultHandler returns whether the player's session is still pending or, once closed, the result.
+func (svc *Service) GetResultHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["sessionID"]
+	if sessionID == "" {
+		NewErrorResponse(w, r, http.StatusBadRequest, errors.New("no sessionID provided"))
+		return
+	}
+	playerID := mux.Vars(r)["playerID"]
+	if playerID == "" {
+		NewErrorResponse(w, r, http.StatusBadRequest, errors.New("no playerID provided"))
+		return
+	}
+	result, err := svc.sessions.GetSessionResult(r.Context(), tenant(r), sessionID, playerID)
+	if err != nil {
+		NewErrorResponse(w, r, keeperStatus(err), err)
+		return
+	}
+	body, err := json.Marshal(result)
 	if err != nil {
 		NewErrorResponse(w, r, http.StatusInternalServerError, err)
 		return
@@ -91,23 +462,22 @@ func NewResponse(w http.ResponseWriter, r *http.Request, status int, body []byte
 	}
 }
 
+// NewErrorResponse writes err as a problem with the given status, the error
+// behind a generic server error is logged instead.
 func NewErrorResponse(w http.ResponseWriter, r *http.Request, status int, err error) {
-	type ErrorResponse struct {
-		Path    string `json:"path"`
-		Method  string `json:"method"`
-		Code    int    `json:"code"`
-		Message string `json:"msg"`
-	}
-	body, merr := json.Marshal(&ErrorResponse{
-		Path:    r.URL.Path,
-		Method:  r.Method,
-		Code:    status,
-		Message: err.Error(),
-	})
+	problem := NewProblem(status, err)
+	problem.Instance = r.URL.Path
+	if problem.Detail == internalErrorDetail {
+		if logger, lerr := middleware.LoggerFromContext(r.Context()); lerr == nil {
+			logger.WithError(err).Error("failed to handle request")
+		}
+	}
+	body, merr := json.Marshal(problem)
 	if merr != nil {
 		return
 	}
-	w.WriteHeader(status)
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(problem.Status)
 	if _, err := w.Write(body); err != nil {
 		return
 	}
@@ -3,27 +3,70 @@ package api
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/rgynn/dice/pkg/middleware"
 	"github.com/rgynn/dice/pkg/session"
 )
 
 type mockKeeper struct {
-	NewSesssionFunc    func(ctx context.Context, maxNumPlayers, maxDurationSeconds int) (*session.Session, error)
-	AddSessionRollFunc func(ctx context.Context, sessionID, playerID string) (chan session.Roll, *session.Roll, error)
-	RunFunc            func()
+	NewSesssionFunc      func(ctx context.Context, tenant string, opts session.Options) (*session.Session, error)
+	GetSessionFunc       func(ctx context.Context, tenant, sessionID string) (*session.Status, error)
+	CancelSessionFunc    func(ctx context.Context, tenant, sessionID string, actor session.Actor) (*session.Status, error)
+	CloseSessionFunc     func(ctx context.Context, tenant, sessionID string, actor session.Actor) (*session.Status, error)
+	SubscribeFunc        func(ctx context.Context, tenant, sessionID string) (chan session.Event, error)
+	ListSessionsFunc     func(ctx context.Context, tenant string, opts session.ListOptions) (*session.List, error)
+	CountOpenFunc        func(ctx context.Context, tenant string) (int, error)
+	AddSessionRollFunc   func(ctx context.Context, tenant, sessionID, playerID string, opts session.RollOptions) (chan session.Result, *session.Roll, error)
+	GetSessionResultFunc func(ctx context.Context, tenant, sessionID, playerID string) (*session.PlayerResult, error)
+	GetDeliveriesFunc    func(ctx context.Context, tenant, sessionID string, actor session.Actor) ([]session.Delivery, error)
+	RunFunc              func(ctx context.Context)
+	ShutdownFunc         func(ctx context.Context) error
 }
 
-func (mock *mockKeeper) NewSession(ctx context.Context, maxNumPlayers, maxDurationSeconds int) (*session.Session, error) {
-	return mock.NewSesssionFunc(ctx, maxNumPlayers, maxDurationSeconds)
+func (mock *mockKeeper) NewSession(ctx context.Context, tenant string, opts session.Options) (*session.Session, error) {
+	return mock.NewSesssionFunc(ctx, tenant, opts)
 }
-func (mock *mockKeeper) AddSessionRoll(ctx context.Context, sessionID, playerID string) (chan session.Roll, *session.Roll, error) {
-	return mock.AddSessionRollFunc(ctx, sessionID, playerID)
+func (mock *mockKeeper) GetSession(ctx context.Context, tenant, sessionID string) (*session.Status, error) {
+	return mock.GetSessionFunc(ctx, tenant, sessionID)
+}
+func (mock *mockKeeper) CancelSession(ctx context.Context, tenant, sessionID string, actor session.Actor) (*session.Status, error) {
+	return mock.CancelSessionFunc(ctx, tenant, sessionID, actor)
+}
+func (mock *mockKeeper) CloseSession(ctx context.Context, tenant, sessionID string, actor session.Actor) (*session.Status, error) {
+	return mock.CloseSessionFunc(ctx, tenant, sessionID, actor)
+}
+func (mock *mockKeeper) SubscribeSession(ctx context.Context, tenant, sessionID string) (chan session.Event, error) {
+	return mock.SubscribeFunc(ctx, tenant, sessionID)
+}
+func (mock *mockKeeper) ListSessions(ctx context.Context, tenant string, opts session.ListOptions) (*session.List, error) {
+	return mock.ListSessionsFunc(ctx, tenant, opts)
+}
+func (mock *mockKeeper) CountOpenSessions(ctx context.Context, tenant string) (int, error) {
+	return mock.CountOpenFunc(ctx, tenant)
+}
+func (mock *mockKeeper) AddSessionRoll(ctx context.Context, tenant, sessionID, playerID string, opts session.RollOptions) (chan session.Result, *session.Roll, error) {
+	return mock.AddSessionRollFunc(ctx, tenant, sessionID, playerID, opts)
+}
+func (mock *mockKeeper) GetSessionResult(ctx context.Context, tenant, sessionID, playerID string) (*session.PlayerResult, error) {
+	return mock.GetSessionResultFunc(ctx, tenant, sessionID, playerID)
+}
+func (mock *mockKeeper) GetSessionDeliveries(ctx context.Context, tenant, sessionID string, actor session.Actor) ([]session.Delivery, error) {
+	return mock.GetDeliveriesFunc(ctx, tenant, sessionID, actor)
+}
+func (mock *mockKeeper) Run(ctx context.Context) {}
+func (mock *mockKeeper) Shutdown(ctx context.Context) error {
+	return mock.ShutdownFunc(ctx)
 }
-func (mock *mockKeeper) Run() {}
+
+var fakeNow = time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
 
 func TestService_NewSessionHandler(t *testing.T) {
 	type testcase struct {
@@ -37,13 +80,37 @@ func TestService_NewSessionHandler(t *testing.T) {
 			Name:           "Happy path",
 			Input:          []byte(`{"num_players": 2,"duration_seconds": 10}`),
 			ExpectedStatus: http.StatusOK,
-			ExpectedBody:   []byte(`{"id":"fakeid","num_players":2}`),
+			ExpectedBody:   []byte(`{"id":"fakeid","num_players":2,"created_at":"2021-10-01T12:00:00Z","expires_at":"2021-10-01T12:00:10Z"}`),
+		},
+		{
+			Name:           "Roll range",
+			Input:          []byte(`{"num_players": 2,"duration_seconds": 10,"min_roll":1,"max_roll":1000}`),
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"id":"fakeid","num_players":2,"min_roll":1,"max_roll":1000,"created_at":"2021-10-01T12:00:00Z","expires_at":"2021-10-01T12:00:10Z"}`),
+		},
+		{
+			Name:           "Dice expression",
+			Input:          []byte(`{"num_players": 2,"duration_seconds": 10,"dice":"4d6kh3"}`),
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"id":"fakeid","num_players":2,"dice":"4d6kh3","created_at":"2021-10-01T12:00:00Z","expires_at":"2021-10-01T12:00:10Z"}`),
+		},
+		{
+			Name:           "Invalid dice expression",
+			Input:          []byte(`{"num_players": 2,"duration_seconds": 10,"dice":"2x6"}`),
+			ExpectedStatus: http.StatusUnprocessableEntity,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:invalid_dice","title":"Unprocessable Entity","status":422,"detail":"invalid dice expression: \"2x6\"","instance":"/","code":"invalid_dice"}`),
+		},
+		{
+			Name:           "Tie policy",
+			Input:          []byte(`{"num_players": 2,"duration_seconds": 10,"tie_policy":"reroll"}`),
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"id":"fakeid","num_players":2,"tie_policy":"reroll","created_at":"2021-10-01T12:00:00Z","expires_at":"2021-10-01T12:00:10Z"}`),
 		},
 		{
 			Name:           "Invalid body",
 			Input:          nil,
 			ExpectedStatus: http.StatusBadRequest,
-			ExpectedBody:   []byte(`{"path":"/","method":"POST","code":400,"msg":"unexpected end of JSON input"}`),
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:bad_request","title":"Bad Request","status":400,"detail":"unexpected end of JSON input","instance":"/","code":"bad_request"}`),
 		},
 	}
 	for _, tc := range testcases {
@@ -52,10 +119,16 @@ func TestService_NewSessionHandler(t *testing.T) {
 			w := httptest.NewRecorder()
 			svc := &Service{
 				sessions: &mockKeeper{
-					NewSesssionFunc: func(ctx context.Context, maxNumPlayers, maxDurationSeconds int) (*session.Session, error) {
+					NewSesssionFunc: func(ctx context.Context, tenant string, opts session.Options) (*session.Session, error) {
 						return &session.Session{
 							ID:            "fakeid",
-							MaxNumPlayers: maxNumPlayers,
+							MaxNumPlayers: opts.MaxNumPlayers,
+							MinRoll:       opts.MinRoll,
+							MaxRoll:       opts.MaxRoll,
+							Dice:          opts.Dice,
+							TiePolicy:     opts.TiePolicy,
+							CreatedAt:     fakeNow,
+							ExpiresAt:     fakeNow.Add(time.Duration(opts.MaxDurationSeconds) * time.Second),
 						}, nil
 					},
 				},
@@ -71,11 +144,261 @@ func TestService_NewSessionHandler(t *testing.T) {
 	}
 }
 
+func TestService_ListSessionsHandler(t *testing.T) {
+	type testcase struct {
+		Name           string
+		InputQuery     string
+		ExpectedStatus int
+		ExpectedBody   []byte
+	}
+	testcases := []testcase{
+		{
+			Name:           "Filtered",
+			InputQuery:     "?state=open&creator=alice&created_after=2021-10-01T11:00:00Z&limit=1",
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"sessions":[{"id":"fakeid","creator":"alice","num_players":2,"created_at":"2021-10-01T12:00:00Z","expires_at":"2021-10-01T12:00:10Z","state":"open","players":[],"remaining_seconds":10}],"next_cursor":"next"}`),
+		},
+		{
+			Name:           "Invalid state",
+			InputQuery:     "?state=pending",
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:bad_request","title":"Bad Request","status":400,"detail":"invalid state: pending","instance":"/sessions","code":"bad_request"}`),
+		},
+		{
+			Name:           "Invalid creation time",
+			InputQuery:     "?created_after=yesterday",
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:bad_request","title":"Bad Request","status":400,"detail":"parsing time \"yesterday\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"yesterday\" as \"2006\"","instance":"/sessions","code":"bad_request"}`),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/sessions"+tc.InputQuery, nil)
+			w := httptest.NewRecorder()
+			svc := &Service{
+				sessions: &mockKeeper{
+					ListSessionsFunc: func(ctx context.Context, tenant string, opts session.ListOptions) (*session.List, error) {
+						if opts.State != session.StateOpen || opts.Creator != "alice" || !opts.CreatedAfter.Equal(fakeNow.Add(-time.Hour)) || opts.Limit != 1 {
+							t.Errorf("unexpected list options: %+v", opts)
+						}
+						return &session.List{
+							Sessions: []*session.Status{
+								{
+									Session: &session.Session{
+										ID:            "fakeid",
+										Creator:       "alice",
+										MaxNumPlayers: 2,
+										CreatedAt:     fakeNow,
+										ExpiresAt:     fakeNow.Add(10 * time.Second),
+									},
+									State:            session.StateOpen,
+									Players:          []string{},
+									RemainingSeconds: 10,
+								},
+							},
+							NextCursor: "next",
+						}, nil
+					},
+				},
+			}
+			svc.ListSessionsHandler(w, r)
+			if want, got := tc.ExpectedStatus, w.Code; want != got {
+				t.Errorf("expected http status code: %v, got: %v", want, got)
+			}
+			if !bytes.Equal(tc.ExpectedBody, w.Body.Bytes()) {
+				t.Errorf("expected http response body: %s, got: %s", tc.ExpectedBody, w.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestService_GetSessionHandler(t *testing.T) {
+	type testcase struct {
+		Name           string
+		InputSessionID string
+		ExpectedStatus int
+		ExpectedBody   []byte
+	}
+	testcases := []testcase{
+		{
+			Name:           "Open session",
+			InputSessionID: "opensession",
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"id":"opensession","num_players":2,"min_roll":1,"max_roll":100,"created_at":"2021-10-01T12:00:00Z","expires_at":"2021-10-01T12:00:10Z","state":"open","players":["a"],"remaining_seconds":7}`),
+		},
+		{
+			Name:           "Closed session",
+			InputSessionID: "closedsession",
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"id":"closedsession","num_players":2,"min_roll":1,"max_roll":100,"created_at":"2021-10-01T12:00:00Z","expires_at":"2021-10-01T12:00:10Z","state":"closed","players":["a","b"],"remaining_seconds":0,"result":{"winner":{"player_id":"b","roll":90}}}`),
+		},
+		{
+			Name:           "No sessionID",
+			InputSessionID: "",
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:bad_request","title":"Bad Request","status":400,"detail":"no sessionID provided","instance":"/","code":"bad_request"}`),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			w := httptest.NewRecorder()
+			svc := &Service{
+				sessions: &mockKeeper{
+					GetSessionFunc: func(ctx context.Context, tenant, sessionID string) (*session.Status, error) {
+						status := &session.Status{
+							Session: &session.Session{
+								ID:            sessionID,
+								MaxNumPlayers: 2,
+								MinRoll:       1,
+								MaxRoll:       100,
+								CreatedAt:     fakeNow,
+								ExpiresAt:     fakeNow.Add(10 * time.Second),
+							},
+						}
+						switch sessionID {
+						case "opensession":
+							status.State = session.StateOpen
+							status.Players = []string{"a"}
+							status.RemainingSeconds = 7
+						case "closedsession":
+							status.State = session.StateClosed
+							status.Players = []string{"a", "b"}
+							status.Result = &session.Result{Winner: session.Roll{PlayerID: "b", Roll: 90}}
+						}
+						return status, nil
+					},
+				},
+			}
+			r = mux.SetURLVars(r, map[string]string{
+				"sessionID": tc.InputSessionID,
+			})
+			svc.GetSessionHandler(w, r)
+			if want, got := tc.ExpectedStatus, w.Code; want != got {
+				t.Errorf("expected http status code: %v, got: %v", want, got)
+			}
+			if !bytes.Equal(tc.ExpectedBody, w.Body.Bytes()) {
+				t.Errorf("expected http response body: %s, got: %s", tc.ExpectedBody, w.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestService_SessionEventsHandler(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	svc := &Service{
+		sessions: &mockKeeper{
+			SubscribeFunc: func(ctx context.Context, tenant, sessionID string) (chan session.Event, error) {
+				eventC := make(chan session.Event, 4)
+				eventC <- session.Event{Type: session.EventPlayerRolled, SessionID: sessionID, Roll: &session.Roll{PlayerID: "a", Roll: 50}}
+				eventC <- session.Event{Type: session.EventTimerTick, SessionID: sessionID, RemainingSeconds: 3}
+				eventC <- session.Event{Type: session.EventSessionClosed, SessionID: sessionID, Result: &session.Result{Winner: session.Roll{PlayerID: "a", Roll: 50}}}
+				close(eventC)
+				return eventC, nil
+			},
+		},
+	}
+	r = mux.SetURLVars(r, map[string]string{
+		"sessionID": "fakesession",
+	})
+	svc.SessionEventsHandler(w, r)
+	if want, got := http.StatusOK, w.Code; want != got {
+		t.Errorf("expected http status code: %v, got: %v", want, got)
+	}
+	if want, got := "text/event-stream", w.Header().Get("Content-Type"); want != got {
+		t.Errorf("expected content type: %v, got: %v", want, got)
+	}
+	expected := []byte("event: player_rolled\ndata: {\"type\":\"player_rolled\",\"session_id\":\"fakesession\",\"roll\":{\"player_id\":\"a\",\"roll\":50}}\n\n" +
+		"event: timer_tick\ndata: {\"type\":\"timer_tick\",\"session_id\":\"fakesession\",\"remaining_seconds\":3}\n\n" +
+		"event: session_closed\ndata: {\"type\":\"session_closed\",\"session_id\":\"fakesession\",\"result\":{\"winner\":{\"player_id\":\"a\",\"roll\":50}}}\n\n")
+	if !bytes.Equal(expected, w.Body.Bytes()) {
+		t.Errorf("expected http response body: %s, got: %s", expected, w.Body.Bytes())
+	}
+}
+
+func TestService_CancelSessionHandler(t *testing.T) {
+	type testcase struct {
+		Name           string
+		InputIdentity  *middleware.Identity
+		ExpectedStatus int
+		ExpectedBody   []byte
+	}
+	testcases := []testcase{
+		{
+			Name:           "Creator",
+			InputIdentity:  &middleware.Identity{PlayerID: "creator"},
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"id":"fakesession","creator":"creator","num_players":2,"created_at":"2021-10-01T12:00:00Z","expires_at":"2021-10-01T12:00:10Z","state":"cancelled","players":["a"],"remaining_seconds":0,"result":{"winner":{"player_id":"","roll":0},"cancelled":true}}`),
+		},
+		{
+			Name:           "Admin",
+			InputIdentity:  &middleware.Identity{PlayerID: "someone", Admin: true},
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"id":"fakesession","creator":"creator","num_players":2,"created_at":"2021-10-01T12:00:00Z","expires_at":"2021-10-01T12:00:10Z","state":"cancelled","players":["a"],"remaining_seconds":0,"result":{"winner":{"player_id":"","roll":0},"cancelled":true}}`),
+		},
+		{
+			Name:           "Someone else",
+			InputIdentity:  &middleware.Identity{PlayerID: "someone"},
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:forbidden","title":"Forbidden","status":403,"detail":"only the session creator or an admin may do this","instance":"/","code":"forbidden"}`),
+		},
+		{
+			Name:           "Anonymous",
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:forbidden","title":"Forbidden","status":403,"detail":"only the session creator or an admin may do this","instance":"/","code":"forbidden"}`),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodDelete, "/", nil)
+			if tc.InputIdentity != nil {
+				r = r.WithContext(middleware.IdentityContext(r.Context(), tc.InputIdentity))
+			}
+			w := httptest.NewRecorder()
+			svc := &Service{
+				sessions: &mockKeeper{
+					CancelSessionFunc: func(ctx context.Context, tenant, sessionID string, actor session.Actor) (*session.Status, error) {
+						sess := &session.Session{
+							ID:            sessionID,
+							Creator:       "creator",
+							MaxNumPlayers: 2,
+							CreatedAt:     fakeNow,
+							ExpiresAt:     fakeNow.Add(10 * time.Second),
+						}
+						if err := sess.Authorize(actor); err != nil {
+							return nil, err
+						}
+						return &session.Status{
+							Session: sess,
+							State:   session.StateCancelled,
+							Players: []string{"a"},
+							Result:  &session.Result{Cancelled: true},
+						}, nil
+					},
+				},
+			}
+			r = mux.SetURLVars(r, map[string]string{
+				"sessionID": "fakesession",
+			})
+			svc.CancelSessionHandler(w, r)
+			if want, got := tc.ExpectedStatus, w.Code; want != got {
+				t.Errorf("expected http status code: %v, got: %v", want, got)
+			}
+			if !bytes.Equal(tc.ExpectedBody, w.Body.Bytes()) {
+				t.Errorf("expected http response body: %s, got: %s", tc.ExpectedBody, w.Body.Bytes())
+			}
+		})
+	}
+}
+
 func TestService_NewRollHandler(t *testing.T) {
 	type testcase struct {
 		Name           string
 		InputSessionID string
 		InputPlayerID  string
+		InputQuery     string
+		Input          []byte
 		ExpectedStatus int
 		ExpectedBody   []byte
 	}
@@ -94,42 +417,164 @@ func TestService_NewRollHandler(t *testing.T) {
 			ExpectedStatus: http.StatusOK,
 			ExpectedBody:   []byte(`{"your":{"player_id":"losinguser","roll":50},"winner":{"player_id":"otheruser","roll":100}}`),
 		},
+		{
+			Name:           "Tie broken by re-roll",
+			InputSessionID: "fakesession",
+			InputPlayerID:  "tieduser",
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"your":{"player_id":"tieduser","roll":100},"winner":{"player_id":"otheruser","roll":90},"tied":[{"player_id":"tieduser","roll":100},{"player_id":"otheruser","roll":100}],"tie_breaks":[{"round":1,"rolls":[{"player_id":"tieduser","roll":20},{"player_id":"otheruser","roll":90}]}]}`),
+		},
+		{
+			Name:           "Need beats greed",
+			InputSessionID: "fakesession",
+			InputPlayerID:  "greeduser",
+			Input:          []byte(`{"type":"greed"}`),
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"your":{"player_id":"greeduser","type":"greed","roll":100},"winner":{"player_id":"otheruser","type":"need","roll":2}}`),
+		},
+		{
+			Name:           "Without waiting",
+			InputSessionID: "fakesession",
+			InputPlayerID:  "losinguser",
+			InputQuery:     "?wait=false",
+			ExpectedStatus: http.StatusAccepted,
+			ExpectedBody:   []byte(`{"your":{"player_id":"losinguser","roll":50},"result_url":"/sessions/fakesession/results/losinguser"}`),
+		},
+		{
+			Name:           "Invalid wait",
+			InputSessionID: "fakesession",
+			InputPlayerID:  "losinguser",
+			InputQuery:     "?wait=maybe",
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:bad_request","title":"Bad Request","status":400,"detail":"invalid wait: maybe","instance":"/","code":"bad_request"}`),
+		},
+		{
+			Name:           "Invalid roll type",
+			InputSessionID: "fakesession",
+			InputPlayerID:  "user",
+			Input:          []byte(`{"type":"loot"}`),
+			ExpectedStatus: http.StatusUnprocessableEntity,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:invalid_roll_type","title":"Unprocessable Entity","status":422,"detail":"invalid roll type","instance":"/","code":"invalid_roll_type"}`),
+		},
 		{
 			Name:           "No sessionID",
 			InputSessionID: "",
 			InputPlayerID:  "user",
 			ExpectedStatus: http.StatusBadRequest,
-			ExpectedBody:   []byte(`{"path":"/","method":"POST","code":400,"msg":"no sessionID provided"}`),
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:bad_request","title":"Bad Request","status":400,"detail":"no sessionID provided","instance":"/","code":"bad_request"}`),
 		},
 		{
 			Name:           "No playerID",
 			InputSessionID: "fakesession",
 			InputPlayerID:  "",
 			ExpectedStatus: http.StatusBadRequest,
-			ExpectedBody:   []byte(`{"path":"/","method":"POST","code":400,"msg":"no playerID provided"}`),
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:bad_request","title":"Bad Request","status":400,"detail":"no playerID provided","instance":"/","code":"bad_request"}`),
 		},
 	}
 	for _, tc := range testcases {
 		t.Run(tc.Name, func(t *testing.T) {
-			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r := httptest.NewRequest(http.MethodPost, "/"+tc.InputQuery, bytes.NewReader(tc.Input))
 			w := httptest.NewRecorder()
 			svc := &Service{
 				sessions: &mockKeeper{
-					AddSessionRollFunc: func(ctx context.Context, sessionID, playerID string) (chan session.Roll, *session.Roll, error) {
-						rollC := make(chan session.Roll, 1)
-						var roll, winningRoll session.Roll
+					AddSessionRollFunc: func(ctx context.Context, tenant, sessionID, playerID string, opts session.RollOptions) (chan session.Result, *session.Roll, error) {
+						resultC := make(chan session.Result, 1)
+						var roll session.Roll
+						var result session.Result
 						switch tc.InputPlayerID {
 						case "winninguser":
 							roll = session.Roll{PlayerID: "winninguser", Roll: 100}
-							winningRoll = session.Roll{PlayerID: "winninguser", Roll: 100}
+							result.Winner = session.Roll{PlayerID: "winninguser", Roll: 100}
 						case "losinguser":
 							roll = session.Roll{PlayerID: "losinguser", Roll: 50}
-							winningRoll = session.Roll{PlayerID: "otheruser", Roll: 100}
+							result.Winner = session.Roll{PlayerID: "otheruser", Roll: 100}
+						case "greeduser":
+							roll = session.Roll{PlayerID: "greeduser", Type: opts.Type, Roll: 100}
+							result.Winner = session.Roll{PlayerID: "otheruser", Type: session.RollTypeNeed, Roll: 2}
+						case "tieduser":
+							roll = session.Roll{PlayerID: "tieduser", Roll: 100}
+							result.Winner = session.Roll{PlayerID: "otheruser", Roll: 90}
+							result.Tied = []session.Roll{{PlayerID: "tieduser", Roll: 100}, {PlayerID: "otheruser", Roll: 100}}
+							result.TieBreaks = []session.TieBreak{{Round: 1, Rolls: []session.Roll{{PlayerID: "tieduser", Roll: 20}, {PlayerID: "otheruser", Roll: 90}}}}
 						}
 						defer func() {
-							rollC <- winningRoll
+							resultC <- result
 						}()
-						return rollC, &roll, nil
+						return resultC, &roll, nil
+					},
+				},
+			}
+			r = mux.SetURLVars(r, map[string]string{
+				"sessionID": tc.InputSessionID,
+				"playerID":  tc.InputPlayerID,
+			})
+			svc.NewRollHandler(w, r)
+			if want, got := tc.ExpectedStatus, w.Code; want != got {
+				t.Errorf("expected http status code: %v, got: %v", want, got)
+			}
+			if !bytes.Equal(tc.ExpectedBody, w.Body.Bytes()) {
+				t.Errorf("expected http response body: %s, got: %s", tc.ExpectedBody, w.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestService_GetResultHandler(t *testing.T) {
+	type testcase struct {
+		Name           string
+		InputSessionID string
+		InputPlayerID  string
+		ExpectedStatus int
+		ExpectedBody   []byte
+	}
+	testcases := []testcase{
+		{
+			Name:           "Pending",
+			InputSessionID: "opensession",
+			InputPlayerID:  "a",
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"state":"open","pending":true}`),
+		},
+		{
+			Name:           "Closed",
+			InputSessionID: "closedsession",
+			InputPlayerID:  "a",
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"state":"closed","your":{"player_id":"a","roll":40},"winner":{"player_id":"b","roll":90}}`),
+		},
+		{
+			Name:           "Player has not rolled",
+			InputSessionID: "opensession",
+			InputPlayerID:  "c",
+			ExpectedStatus: http.StatusNotFound,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:player_not_found","title":"Not Found","status":404,"detail":"player has not rolled in this session","instance":"/","code":"player_not_found"}`),
+		},
+		{
+			Name:           "No playerID",
+			InputSessionID: "opensession",
+			InputPlayerID:  "",
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:bad_request","title":"Bad Request","status":400,"detail":"no playerID provided","instance":"/","code":"bad_request"}`),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			w := httptest.NewRecorder()
+			svc := &Service{
+				sessions: &mockKeeper{
+					GetSessionResultFunc: func(ctx context.Context, tenant, sessionID, playerID string) (*session.PlayerResult, error) {
+						if playerID != "a" {
+							return nil, session.ErrPlayerNotFound
+						}
+						if sessionID == "opensession" {
+							return &session.PlayerResult{State: session.StateOpen, Pending: true}, nil
+						}
+						return &session.PlayerResult{
+							State:  session.StateClosed,
+							Your:   &session.Roll{PlayerID: "a", Roll: 40},
+							Result: &session.Result{Winner: session.Roll{PlayerID: "b", Roll: 90}},
+						}, nil
 					},
 				},
 			}
@@ -137,10 +582,321 @@ func TestService_NewRollHandler(t *testing.T) {
 				"sessionID": tc.InputSessionID,
 				"playerID":  tc.InputPlayerID,
 			})
+			svc.GetResultHandler(w, r)
+			if want, got := tc.ExpectedStatus, w.Code; want != got {
+				t.Errorf("expected http status code: %v, got: %v", want, got)
+			}
+			if !bytes.Equal(tc.ExpectedBody, w.Body.Bytes()) {
+				t.Errorf("expected http response body: %s, got: %s", tc.ExpectedBody, w.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestService_WebhookDeliveriesHandler(t *testing.T) {
+	type testcase struct {
+		Name           string
+		InputIdentity  *middleware.Identity
+		ExpectedStatus int
+		ExpectedBody   []byte
+	}
+	testcases := []testcase{
+		{
+			Name:           "Creator",
+			InputIdentity:  &middleware.Identity{PlayerID: "creator"},
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"deliveries":[{"url":"http://bot.example/dice","attempt":1,"status_code":502,"error":"unexpected status: 502 Bad Gateway","delivered":false,"time":"2021-10-01T12:00:00Z"},{"url":"http://bot.example/dice","attempt":2,"status_code":200,"delivered":true,"time":"2021-10-01T12:00:01Z"}]}`),
+		},
+		{
+			Name:           "Someone else",
+			InputIdentity:  &middleware.Identity{PlayerID: "someone"},
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:forbidden","title":"Forbidden","status":403,"detail":"only the session creator or an admin may do this","instance":"/","code":"forbidden"}`),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.InputIdentity != nil {
+				r = r.WithContext(middleware.IdentityContext(r.Context(), tc.InputIdentity))
+			}
+			w := httptest.NewRecorder()
+			svc := &Service{
+				sessions: &mockKeeper{
+					GetDeliveriesFunc: func(ctx context.Context, tenant, sessionID string, actor session.Actor) ([]session.Delivery, error) {
+						sess := &session.Session{ID: sessionID, Creator: "creator"}
+						if err := sess.Authorize(actor); err != nil {
+							return nil, err
+						}
+						return []session.Delivery{
+							{URL: "http://bot.example/dice", Attempt: 1, StatusCode: http.StatusBadGateway, Error: "unexpected status: 502 Bad Gateway", Time: fakeNow},
+							{URL: "http://bot.example/dice", Attempt: 2, StatusCode: http.StatusOK, Delivered: true, Time: fakeNow.Add(time.Second)},
+						}, nil
+					},
+				},
+			}
+			r = mux.SetURLVars(r, map[string]string{
+				"sessionID": "fakesession",
+			})
+			svc.WebhookDeliveriesHandler(w, r)
+			if want, got := tc.ExpectedStatus, w.Code; want != got {
+				t.Errorf("expected http status code: %v, got: %v", want, got)
+			}
+			if !bytes.Equal(tc.ExpectedBody, w.Body.Bytes()) {
+				t.Errorf("expected http response body: %s, got: %s", tc.ExpectedBody, w.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestService_Shutdown(t *testing.T) {
+	type testcase struct {
+		Name           string
+		Resolve        bool
+		ExpectedStatus int
+		ExpectedBody   []byte
+	}
+	testcases := []testcase{
+		{
+			Name:           "Resolved early",
+			Resolve:        true,
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"your":{"player_id":"a","roll":50},"winner":{"player_id":"a","roll":50}}`),
+		},
+		{
+			Name:           "Handed off",
+			ExpectedStatus: http.StatusAccepted,
+			ExpectedBody:   []byte(`{"your":{"player_id":"a","roll":50},"result_url":"/sessions/fakesession/results/a"}`),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r = mux.SetURLVars(r, map[string]string{"sessionID": "fakesession", "playerID": "a"})
+			w := httptest.NewRecorder()
+			roll := session.Roll{PlayerID: "a", Roll: 50}
+			resultC := make(chan session.Result, 1)
+			rolledC := make(chan struct{})
+			svc := &Service{
+				sessions: &mockKeeper{
+					AddSessionRollFunc: func(ctx context.Context, tenant, sessionID, playerID string, opts session.RollOptions) (chan session.Result, *session.Roll, error) {
+						close(rolledC)
+						return resultC, &roll, nil
+					},
+					ShutdownFunc: func(ctx context.Context) error {
+						if tc.Resolve {
+							resultC <- session.Result{Winner: roll}
+						}
+						return nil
+					},
+				},
+				done: make(chan struct{}),
+			}
+			handled := make(chan struct{})
+			go func() {
+				defer close(handled)
+				svc.NewRollHandler(w, r)
+			}()
+			<-rolledC
+			if err := svc.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			<-handled
+			if want, got := tc.ExpectedStatus, w.Code; want != got {
+				t.Errorf("expected http status code: %v, got: %v", want, got)
+			}
+			if !bytes.Equal(tc.ExpectedBody, w.Body.Bytes()) {
+				t.Errorf("expected http response body: %s, got: %s", tc.ExpectedBody, w.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestService_VerifiedIdentity(t *testing.T) {
+	alice := &middleware.Identity{PlayerID: "alice", Verified: true, Scopes: []middleware.Scope{middleware.ScopeSessionCreate, middleware.ScopeSessionRoll}}
+	type testcase struct {
+		Name           string
+		Identity       *middleware.Identity
+		Path           string
+		Input          []byte
+		ExpectedStatus int
+		ExpectedBody   []byte
+	}
+	testcases := []testcase{
+		{
+			Name:           "Creator from identity",
+			Identity:       alice,
+			Path:           "/sessions",
+			Input:          []byte(`{"num_players":2}`),
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"id":"fakesession","creator":"alice","num_players":2,"created_at":"2021-10-01T12:00:00Z","expires_at":"2021-10-01T12:00:00Z"}`),
+		},
+		{
+			Name:           "Creating for another player",
+			Identity:       alice,
+			Path:           "/sessions",
+			Input:          []byte(`{"creator":"bob","num_players":2}`),
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:player_mismatch","title":"Forbidden","status":403,"detail":"not allowed to act as this player","instance":"/sessions","code":"player_mismatch"}`),
+		},
+		{
+			Name:           "Rolling as another player",
+			Identity:       alice,
+			Path:           "/sessions/fakesession/bob",
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:player_mismatch","title":"Forbidden","status":403,"detail":"not allowed to act as this player","instance":"/sessions/fakesession/bob","code":"player_mismatch"}`),
+		},
+		{
+			Name:           "Rolling without the scope",
+			Identity:       &middleware.Identity{PlayerID: "bob", Verified: true},
+			Path:           "/sessions/fakesession/bob",
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   []byte(`{"type":"urn:dice:problem:insufficient_scope","title":"Forbidden","status":403,"detail":"not allowed to do this","instance":"/sessions/fakesession/bob","code":"insufficient_scope"}`),
+		},
+		{
+			Name:           "Admin rolling as another player",
+			Identity:       &middleware.Identity{Admin: true, Verified: true, Scopes: []middleware.Scope{middleware.ScopeAdmin}},
+			Path:           "/sessions/fakesession/bob",
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   []byte(`{"your":{"player_id":"bob","roll":50},"winner":{"player_id":"bob","roll":50}}`),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			svc := &Service{
+				sessions: &mockKeeper{
+					NewSesssionFunc: func(ctx context.Context, tenant string, opts session.Options) (*session.Session, error) {
+						return &session.Session{ID: "fakesession", Creator: opts.Creator, MaxNumPlayers: opts.MaxNumPlayers, CreatedAt: fakeNow, ExpiresAt: fakeNow}, nil
+					},
+					AddSessionRollFunc: func(ctx context.Context, tenant, sessionID, playerID string, opts session.RollOptions) (chan session.Result, *session.Roll, error) {
+						roll := session.Roll{PlayerID: playerID, Roll: 50}
+						resultC := make(chan session.Result, 1)
+						resultC <- session.Result{Winner: roll}
+						return resultC, &roll, nil
+					},
+				},
+			}
+			router := mux.NewRouter()
+			router.HandleFunc("/sessions", svc.NewSessionHandler).Methods(http.MethodPost)
+			router.HandleFunc("/sessions/{sessionID}/{playerID}", svc.NewRollHandler).Methods(http.MethodPost)
+			r := httptest.NewRequest(http.MethodPost, tc.Path, bytes.NewReader(tc.Input))
+			r = r.WithContext(middleware.IdentityContext(r.Context(), tc.Identity))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if want, got := tc.ExpectedStatus, w.Code; want != got {
+				t.Errorf("expected http status code: %v, got: %v", want, got)
+			}
+			if !bytes.Equal(tc.ExpectedBody, w.Body.Bytes()) {
+				t.Errorf("expected http response body: %s, got: %s", tc.ExpectedBody, w.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestService_KeeperErrors(t *testing.T) {
+	type testcase struct {
+		Name           string
+		Input          error
+		ExpectedStatus int
+		ExpectedCode   string
+		ExpectedDetail string
+	}
+	testcases := []testcase{
+		{Name: "Session not found", Input: session.ErrNotFound, ExpectedStatus: http.StatusNotFound, ExpectedCode: CodeSessionNotFound},
+		{Name: "Tenant not found", Input: session.ErrTenantNotFound, ExpectedStatus: http.StatusNotFound, ExpectedCode: CodeTenantNotFound},
+		{Name: "Session closed", Input: session.ErrSessionClosed, ExpectedStatus: http.StatusConflict, ExpectedCode: CodeSessionClosed},
+		{Name: "Player already rolled", Input: session.ErrPlayerAlreadyRolled, ExpectedStatus: http.StatusConflict, ExpectedCode: CodePlayerAlreadyRolled},
+		{Name: "Session full", Input: session.ErrMaxNumPlayersReached, ExpectedStatus: http.StatusConflict, ExpectedCode: CodeMaxNumPlayersReached},
+		{Name: "Too many sessions", Input: session.ErrMaxNumSessionsReached, ExpectedStatus: http.StatusTooManyRequests, ExpectedCode: CodeMaxNumSessionsReached},
+		{Name: "Invalid roll range", Input: fmt.Errorf("%w: max roll must not exceed 100", session.ErrInvalidRollRange), ExpectedStatus: http.StatusUnprocessableEntity, ExpectedCode: CodeInvalidRollRange},
+		{Name: "Shutting down", Input: session.ErrShuttingDown, ExpectedStatus: http.StatusServiceUnavailable, ExpectedCode: CodeShuttingDown},
+		{Name: "Unknown error", Input: errors.New("dial tcp 10.0.0.7:6379: connection refused"), ExpectedStatus: http.StatusInternalServerError, ExpectedCode: "internal_server_error", ExpectedDetail: internalErrorDetail},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/sessions/fakesession/a", nil)
+			r = mux.SetURLVars(r, map[string]string{"sessionID": "fakesession", "playerID": "a"})
+			w := httptest.NewRecorder()
+			svc := &Service{
+				sessions: &mockKeeper{
+					AddSessionRollFunc: func(ctx context.Context, tenant, sessionID, playerID string, opts session.RollOptions) (chan session.Result, *session.Roll, error) {
+						return nil, nil, tc.Input
+					},
+				},
+			}
 			svc.NewRollHandler(w, r)
 			if want, got := tc.ExpectedStatus, w.Code; want != got {
 				t.Errorf("expected http status code: %v, got: %v", want, got)
 			}
+			if want, got := ProblemContentType, w.Header().Get("Content-Type"); want != got {
+				t.Errorf("expected content type: %s, got: %s", want, got)
+			}
+			var problem Problem
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			detail := tc.ExpectedDetail
+			if detail == "" {
+				detail = tc.Input.Error()
+			}
+			expected := Problem{
+				Type:     ProblemTypePrefix + tc.ExpectedCode,
+				Title:    http.StatusText(tc.ExpectedStatus),
+				Status:   tc.ExpectedStatus,
+				Detail:   detail,
+				Instance: "/sessions/fakesession/a",
+				Code:     tc.ExpectedCode,
+			}
+			if problem != expected {
+				t.Errorf("expected problem: %+v, got: %+v", expected, problem)
+			}
+		})
+	}
+}
+
+func TestService_Tenants(t *testing.T) {
+	type testcase struct {
+		Name           string
+		Path           string
+		ExpectedTenant string
+		ExpectedBody   []byte
+	}
+	testcases := []testcase{
+		{
+			Name:           "Default tenant",
+			Path:           "/sessions/fakesession/a?wait=false",
+			ExpectedTenant: session.DefaultTenant,
+			ExpectedBody:   []byte(`{"your":{"player_id":"a","roll":50},"result_url":"/sessions/fakesession/results/a"}`),
+		},
+		{
+			Name:           "Tenant",
+			Path:           "/t/guild/sessions/fakesession/a?wait=false",
+			ExpectedTenant: "guild",
+			ExpectedBody:   []byte(`{"your":{"player_id":"a","roll":50},"result_url":"/t/guild/sessions/fakesession/results/a"}`),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var gotTenant string
+			svc := &Service{
+				sessions: &mockKeeper{
+					AddSessionRollFunc: func(ctx context.Context, tenant, sessionID, playerID string, opts session.RollOptions) (chan session.Result, *session.Roll, error) {
+						gotTenant = tenant
+						return make(chan session.Result, 1), &session.Roll{PlayerID: playerID, Roll: 50}, nil
+					},
+				},
+			}
+			router := mux.NewRouter()
+			router.HandleFunc("/sessions/{sessionID}/{playerID}", svc.NewRollHandler).Methods(http.MethodPost)
+			router.HandleFunc("/t/{tenant}/sessions/{sessionID}/{playerID}", svc.NewRollHandler).Methods(http.MethodPost)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tc.Path, nil))
+			if want, got := http.StatusAccepted, w.Code; want != got {
+				t.Errorf("expected http status code: %v, got: %v", want, got)
+			}
+			if want, got := tc.ExpectedTenant, gotTenant; want != got {
+				t.Errorf("expected tenant: %q, got: %q", want, got)
+			}
 			if !bytes.Equal(tc.ExpectedBody, w.Body.Bytes()) {
 				t.Errorf("expected http response body: %s, got: %s", tc.ExpectedBody, w.Body.Bytes())
 			}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rgynn/dice/pkg/clock"
+	"github.com/rgynn/dice/pkg/middleware"
+)
+
+const (
+	// DefaultIdempotencyTTL is how long responses are replayed for unless
+	// configured otherwise.
+	DefaultIdempotencyTTL = 24 * time.Hour
+	// DefaultIdempotencyMaxKeys is how many responses are kept unless
+	// configured otherwise.
+	DefaultIdempotencyMaxKeys = 10000
+	// maxIdempotencyKeyLength is the longest Idempotency-Key accepted.
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	ErrInvalidIdempotencyKey = fmt.Errorf("idempotency key must be 1 to %d characters", maxIdempotencyKeyLength)
+	ErrIdempotencyKeyReused  = errors.New("idempotency key was already used for another request")
+)
+
+// IdempotencyCache holds the responses of requests made with an
+// Idempotency-Key for TTL, at most MaxKeys of them, oldest evicted first.
+// Clock is the system clock and may be replaced before the first request.
+type IdempotencyCache struct {
+	TTL     time.Duration
+	MaxKeys int
+	Clock   clock.Clock
+	entries map[string]*list.Element
+	order   *list.List
+	sync.Mutex
+}
+
+// idempotentRequest is a request made with an Idempotency-Key, done is closed
+// once its response is in, nil if it wasn't kept.
+type idempotentRequest struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	createdAt   time.Time
+	done        chan struct{}
+	response    *recordedResponse
+}
+
+type recordedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func NewIdempotencyCache(ttl time.Duration, maxKeys int) *IdempotencyCache {
+	return &IdempotencyCache{
+		TTL:     ttl,
+		MaxKeys: maxKeys,
+		Clock:   clock.New(),
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// begin returns the request already made with key, or starts a new one when
+// there is none or it expired.
+func (cache *IdempotencyCache) begin(key string, fingerprint [sha256.Size]byte) (req *idempotentRequest, started bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	now := cache.Clock.Now()
+	cache.evict(now, 0)
+	if elem, ok := cache.entries[key]; ok {
+		return elem.Value.(*idempotentRequest), false
+	}
+	cache.evict(now, 1)
+	req = &idempotentRequest{key: key, fingerprint: fingerprint, createdAt: now, done: make(chan struct{})}
+	cache.entries[key] = cache.order.PushBack(req)
+	return req, true
+}
+
+// finish keeps the response of a request, or forgets the request so it can be
+// made again, and wakes up the retries waiting for it.
+func (cache *IdempotencyCache) finish(req *idempotentRequest, response *recordedResponse) {
+	cache.Lock()
+	defer cache.Unlock()
+	if response == nil {
+		if elem, ok := cache.entries[req.key]; ok && elem.Value == req {
+			cache.order.Remove(elem)
+			delete(cache.entries, req.key)
+		}
+	}
+	req.response = response
+	close(req.done)
+}
+
+// evict must be called with the cache locked. It drops expired responses and
+// the oldest ones until there is room for more, requests still being served
+// are kept.
+func (cache *IdempotencyCache) evict(now time.Time, more int) {
+	for elem := cache.order.Front(); elem != nil; {
+		next := elem.Next()
+		req := elem.Value.(*idempotentRequest)
+		expired := now.Sub(req.createdAt) >= cache.TTL
+		full := cache.order.Len()+more > cache.MaxKeys
+		if !expired && !full {
+			break
+		}
+		select {
+		case <-req.done:
+			cache.order.Remove(elem)
+			delete(cache.entries, req.key)
+		default:
+		}
+		elem = next
+	}
+}
+
+// idempotent serves requests made with an Idempotency-Key once per caller and
+// key, retries get the original response replayed, waiting for it while the
+// original is still being served. A key reused for another request is
+// rejected. Server errors and 429s aren't kept so they can be retried.
+func (svc *Service) idempotent(w http.ResponseWriter, r *http.Request, h http.HandlerFunc) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || svc.Idempotency == nil {
+		h(w, r)
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		NewErrorResponse(w, r, http.StatusBadRequest, ErrInvalidIdempotencyKey)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		NewErrorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	r.Body.Close()
+	var caller string
+	if identity, err := middleware.IdentityFromContext(r.Context()); err == nil {
+		caller = identity.PlayerID
+	}
+	scoped := fmt.Sprintf("%s %s\x00%s\x00%s", r.Method, r.URL.Path, caller, key)
+	fingerprint := sha256.Sum256(append([]byte(r.URL.RawQuery+"\x00"), body...))
+	for {
+		req, started := svc.Idempotency.begin(scoped, fingerprint)
+		if started {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			recorder := &responseRecorder{ResponseWriter: w}
+			defer func() {
+				svc.Idempotency.finish(req, recorder.response())
+			}()
+			h(recorder, r)
+			return
+		}
+		if req.fingerprint != fingerprint {
+			NewErrorResponse(w, r, http.StatusUnprocessableEntity, ErrIdempotencyKeyReused)
+			return
+		}
+		select {
+		case <-req.done:
+		case <-r.Context().Done():
+			return
+		}
+		if req.response == nil {
+			// The original wasn't kept, make the request again.
+			continue
+		}
+		for name, values := range req.response.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		NewResponse(w, r, req.response.status, req.response.body)
+		return
+	}
+}
+
+// responseRecorder keeps a copy of the response written through it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// response returns the response to keep, nil for responses worth retrying.
+func (w *responseRecorder) response() *recordedResponse {
+	if w.status == 0 || w.status >= http.StatusInternalServerError || w.status == http.StatusTooManyRequests {
+		return nil
+	}
+	return &recordedResponse{status: w.status, header: w.header, body: w.body.Bytes()}
+}
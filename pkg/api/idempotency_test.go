@@ -0,0 +1,208 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rgynn/dice/pkg/clock"
+	"github.com/rgynn/dice/pkg/session"
+)
+
+func TestService_IdempotentNewSession(t *testing.T) {
+	type request struct {
+		Key              string
+		Body             string
+		ExpectedStatus   int
+		ExpectedReplayed bool
+	}
+	type testcase struct {
+		Name          string
+		KeeperErrors  []error
+		Requests      []request
+		ExpectedCalls int32
+	}
+	testcases := []testcase{
+		{
+			Name: "Retry replayed",
+			Requests: []request{
+				{Key: "a", Body: `{"num_players":2}`, ExpectedStatus: http.StatusOK},
+				{Key: "a", Body: `{"num_players":2}`, ExpectedStatus: http.StatusOK, ExpectedReplayed: true},
+			},
+			ExpectedCalls: 1,
+		},
+		{
+			Name: "Other keys",
+			Requests: []request{
+				{Key: "a", Body: `{"num_players":2}`, ExpectedStatus: http.StatusOK},
+				{Key: "b", Body: `{"num_players":2}`, ExpectedStatus: http.StatusOK},
+				{Body: `{"num_players":2}`, ExpectedStatus: http.StatusOK},
+				{Body: `{"num_players":2}`, ExpectedStatus: http.StatusOK},
+			},
+			ExpectedCalls: 4,
+		},
+		{
+			Name: "Key reused",
+			Requests: []request{
+				{Key: "a", Body: `{"num_players":2}`, ExpectedStatus: http.StatusOK},
+				{Key: "a", Body: `{"num_players":3}`, ExpectedStatus: http.StatusUnprocessableEntity},
+			},
+			ExpectedCalls: 1,
+		},
+		{
+			Name:         "Client errors replayed",
+			KeeperErrors: []error{session.ErrInvalidRollRange},
+			Requests: []request{
+				{Key: "a", Body: `{"num_players":2}`, ExpectedStatus: http.StatusUnprocessableEntity},
+				{Key: "a", Body: `{"num_players":2}`, ExpectedStatus: http.StatusUnprocessableEntity, ExpectedReplayed: true},
+			},
+			ExpectedCalls: 1,
+		},
+		{
+			Name:         "Retryable errors not kept",
+			KeeperErrors: []error{session.ErrMaxNumSessionsReached, session.ErrShuttingDown},
+			Requests: []request{
+				{Key: "a", Body: `{"num_players":2}`, ExpectedStatus: http.StatusTooManyRequests},
+				{Key: "a", Body: `{"num_players":2}`, ExpectedStatus: http.StatusServiceUnavailable},
+				{Key: "a", Body: `{"num_players":2}`, ExpectedStatus: http.StatusOK},
+				{Key: "a", Body: `{"num_players":2}`, ExpectedStatus: http.StatusOK, ExpectedReplayed: true},
+			},
+			ExpectedCalls: 3,
+		},
+		{
+			Name: "Key too long",
+			Requests: []request{
+				{Key: strings.Repeat("a", maxIdempotencyKeyLength+1), Body: `{"num_players":2}`, ExpectedStatus: http.StatusBadRequest},
+			},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var calls int32
+			svc := &Service{
+				Idempotency: NewIdempotencyCache(time.Hour, 10),
+				sessions: &mockKeeper{
+					NewSesssionFunc: func(ctx context.Context, tenant string, opts session.Options) (*session.Session, error) {
+						n := atomic.AddInt32(&calls, 1)
+						if int(n) <= len(tc.KeeperErrors) {
+							return nil, tc.KeeperErrors[n-1]
+						}
+						return &session.Session{ID: string(rune('a' + n)), MaxNumPlayers: opts.MaxNumPlayers, CreatedAt: fakeNow}, nil
+					},
+				},
+			}
+			var first []byte
+			for i, req := range tc.Requests {
+				r := httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(req.Body))
+				if req.Key != "" {
+					r.Header.Set("Idempotency-Key", req.Key)
+				}
+				w := httptest.NewRecorder()
+				svc.NewSessionHandler(w, r)
+				if want, got := req.ExpectedStatus, w.Code; want != got {
+					t.Errorf("request %d: expected http status code: %v, got: %v", i+1, want, got)
+				}
+				replayed := w.Header().Get("Idempotent-Replayed") == "true"
+				if want, got := req.ExpectedReplayed, replayed; want != got {
+					t.Errorf("request %d: expected replayed: %v, got: %v", i+1, want, got)
+				}
+				if replayed && !bytes.Equal(first, w.Body.Bytes()) {
+					t.Errorf("request %d: expected replayed body: %s, got: %s", i+1, first, w.Body.Bytes())
+				}
+				first = w.Body.Bytes()
+			}
+			if want, got := tc.ExpectedCalls, atomic.LoadInt32(&calls); want != got {
+				t.Errorf("expected sessions created: %d, got: %d", want, got)
+			}
+		})
+	}
+}
+
+func TestService_IdempotentNewRoll(t *testing.T) {
+	var calls int32
+	rolled := make(chan struct{})
+	resultC := make(chan session.Result, 1)
+	svc := &Service{
+		Idempotency: NewIdempotencyCache(time.Hour, 10),
+		sessions: &mockKeeper{
+			AddSessionRollFunc: func(ctx context.Context, tenant, sessionID, playerID string, opts session.RollOptions) (chan session.Result, *session.Roll, error) {
+				if atomic.AddInt32(&calls, 1) > 1 {
+					return nil, nil, session.ErrPlayerAlreadyRolled
+				}
+				close(rolled)
+				return resultC, &session.Roll{PlayerID: playerID, Roll: 50}, nil
+			},
+		},
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/sessions/{sessionID}/{playerID}", svc.NewRollHandler).Methods(http.MethodPost)
+	roll := func() <-chan *httptest.ResponseRecorder {
+		doneC := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			r := httptest.NewRequest(http.MethodPost, "/sessions/fakesession/alice", nil)
+			r.Header.Set("Idempotency-Key", "roll-1")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			doneC <- w
+		}()
+		return doneC
+	}
+
+	original := roll()
+	<-rolled
+	retry := roll()
+	select {
+	case w := <-retry:
+		t.Fatalf("expected the retry to wait for the original roll, got: %d %s", w.Code, w.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	resultC <- session.Result{Winner: session.Roll{PlayerID: "alice", Roll: 50}}
+	expected := []byte(`{"your":{"player_id":"alice","roll":50},"winner":{"player_id":"alice","roll":50}}`)
+	for _, w := range []*httptest.ResponseRecorder{<-original, <-retry, <-roll()} {
+		if want, got := http.StatusOK, w.Code; want != got {
+			t.Errorf("expected http status code: %v, got: %v", want, got)
+		}
+		if !bytes.Equal(expected, w.Body.Bytes()) {
+			t.Errorf("expected http response body: %s, got: %s", expected, w.Body.Bytes())
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected a single roll, got: %d", n)
+	}
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	fake := clock.NewFake(fakeNow)
+	cache := NewIdempotencyCache(time.Minute, 2)
+	cache.Clock = fake
+	fingerprint := sha256.Sum256(nil)
+	response := &recordedResponse{status: http.StatusOK}
+
+	a, _ := cache.begin("a", fingerprint)
+	cache.finish(a, response)
+	inFlight, _ := cache.begin("in-flight", fingerprint)
+	if _, started := cache.begin("a", fingerprint); started {
+		t.Error("expected a kept response for a")
+	}
+	c, _ := cache.begin("c", fingerprint)
+	cache.finish(c, response)
+	if _, started := cache.begin("a", fingerprint); !started {
+		t.Error("expected a to be evicted once full")
+	}
+	if _, started := cache.begin("in-flight", fingerprint); started {
+		t.Error("expected requests still being served to be kept when full")
+	}
+
+	fake.Advance(time.Minute)
+	cache.finish(inFlight, response)
+	if _, started := cache.begin("in-flight", fingerprint); !started {
+		t.Error("expected expired responses to be evicted")
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/rgynn/dice/pkg/dice"
+	"github.com/rgynn/dice/pkg/middleware"
+	"github.com/rgynn/dice/pkg/session"
+)
+
+// ProblemContentType is the media type of error responses, see RFC 7807.
+const ProblemContentType = "application/problem+json"
+
+// ProblemTypePrefix is prepended to the code of a problem to make its type URI.
+const ProblemTypePrefix = "urn:dice:problem:"
+
+// Codes identify problems for clients, they are stable unlike the detail.
+const (
+	CodeSessionNotFound       = "session_not_found"
+	CodeTenantNotFound        = "tenant_not_found"
+	CodePlayerNotFound        = "player_not_found"
+	CodeSessionClosed         = "session_closed"
+	CodePlayerAlreadyRolled   = "player_already_rolled"
+	CodeMaxNumPlayersReached  = "max_num_players_reached"
+	CodeMaxNumSessionsReached = "max_num_sessions_reached"
+	CodeNotEnoughPlayers      = "not_enough_players"
+	CodeTooManyPlayers        = "too_many_players"
+	CodeInvalidDuration       = "invalid_duration"
+	CodeInvalidRollRange      = "invalid_roll_range"
+	CodeInvalidTiePolicy      = "invalid_tie_policy"
+	CodeInvalidRollType       = "invalid_roll_type"
+	CodeInvalidDice           = "invalid_dice"
+	CodeInvalidWebhook        = "invalid_webhook"
+	CodeWebhooksDisabled      = "webhooks_disabled"
+	CodeInvalidCursor         = "invalid_cursor"
+	CodeForbidden             = "forbidden"
+	CodeShuttingDown          = "shutting_down"
+	CodeUnauthorized          = "unauthorized"
+	CodeInsufficientScope     = "insufficient_scope"
+	CodePlayerMismatch        = "player_mismatch"
+	CodeRateLimited           = "rate_limited"
+	CodeInvalidIdempotencyKey = "invalid_idempotency_key"
+	CodeIdempotencyKeyReused  = "idempotency_key_reused"
+)
+
+// Problem is the body of every error response.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+}
+
+// problems maps the errors a Keeper may return to their status and code.
+var problems = []struct {
+	Err    error
+	Status int
+	Code   string
+}{
+	{session.ErrNotFound, http.StatusNotFound, CodeSessionNotFound},
+	{session.ErrTenantNotFound, http.StatusNotFound, CodeTenantNotFound},
+	{session.ErrPlayerNotFound, http.StatusNotFound, CodePlayerNotFound},
+	{session.ErrSessionClosed, http.StatusConflict, CodeSessionClosed},
+	{session.ErrPlayerAlreadyRolled, http.StatusConflict, CodePlayerAlreadyRolled},
+	{session.ErrMaxNumPlayersReached, http.StatusConflict, CodeMaxNumPlayersReached},
+	{session.ErrMaxNumSessionsReached, http.StatusTooManyRequests, CodeMaxNumSessionsReached},
+	{session.ErrNotEnoughPlayers, http.StatusUnprocessableEntity, CodeNotEnoughPlayers},
+	{session.ErrTooManyPlayers, http.StatusUnprocessableEntity, CodeTooManyPlayers},
+	{session.ErrInvalidDuration, http.StatusUnprocessableEntity, CodeInvalidDuration},
+	{session.ErrInvalidRollRange, http.StatusUnprocessableEntity, CodeInvalidRollRange},
+	{session.ErrInvalidTiePolicy, http.StatusUnprocessableEntity, CodeInvalidTiePolicy},
+	{session.ErrInvalidRollType, http.StatusUnprocessableEntity, CodeInvalidRollType},
+	{dice.ErrInvalidExpression, http.StatusUnprocessableEntity, CodeInvalidDice},
+	{session.ErrInvalidWebhook, http.StatusUnprocessableEntity, CodeInvalidWebhook},
+	{session.ErrWebhooksDisabled, http.StatusUnprocessableEntity, CodeWebhooksDisabled},
+	{session.ErrInvalidCursor, http.StatusBadRequest, CodeInvalidCursor},
+	{session.ErrForbidden, http.StatusForbidden, CodeForbidden},
+	{session.ErrShuttingDown, http.StatusServiceUnavailable, CodeShuttingDown},
+	{middleware.ErrUnauthorized, http.StatusUnauthorized, CodeUnauthorized},
+	{middleware.ErrInsufficientScope, http.StatusForbidden, CodeInsufficientScope},
+	{middleware.ErrPlayerMismatch, http.StatusForbidden, CodePlayerMismatch},
+	{middleware.ErrRateLimited, http.StatusTooManyRequests, CodeRateLimited},
+	{ErrInvalidIdempotencyKey, http.StatusBadRequest, CodeInvalidIdempotencyKey},
+	{ErrIdempotencyKeyReused, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused},
+}
+
+// internalErrorDetail stands in for the detail of unknown server errors,
+// which may reveal more about the server than clients should know.
+const internalErrorDetail = "The server failed to handle the request."
+
+// NewProblem describes err with the given status, and the code of known
+// errors or otherwise one derived from the status, e.g. bad_request. Unknown
+// errors with a 5xx status get a generic detail.
+func NewProblem(status int, err error) *Problem {
+	code := strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	detail := err.Error()
+	if _, knownCode, ok := lookupProblem(err); ok {
+		code = knownCode
+	} else if status >= http.StatusInternalServerError {
+		detail = internalErrorDetail
+	}
+	return &Problem{
+		Type:   ProblemTypePrefix + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// keeperStatus returns the status of an error a Keeper returned, 500 unless
+// it is a known one.
+func keeperStatus(err error) int {
+	if status, _, ok := lookupProblem(err); ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// lookupProblem returns the status and code of a known error.
+func lookupProblem(err error) (int, string, bool) {
+	for _, problem := range problems {
+		if errors.Is(err, problem.Err) {
+			return problem.Status, problem.Code, true
+		}
+	}
+	return 0, "", false
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/rgynn/dice/pkg/session"
+)
+
+const (
+	WSMessageRoll   = "roll"
+	WSMessageRolled = "rolled"
+	WSMessageError  = "error"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// WSMessage is every JSON message sent over the session websocket.
+//
+// Clients send {"type":"roll","player_id":...,"roll_type":...,"client_seed":...}.
+// The server answers with {"type":"rolled","roll":...} or {"type":"error","error":...,"code":...}
+// and forwards every session event (player_rolled, timer_tick, tie_break and
+// session_closed) with the same fields as the SSE stream.
+type WSMessage struct {
+	Type             string              `json:"type"`
+	SessionID        string              `json:"session_id,omitempty"`
+	PlayerID         string              `json:"player_id,omitempty"`
+	RollType         session.RollType    `json:"roll_type,omitempty"`
+	ClientSeed       string              `json:"client_seed,omitempty"`
+	Roll             *session.Roll       `json:"roll,omitempty"`
+	RemainingSeconds int                 `json:"remaining_seconds,omitempty"`
+	TieBreak         *session.TieBreak   `json:"tie_break,omitempty"`
+	Result           *session.Result     `json:"result,omitempty"`
+	Reason           session.CloseReason `json:"reason,omitempty"`
+	Error            string              `json:"error,omitempty"`
+	Code             string              `json:"code,omitempty"`
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// SessionWebSocketHandler lets a client watch a session, submit its roll and
+// receive the result over a single connection, which is closed once the
+// session is.
+func (svc *Service) SessionWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["sessionID"]
+	if sessionID == "" {
+		NewErrorResponse(w, r, http.StatusBadRequest, errors.New("no sessionID provided"))
+		return
+	}
+	eventC, err := svc.sessions.SubscribeSession(r.Context(), tenant(r), sessionID)
+	if err != nil {
+		NewErrorResponse(w, r, keeperStatus(err), err)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sendC := make(chan WSMessage, 1)
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		svc.readWebSocket(r, conn, sessionID, sendC)
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-sendC:
+			if err := writeWebSocket(conn, msg); err != nil {
+				return
+			}
+		case event, ok := <-eventC:
+			if !ok {
+				select {
+				case msg := <-sendC:
+					_ = writeWebSocket(conn, msg)
+				default:
+				}
+				_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteWait))
+				return
+			}
+			if err := writeWebSocket(conn, newWSEvent(event)); err != nil {
+				return
+			}
+		case <-svc.done:
+			// Write what was published before shutting down, e.g. the
+			// session resolving early, and tell the client the server is going away.
+		drain:
+			for {
+				select {
+				case event, ok := <-eventC:
+					if !ok || writeWebSocket(conn, newWSEvent(event)) != nil {
+						break drain
+					}
+				default:
+					break drain
+				}
+			}
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down"), time.Now().Add(wsWriteWait))
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-readDone:
+			return
+		}
+	}
+}
+
+// readWebSocket handles roll messages until the connection is closed.
+func (svc *Service) readWebSocket(r *http.Request, conn *websocket.Conn, sessionID string, sendC chan WSMessage) {
+	conn.SetReadLimit(4096)
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		reply := WSMessage{Type: WSMessageRolled, SessionID: sessionID}
+		switch {
+		case msg.Type != WSMessageRoll:
+			reply = newWSError(sessionID, http.StatusBadRequest, errors.New("unknown message type: "+msg.Type))
+		case msg.PlayerID == "":
+			reply = newWSError(sessionID, http.StatusBadRequest, errors.New("no player_id provided"))
+		default:
+			if err := actAs(r, msg.PlayerID); err != nil {
+				reply = newWSError(sessionID, http.StatusForbidden, err)
+				break
+			}
+			_, roll, err := svc.sessions.AddSessionRoll(r.Context(), tenant(r), sessionID, msg.PlayerID, session.RollOptions{
+				Type:       msg.RollType,
+				ClientSeed: msg.ClientSeed,
+			})
+			if err != nil {
+				reply = newWSError(sessionID, keeperStatus(err), err)
+			} else {
+				reply.Roll = roll
+			}
+		}
+		select {
+		case sendC <- reply:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeWebSocket(conn *websocket.Conn, msg WSMessage) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+		return err
+	}
+	return conn.WriteJSON(msg)
+}
+
+func newWSEvent(event session.Event) WSMessage {
+	return WSMessage{
+		Type:             string(event.Type),
+		SessionID:        event.SessionID,
+		Roll:             event.Roll,
+		RemainingSeconds: event.RemainingSeconds,
+		TieBreak:         event.TieBreak,
+		Result:           event.Result,
+		Reason:           event.Reason,
+	}
+}
+
+// newWSError describes err with the same code as the problem an HTTP request would get.
+func newWSError(sessionID string, status int, err error) WSMessage {
+	problem := NewProblem(status, err)
+	return WSMessage{Type: WSMessageError, SessionID: sessionID, Error: problem.Detail, Code: problem.Code}
+}
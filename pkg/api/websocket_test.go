@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/rgynn/dice/pkg/session"
+)
+
+func TestService_SessionWebSocketHandler(t *testing.T) {
+	eventC := make(chan session.Event, 4)
+	svc := &Service{
+		sessions: &mockKeeper{
+			SubscribeFunc: func(ctx context.Context, tenant, sessionID string) (chan session.Event, error) {
+				return eventC, nil
+			},
+			AddSessionRollFunc: func(ctx context.Context, tenant, sessionID, playerID string, opts session.RollOptions) (chan session.Result, *session.Roll, error) {
+				if playerID == "taken" {
+					return nil, nil, session.ErrPlayerAlreadyRolled
+				}
+				roll := session.Roll{PlayerID: playerID, Type: opts.Type, Roll: 50}
+				eventC <- session.Event{Type: session.EventPlayerRolled, SessionID: sessionID, Roll: &roll}
+				eventC <- session.Event{Type: session.EventSessionClosed, SessionID: sessionID, Result: &session.Result{Winner: roll}, Reason: session.CloseReasonAllPlayers}
+				close(eventC)
+				return make(chan session.Result, 1), &roll, nil
+			},
+		},
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/sessions/{sessionID}/ws", svc.SessionWebSocketHandler)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/sessions/fakesession/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	send := func(msg WSMessage) {
+		if err := conn.WriteJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func() WSMessage {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	send(WSMessage{Type: "shout"})
+	if want, got := (WSMessage{Type: WSMessageError, SessionID: "fakesession", Error: "unknown message type: shout", Code: "bad_request"}), receive(); !reflect.DeepEqual(want, got) {
+		t.Errorf("expected message: %+v, got: %+v", want, got)
+	}
+	send(WSMessage{Type: WSMessageRoll, PlayerID: "taken"})
+	if want, got := (WSMessage{Type: WSMessageError, SessionID: "fakesession", Error: session.ErrPlayerAlreadyRolled.Error(), Code: CodePlayerAlreadyRolled}), receive(); !reflect.DeepEqual(want, got) {
+		t.Errorf("expected message: %+v, got: %+v", want, got)
+	}
+
+	send(WSMessage{Type: WSMessageRoll, PlayerID: "a", RollType: session.RollTypeNeed})
+	roll := session.Roll{PlayerID: "a", Type: session.RollTypeNeed, Roll: 50}
+	received := map[string]WSMessage{}
+	for i := 0; i < 3; i++ {
+		msg := receive()
+		received[msg.Type] = msg
+	}
+	expected := map[string]WSMessage{
+		WSMessageRolled:                    {Type: WSMessageRolled, SessionID: "fakesession", Roll: &roll},
+		string(session.EventPlayerRolled):  {Type: string(session.EventPlayerRolled), SessionID: "fakesession", Roll: &roll},
+		string(session.EventSessionClosed): {Type: string(session.EventSessionClosed), SessionID: "fakesession", Result: &session.Result{Winner: roll}, Reason: session.CloseReasonAllPlayers},
+	}
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("expected messages: %+v, got: %+v", expected, received)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected normal closure, got: %v", err)
+	}
+}
+
+func TestService_SessionWebSocketHandler_Shutdown(t *testing.T) {
+	eventC := make(chan session.Event, 1)
+	svc := &Service{
+		sessions: &mockKeeper{
+			SubscribeFunc: func(ctx context.Context, tenant, sessionID string) (chan session.Event, error) {
+				return eventC, nil
+			},
+			ShutdownFunc: func(ctx context.Context) error {
+				eventC <- session.Event{Type: session.EventTimerTick, SessionID: "fakesession", RemainingSeconds: 3}
+				return nil
+			},
+		},
+		done: make(chan struct{}),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/sessions/{sessionID}/ws", svc.SessionWebSocketHandler)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/sessions/fakesession/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := svc.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if want := (WSMessage{Type: string(session.EventTimerTick), SessionID: "fakesession", RemainingSeconds: 3}); !reflect.DeepEqual(want, msg) {
+		t.Errorf("expected events published before shutting down, got: %+v", msg)
+	}
+	if err := conn.ReadJSON(&msg); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected going away close, got: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+// Package clock abstracts the passing of time so session deadlines can be
+// simulated in tests instead of waited for.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates timers and tickers running on it.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the system clock.
+type Real struct{}
+
+func New() Real {
+	return Real{}
+}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (Real) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (timer realTimer) C() <-chan time.Time {
+	return timer.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (ticker realTicker) C() <-chan time.Time {
+	return ticker.Ticker.C
+}
+
+// Fake only moves when told to by Advance, firing the timers and tickers
+// that became due in the order they were due.
+type Fake struct {
+	now     time.Time
+	waiters []*fakeWaiter
+	changed chan struct{}
+	sync.Mutex
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now, changed: make(chan struct{})}
+}
+
+func (clock *Fake) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.now
+}
+
+func (clock *Fake) NewTimer(d time.Duration) Timer {
+	return clock.newWaiter(d, 0)
+}
+
+func (clock *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	return fakeTicker{clock.newWaiter(d, d)}
+}
+
+// Advance moves the clock forward by d.
+func (clock *Fake) Advance(d time.Duration) {
+	clock.Lock()
+	defer clock.Unlock()
+	until := clock.now.Add(d)
+	for {
+		sort.SliceStable(clock.waiters, func(i, j int) bool {
+			return clock.waiters[i].at.Before(clock.waiters[j].at)
+		})
+		if len(clock.waiters) == 0 || clock.waiters[0].at.After(until) {
+			break
+		}
+		waiter := clock.waiters[0]
+		clock.now = waiter.at
+		waiter.fire(clock.now)
+		if waiter.period > 0 {
+			waiter.at = waiter.at.Add(waiter.period)
+		} else {
+			clock.remove(waiter)
+		}
+	}
+	clock.now = until
+}
+
+// BlockUntil waits until n timers and tickers are running, e.g. for a
+// goroutine to have started its ticker before the clock is advanced.
+func (clock *Fake) BlockUntil(n int) {
+	for {
+		clock.Lock()
+		if len(clock.waiters) >= n {
+			clock.Unlock()
+			return
+		}
+		changed := clock.changed
+		clock.Unlock()
+		<-changed
+	}
+}
+
+func (clock *Fake) newWaiter(d, period time.Duration) *fakeWaiter {
+	clock.Lock()
+	defer clock.Unlock()
+	waiter := &fakeWaiter{clock: clock, c: make(chan time.Time, 1), at: clock.now.Add(d), period: period}
+	if d <= 0 {
+		waiter.fire(clock.now)
+		return waiter
+	}
+	clock.waiters = append(clock.waiters, waiter)
+	clock.notify()
+	return waiter
+}
+
+// remove must be called with the clock locked, it reports whether the waiter was running.
+func (clock *Fake) remove(waiter *fakeWaiter) bool {
+	for i, w := range clock.waiters {
+		if w == waiter {
+			clock.waiters = append(clock.waiters[:i], clock.waiters[i+1:]...)
+			clock.notify()
+			return true
+		}
+	}
+	return false
+}
+
+// notify must be called with the clock locked.
+func (clock *Fake) notify() {
+	close(clock.changed)
+	clock.changed = make(chan struct{})
+}
+
+// fakeWaiter is a timer, or a ticker when it has a period.
+type fakeWaiter struct {
+	clock  *Fake
+	c      chan time.Time
+	at     time.Time
+	period time.Duration
+}
+
+func (waiter *fakeWaiter) C() <-chan time.Time {
+	return waiter.c
+}
+
+// fire drops the tick if the last one was not received yet, like time.Ticker.
+func (waiter *fakeWaiter) fire(now time.Time) {
+	select {
+	case waiter.c <- now:
+	default:
+	}
+}
+
+func (waiter *fakeWaiter) Stop() bool {
+	waiter.clock.Lock()
+	defer waiter.clock.Unlock()
+	return waiter.clock.remove(waiter)
+}
+
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (ticker fakeTicker) Stop() {
+	ticker.fakeWaiter.Stop()
+}
@@ -0,0 +1,76 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFake(start)
+	timer := clock.NewTimer(3 * time.Second)
+	stopped := clock.NewTimer(time.Second)
+	ticker := clock.NewTicker(2 * time.Second)
+
+	if !stopped.Stop() {
+		t.Error("expected running timer to stop")
+	}
+	clock.Advance(2 * time.Second)
+	select {
+	case now := <-ticker.C():
+		if expected := start.Add(2 * time.Second); !now.Equal(expected) {
+			t.Errorf("expected tick at: %s, got: %s", expected, now)
+		}
+	default:
+		t.Error("expected ticker to fire")
+	}
+	select {
+	case <-timer.C():
+		t.Error("expected timer not to fire before it is due")
+	case <-stopped.C():
+		t.Error("expected stopped timer not to fire")
+	default:
+	}
+
+	clock.Advance(2 * time.Second)
+	if expected := start.Add(4 * time.Second); !clock.Now().Equal(expected) {
+		t.Errorf("expected now: %s, got: %s", expected, clock.Now())
+	}
+	if now := <-timer.C(); !now.Equal(start.Add(3 * time.Second)) {
+		t.Errorf("expected timer to fire when due, got: %s", now)
+	}
+	if timer.Stop() {
+		t.Error("expected fired timer not to be running")
+	}
+	if now := <-ticker.C(); !now.Equal(start.Add(4 * time.Second)) {
+		t.Errorf("expected ticker to fire again, got: %s", now)
+	}
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Error("expected stopped ticker not to fire")
+	default:
+	}
+
+	if expired := clock.NewTimer(0); len(expired.C()) != 1 {
+		t.Error("expected timer without duration to fire right away")
+	}
+}
+
+func TestFake_BlockUntil(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFake(start)
+	tickC := make(chan time.Time)
+	go func() {
+		ticker := clock.NewTicker(time.Second)
+		defer ticker.Stop()
+		tickC <- <-ticker.C()
+	}()
+	// Advancing before the goroutine has its ticker would not tick it.
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if now := <-tickC; !now.Equal(start.Add(time.Second)) {
+		t.Errorf("expected tick at: %s, got: %s", start.Add(time.Second), now)
+	}
+}
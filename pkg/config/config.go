@@ -6,18 +6,41 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 )
 
 type Data struct {
-	LogLevel       logrus.Level
-	Port           int
-	Host           string
-	Addr           string
-	MaxNumSessions int
-	MaxRollNumber  int
+	LogLevel            logrus.Level
+	Port                int
+	Host                string
+	Addr                string
+	MaxNumSessions      int
+	MaxRollNumber       int
+	Retention           time.Duration
+	TenantsFile         string
+	DrainTimeout        time.Duration
+	IdempotencyTTL      time.Duration
+	IdempotencyMaxKeys  int
+	AdminToken          string
+	APIKeysFile         string
+	RateLimitsFile      string
+	JWKSFile            string
+	JWKSURL             string
+	JWTIssuer           string
+	JWTAudience         string
+	JWTPlayerClaim      string
+	WebhookSecret       string
+	WebhookAllowPrivate bool
+	Keeper              string
+	SQLitePath          string
+	RedisURL            string
+	Randomness          string
+	RandomSeed          int64
+	RandomSequence      []int
 }
 
 func NewFromEnv(filenames ...string) (*Data, error) {
@@ -50,12 +73,99 @@ func NewFromEnv(filenames ...string) (*Data, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read env variable MAX_ROLL_NUM: %w", err)
 	}
+	retention := 5 * time.Minute
+	if v := os.Getenv("SESSION_RETENTION_SECONDS"); v != "" {
+		retentionSeconds, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read env variable SESSION_RETENTION_SECONDS: %w", err)
+		}
+		retention = time.Duration(retentionSeconds) * time.Second
+	}
+	drainTimeout := 30 * time.Second
+	if v := os.Getenv("SHUTDOWN_TIMEOUT_SECONDS"); v != "" {
+		drainSeconds, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read env variable SHUTDOWN_TIMEOUT_SECONDS: %w", err)
+		}
+		drainTimeout = time.Duration(drainSeconds) * time.Second
+	}
+	idempotencyTTL := 24 * time.Hour
+	if v := os.Getenv("IDEMPOTENCY_TTL_SECONDS"); v != "" {
+		ttlSeconds, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read env variable IDEMPOTENCY_TTL_SECONDS: %w", err)
+		}
+		idempotencyTTL = time.Duration(ttlSeconds) * time.Second
+	}
+	idempotencyMax := 10000
+	if v := os.Getenv("IDEMPOTENCY_MAX_KEYS"); v != "" {
+		if idempotencyMax, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("failed to read env variable IDEMPOTENCY_MAX_KEYS: %w", err)
+		}
+	}
+	var webhookAllowPrivate bool
+	if v := os.Getenv("WEBHOOK_ALLOW_PRIVATE"); v != "" {
+		if webhookAllowPrivate, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("failed to read env variable WEBHOOK_ALLOW_PRIVATE: %w", err)
+		}
+	}
+	keeper := os.Getenv("KEEPER")
+	if keeper == "" {
+		keeper = "local"
+	}
+	sqlitePath := os.Getenv("SQLITE_PATH")
+	if sqlitePath == "" {
+		sqlitePath = "dice.db"
+	}
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		redisURL = "redis://localhost:6379/0"
+	}
+	randomness := os.Getenv("RANDOMNESS")
+	var randomSeed int64
+	if randomness == "seeded" {
+		randomSeed, err = strconv.ParseInt(os.Getenv("RANDOM_SEED"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read env variable RANDOM_SEED: %w", err)
+		}
+	}
+	var randomSequence []int
+	if randomness == "sequence" {
+		for _, v := range strings.Split(os.Getenv("RANDOM_SEQUENCE"), ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read env variable RANDOM_SEQUENCE: %w", err)
+			}
+			randomSequence = append(randomSequence, n)
+		}
+	}
 	return &Data{
-		LogLevel:       logLevel,
-		Port:           port,
-		Host:           host,
-		Addr:           fmt.Sprintf("%s:%d", host, port),
-		MaxNumSessions: maxNumSessions,
-		MaxRollNumber:  maxRollNumber,
+		LogLevel:            logLevel,
+		Port:                port,
+		Host:                host,
+		Addr:                fmt.Sprintf("%s:%d", host, port),
+		MaxNumSessions:      maxNumSessions,
+		MaxRollNumber:       maxRollNumber,
+		Retention:           retention,
+		TenantsFile:         os.Getenv("TENANTS_FILE"),
+		DrainTimeout:        drainTimeout,
+		IdempotencyTTL:      idempotencyTTL,
+		IdempotencyMaxKeys:  idempotencyMax,
+		AdminToken:          os.Getenv("ADMIN_TOKEN"),
+		APIKeysFile:         os.Getenv("API_KEYS_FILE"),
+		RateLimitsFile:      os.Getenv("RATE_LIMITS_FILE"),
+		JWKSFile:            os.Getenv("JWKS_FILE"),
+		JWKSURL:             os.Getenv("JWKS_URL"),
+		JWTIssuer:           os.Getenv("JWT_ISSUER"),
+		JWTAudience:         os.Getenv("JWT_AUDIENCE"),
+		JWTPlayerClaim:      os.Getenv("JWT_PLAYER_CLAIM"),
+		WebhookSecret:       os.Getenv("WEBHOOK_SECRET"),
+		WebhookAllowPrivate: webhookAllowPrivate,
+		Keeper:              keeper,
+		SQLitePath:          sqlitePath,
+		RedisURL:            redisURL,
+		Randomness:          randomness,
+		RandomSeed:          randomSeed,
+		RandomSequence:      randomSequence,
 	}, nil
 }
@@ -0,0 +1,187 @@
+// Package dice parses and rolls dice expressions such as 2d6+3, 4d6kh3 or 1d10!.
+package dice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MaxNumDice    = 100
+	MaxNumSides   = 1000000
+	MaxModifier   = 1000000
+	MaxExplosions = 100
+)
+
+var ErrInvalidExpression = errors.New("invalid dice expression")
+
+var expressionRegexp = regexp.MustCompile(`^(\d*)d(\d+)(?:(kh|kl)(\d+))?(!)?(?:([+-])(\d+))?$`)
+
+// Expression is a parsed dice expression.
+//
+// NdM rolls N dice with M sides, khK/klK keeps the K highest/lowest dice,
+// ! explodes a die (rolls it again) every time it lands on its highest face,
+// adding every roll to the die's value before dice are kept, and +K/-K adds a
+// flat modifier to the total.
+type Expression struct {
+	NumDice     int
+	NumSides    int
+	KeepHighest int
+	KeepLowest  int
+	Explode     bool
+	Modifier    int
+}
+
+// Result of rolling an Expression. Dice holds every die that was rolled,
+// including explosions and dice that were not kept.
+type Result struct {
+	Dice  []int
+	Total int
+}
+
+func Parse(s string) (*Expression, error) {
+	m := expressionRegexp.FindStringSubmatch(strings.ToLower(strings.ReplaceAll(s, " ", "")))
+	if m == nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidExpression, s)
+	}
+	expr := &Expression{
+		NumDice: 1,
+		Explode: m[5] == "!",
+	}
+	var err error
+	if m[1] != "" {
+		if expr.NumDice, err = strconv.Atoi(m[1]); err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", ErrInvalidExpression, s, err)
+		}
+	}
+	if expr.NumSides, err = strconv.Atoi(m[2]); err != nil {
+		return nil, fmt.Errorf("%w: %q: %v", ErrInvalidExpression, s, err)
+	}
+	if m[3] != "" {
+		keep, err := strconv.Atoi(m[4])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", ErrInvalidExpression, s, err)
+		}
+		if keep < 1 {
+			return nil, fmt.Errorf("%w: %q: must keep at least 1 die", ErrInvalidExpression, s)
+		}
+		if m[3] == "kh" {
+			expr.KeepHighest = keep
+		} else {
+			expr.KeepLowest = keep
+		}
+	}
+	if m[6] != "" {
+		if expr.Modifier, err = strconv.Atoi(m[7]); err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", ErrInvalidExpression, s, err)
+		}
+		if m[6] == "-" {
+			expr.Modifier = -expr.Modifier
+		}
+	}
+	if err := expr.Validate(); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+func (expr *Expression) Validate() error {
+	if expr.NumDice < 1 || expr.NumDice > MaxNumDice {
+		return fmt.Errorf("%w: number of dice must be between 1 and %d", ErrInvalidExpression, MaxNumDice)
+	}
+	if expr.NumSides < 1 || expr.NumSides > MaxNumSides {
+		return fmt.Errorf("%w: number of sides must be between 1 and %d", ErrInvalidExpression, MaxNumSides)
+	}
+	if expr.KeepHighest != 0 && expr.KeepLowest != 0 {
+		return fmt.Errorf("%w: cannot keep both highest and lowest", ErrInvalidExpression)
+	}
+	if expr.KeepHighest < 0 || expr.KeepHighest > expr.NumDice || expr.KeepLowest < 0 || expr.KeepLowest > expr.NumDice {
+		return fmt.Errorf("%w: number of dice to keep must be between 1 and %d", ErrInvalidExpression, expr.NumDice)
+	}
+	if expr.Explode && expr.NumSides < 2 {
+		return fmt.Errorf("%w: exploding dice need at least 2 sides", ErrInvalidExpression)
+	}
+	if expr.Modifier < -MaxModifier || expr.Modifier > MaxModifier {
+		return fmt.Errorf("%w: modifier must be between -%d and %d", ErrInvalidExpression, MaxModifier, MaxModifier)
+	}
+	return nil
+}
+
+// Roll the expression, intn must return a number in the range [0,n).
+func (expr *Expression) Roll(intn func(n int) int) Result {
+	var rolls []int
+	values := make([]int, 0, expr.NumDice)
+	for i := 0; i < expr.NumDice; i++ {
+		roll := intn(expr.NumSides) + 1
+		rolls = append(rolls, roll)
+		value := roll
+		for explosions := 0; expr.Explode && roll == expr.NumSides && explosions < MaxExplosions; explosions++ {
+			roll = intn(expr.NumSides) + 1
+			rolls = append(rolls, roll)
+			value += roll
+		}
+		values = append(values, value)
+	}
+	kept := values
+	if expr.KeepHighest > 0 || expr.KeepLowest > 0 {
+		kept = make([]int, len(values))
+		copy(kept, values)
+		sort.Ints(kept)
+		if expr.KeepHighest > 0 {
+			kept = kept[len(kept)-expr.KeepHighest:]
+		} else {
+			kept = kept[:expr.KeepLowest]
+		}
+	}
+	total := expr.Modifier
+	for _, roll := range kept {
+		total += roll
+	}
+	return Result{
+		Dice:  rolls,
+		Total: total,
+	}
+}
+
+func (expr *Expression) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%dd%d", expr.NumDice, expr.NumSides)
+	if expr.KeepHighest > 0 {
+		fmt.Fprintf(&sb, "kh%d", expr.KeepHighest)
+	}
+	if expr.KeepLowest > 0 {
+		fmt.Fprintf(&sb, "kl%d", expr.KeepLowest)
+	}
+	if expr.Explode {
+		sb.WriteString("!")
+	}
+	if expr.Modifier > 0 {
+		fmt.Fprintf(&sb, "+%d", expr.Modifier)
+	}
+	if expr.Modifier < 0 {
+		fmt.Fprintf(&sb, "%d", expr.Modifier)
+	}
+	return sb.String()
+}
+
+func (expr *Expression) MarshalJSON() ([]byte, error) {
+	return json.Marshal(expr.String())
+}
+
+func (expr *Expression) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*expr = *parsed
+	return nil
+}
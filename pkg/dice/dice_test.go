@@ -0,0 +1,148 @@
+package dice
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	type testcase struct {
+		Name          string
+		Input         string
+		ExpectedExpr  *Expression
+		ExpectedError error
+	}
+	testcases := []testcase{
+		{
+			Name:         "Single die",
+			Input:        "d20",
+			ExpectedExpr: &Expression{NumDice: 1, NumSides: 20},
+		},
+		{
+			Name:         "Modifier",
+			Input:        "2d6+3",
+			ExpectedExpr: &Expression{NumDice: 2, NumSides: 6, Modifier: 3},
+		},
+		{
+			Name:         "Negative modifier",
+			Input:        "2d6-1",
+			ExpectedExpr: &Expression{NumDice: 2, NumSides: 6, Modifier: -1},
+		},
+		{
+			Name:         "Keep highest",
+			Input:        "4d6kh3",
+			ExpectedExpr: &Expression{NumDice: 4, NumSides: 6, KeepHighest: 3},
+		},
+		{
+			Name:         "Keep lowest",
+			Input:        "2d20kl1",
+			ExpectedExpr: &Expression{NumDice: 2, NumSides: 20, KeepLowest: 1},
+		},
+		{
+			Name:         "Exploding",
+			Input:        "1d10!",
+			ExpectedExpr: &Expression{NumDice: 1, NumSides: 10, Explode: true},
+		},
+		{
+			Name:          "Garbage",
+			Input:         "2x6",
+			ExpectedError: ErrInvalidExpression,
+		},
+		{
+			Name:          "Keep more than rolled",
+			Input:         "2d6kh3",
+			ExpectedError: ErrInvalidExpression,
+		},
+		{
+			Name:          "Keep zero",
+			Input:         "2d6kh0",
+			ExpectedError: ErrInvalidExpression,
+		},
+		{
+			Name:          "Exploding single sided die",
+			Input:         "1d1!",
+			ExpectedError: ErrInvalidExpression,
+		},
+		{
+			Name:          "Too many dice",
+			Input:         "1000d6",
+			ExpectedError: ErrInvalidExpression,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			expr, err := Parse(tc.Input)
+			if !errors.Is(err, tc.ExpectedError) {
+				t.Fatalf("expected error: %v, got: %v", tc.ExpectedError, err)
+			}
+			if !reflect.DeepEqual(tc.ExpectedExpr, expr) {
+				t.Errorf("expected expression: %+v, got: %+v", tc.ExpectedExpr, expr)
+			}
+		})
+	}
+}
+
+func TestExpression_Roll(t *testing.T) {
+	type testcase struct {
+		Name           string
+		Input          string
+		Sequence       []int
+		ExpectedResult Result
+	}
+	testcases := []testcase{
+		{
+			Name:           "Sum with modifier",
+			Input:          "2d6+3",
+			Sequence:       []int{0, 5},
+			ExpectedResult: Result{Dice: []int{1, 6}, Total: 10},
+		},
+		{
+			Name:           "Keep highest",
+			Input:          "4d6kh3",
+			Sequence:       []int{0, 3, 5, 1},
+			ExpectedResult: Result{Dice: []int{1, 4, 6, 2}, Total: 12},
+		},
+		{
+			Name:           "Keep lowest",
+			Input:          "2d20kl1",
+			Sequence:       []int{14, 2},
+			ExpectedResult: Result{Dice: []int{15, 3}, Total: 3},
+		},
+		{
+			Name:           "Exploding",
+			Input:          "1d10!",
+			Sequence:       []int{9, 9, 3},
+			ExpectedResult: Result{Dice: []int{10, 10, 4}, Total: 24},
+		},
+		{
+			Name:           "Keep highest exploded die",
+			Input:          "2d6kh1!",
+			Sequence:       []int{5, 2, 4},
+			ExpectedResult: Result{Dice: []int{6, 3, 5}, Total: 9},
+		},
+		{
+			Name:           "Keep lowest exploded die",
+			Input:          "2d6kl1!",
+			Sequence:       []int{5, 0, 3},
+			ExpectedResult: Result{Dice: []int{6, 1, 4}, Total: 4},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			expr, err := Parse(tc.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			i := 0
+			result := expr.Roll(func(n int) int {
+				v := tc.Sequence[i]
+				i++
+				return v
+			})
+			if !reflect.DeepEqual(tc.ExpectedResult, result) {
+				t.Errorf("expected result: %+v, got: %+v", tc.ExpectedResult, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Package fair derives provably fair random numbers from a committed server seed.
+//
+// The server commits to Hash(serverSeed) before any roll is made and reveals
+// the seed once the session is closed. Every roll is derived from the server
+// seed, the client seed the player submitted, the player ID and the round, so
+// anyone holding the revealed seed can recompute it.
+package fair
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+)
+
+const SeedLength = 32
+
+// NewSeed returns a random hex encoded seed read from crypto/rand.
+func NewSeed() (string, error) {
+	seed := make([]byte, SeedLength)
+	if _, err := rand.Read(seed); err != nil {
+		return "", fmt.Errorf("failed to generate seed: %w", err)
+	}
+	return hex.EncodeToString(seed), nil
+}
+
+// Hash returns the commitment published for a server seed.
+func Hash(serverSeed string) string {
+	sum := sha256.Sum256([]byte(serverSeed))
+	return hex.EncodeToString(sum[:])
+}
+
+// Source is a deterministic stream of numbers for a single roll.
+type Source struct {
+	serverSeed string
+	message    string
+	counter    int
+	buf        []byte
+}
+
+func NewSource(serverSeed, clientSeed, playerID string, round int) *Source {
+	return &Source{
+		serverSeed: serverSeed,
+		message:    fmt.Sprintf("%s:%s:%d", clientSeed, playerID, round),
+	}
+}
+
+// Intn returns a uniformly distributed number in the range [0,n).
+func (src *Source) Intn(n int) int {
+	if n <= 0 {
+		panic("invalid argument to Intn")
+	}
+	max := uint64(n)
+	limit := math.MaxUint64 - math.MaxUint64%max
+	for {
+		if v := src.uint64(); v < limit {
+			return int(v % max)
+		}
+	}
+}
+
+func (src *Source) uint64() uint64 {
+	if len(src.buf) < 8 {
+		mac := hmac.New(sha256.New, []byte(src.serverSeed))
+		fmt.Fprintf(mac, "%s:%d", src.message, src.counter)
+		src.counter++
+		src.buf = mac.Sum(nil)
+	}
+	v := binary.BigEndian.Uint64(src.buf[:8])
+	src.buf = src.buf[8:]
+	return v
+}
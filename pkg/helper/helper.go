@@ -10,10 +10,14 @@ func init() {
 }
 
 func RandomString(n int) string {
+	return RandomStringFrom(rand.Intn, n)
+}
+
+func RandomStringFrom(intn func(n int) int, n int) string {
 	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 	s := make([]rune, n)
 	for i := range s {
-		s[i] = letters[rand.Intn(len(letters))]
+		s[i] = letters[intn(len(letters))]
 	}
 	return string(s)
 }
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rgynn/dice/pkg/session"
+)
+
+var openSessionsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "open_sessions"),
+	"Sessions still open, read from the keeper when scraped.",
+	nil, nil,
+)
+
+// Keeper records metrics about the sessions and rolls of the Keeper it wraps.
+// It follows every session it creates until it closes, so with several
+// replicas each one counts the sessions created and closed through it. Open
+// sessions are counted by the wrapped Keeper instead, across the default
+// tenant and Tenants, so they include those of other replicas and those
+// reloaded after a restart.
+type Keeper struct {
+	session.Keeper
+	Metrics *Metrics
+	Tenants session.Tenants
+}
+
+// NewKeeper wraps keeper, registering its open sessions with m.
+func NewKeeper(keeper session.Keeper, m *Metrics) *Keeper {
+	svc := &Keeper{Keeper: keeper, Metrics: m}
+	m.Registry.MustRegister(openSessionsCollector{keeper: svc})
+	return svc
+}
+
+func (svc *Keeper) NewSession(ctx context.Context, tenant string, opts session.Options) (*session.Session, error) {
+	sess, err := svc.Keeper.NewSession(ctx, tenant, opts)
+	if err != nil {
+		return nil, err
+	}
+	svc.Metrics.SessionsCreated.Inc()
+	eventC, err := svc.Keeper.SubscribeSession(context.Background(), tenant, sess.ID)
+	if err != nil {
+		return sess, nil
+	}
+	go svc.watch(sess, eventC)
+	return sess, nil
+}
+
+func (svc *Keeper) AddSessionRoll(ctx context.Context, tenant, sessionID, playerID string, opts session.RollOptions) (chan session.Result, *session.Roll, error) {
+	resultC, roll, err := svc.Keeper.AddSessionRoll(ctx, tenant, sessionID, playerID, opts)
+	if err != nil {
+		svc.Metrics.RollsRejected.WithLabelValues(rollErrorLabel(err)).Inc()
+		return nil, nil, err
+	}
+	svc.Metrics.RollsAccepted.Inc()
+	return resultC, roll, nil
+}
+
+// watch records the session closing, the events channel is closed after it.
+func (svc *Keeper) watch(sess *session.Session, eventC chan session.Event) {
+	for event := range eventC {
+		if event.Type != session.EventSessionClosed {
+			continue
+		}
+		reason := event.Reason
+		if reason == "" {
+			reason = session.CloseReasonClosed
+			if event.Result != nil && event.Result.Cancelled {
+				reason = session.CloseReasonCancelled
+			}
+		}
+		svc.Metrics.SessionsClosed.WithLabelValues(string(reason)).Inc()
+		svc.Metrics.SessionLifetime.Observe(time.Since(sess.CreatedAt).Seconds())
+	}
+}
+
+// openSessions counts the open sessions of every tenant.
+func (svc *Keeper) openSessions(ctx context.Context) (int, error) {
+	var n int
+	for _, tenant := range append([]string{session.DefaultTenant}, svc.Tenants.Names()...) {
+		count, err := svc.Keeper.CountOpenSessions(ctx, tenant)
+		if err != nil {
+			return 0, err
+		}
+		n += count
+	}
+	return n, nil
+}
+
+// openSessionsCollector reads the number of open sessions when scraped.
+type openSessionsCollector struct {
+	keeper *Keeper
+}
+
+func (c openSessionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- openSessionsDesc
+}
+
+func (c openSessionsCollector) Collect(ch chan<- prometheus.Metric) {
+	n, err := c.keeper.openSessions(context.Background())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(openSessionsDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(openSessionsDesc, prometheus.GaugeValue, float64(n))
+}
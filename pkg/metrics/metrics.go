@@ -0,0 +1,102 @@
+// Package metrics exposes Prometheus metrics about sessions, rolls and HTTP requests.
+package metrics
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rgynn/dice/pkg/session"
+)
+
+const namespace = "dice"
+
+type Metrics struct {
+	Registry        *prometheus.Registry
+	SessionsCreated prometheus.Counter
+	SessionsClosed  *prometheus.CounterVec
+	SessionLifetime prometheus.Histogram
+	RollsAccepted   prometheus.Counter
+	RollsRejected   *prometheus.CounterVec
+	RequestDuration *prometheus.HistogramVec
+}
+
+// New returns metrics registered with a registry of their own, along with
+// the Go runtime and process collectors.
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		SessionsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sessions_created_total",
+			Help:      "Sessions created.",
+		}),
+		SessionsClosed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sessions_closed_total",
+			Help:      "Sessions closed, by reason: all_players, timeout, closed, cancelled or shutdown.",
+		}, []string{"reason"}),
+		SessionLifetime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "session_lifetime_seconds",
+			Help:      "Time from creating a session until it closed.",
+			Buckets:   []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+		}),
+		RollsAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rolls_accepted_total",
+			Help:      "Rolls added to a session.",
+		}),
+		RollsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rolls_rejected_total",
+			Help:      "Rolls rejected, by error.",
+		}, []string{"error"}),
+		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time spent serving HTTP requests, by route, method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+	}
+	m.Registry.MustRegister(
+		m.SessionsCreated,
+		m.SessionsClosed,
+		m.SessionLifetime,
+		m.RollsAccepted,
+		m.RollsRejected,
+		m.RequestDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// rollErrors are the labels rejected rolls are counted by, anything else is "other".
+var rollErrors = []struct {
+	Err   error
+	Label string
+}{
+	{session.ErrNotFound, "not_found"},
+	{session.ErrTenantNotFound, "tenant_not_found"},
+	{session.ErrSessionClosed, "session_closed"},
+	{session.ErrMaxNumPlayersReached, "max_num_players_reached"},
+	{session.ErrPlayerAlreadyRolled, "player_already_rolled"},
+	{session.ErrInvalidRollType, "invalid_roll_type"},
+}
+
+func rollErrorLabel(err error) string {
+	for _, rollErr := range rollErrors {
+		if errors.Is(err, rollErr.Err) {
+			return rollErr.Label
+		}
+	}
+	return "other"
+}
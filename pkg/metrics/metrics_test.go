@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rgynn/dice/pkg/middleware"
+	"github.com/rgynn/dice/pkg/random"
+	"github.com/rgynn/dice/pkg/session"
+	"github.com/rgynn/dice/pkg/session/local"
+)
+
+func TestKeeper(t *testing.T) {
+	ctx := context.Background()
+	m := New()
+	keeper, err := local.NewKeeper(2, 100, time.Minute, random.NewSeeded(42), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewKeeper(keeper, m)
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go svc.Run(runCtx)
+
+	full, err := svc.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled, err := svc.NewSession(ctx, session.DefaultTenant, session.Options{Creator: "x", MaxNumPlayers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2}); !errors.Is(err, session.ErrMaxNumSessionsReached) {
+		t.Errorf("expected error: %v, got: %v", session.ErrMaxNumSessionsReached, err)
+	}
+	if got := testutil.ToFloat64(openSessionsCollector{keeper: svc}); got != 2 {
+		t.Errorf("expected 2 open sessions, got: %v", got)
+	}
+
+	resultC, _, err := svc.AddSessionRoll(ctx, session.DefaultTenant, full.ID, "a", session.RollOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := svc.AddSessionRoll(ctx, session.DefaultTenant, full.ID, "a", session.RollOptions{}); !errors.Is(err, session.ErrPlayerAlreadyRolled) {
+		t.Errorf("expected error: %v, got: %v", session.ErrPlayerAlreadyRolled, err)
+	}
+	if _, _, err := svc.AddSessionRoll(ctx, session.DefaultTenant, full.ID, "b", session.RollOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	<-resultC
+	if _, _, err := svc.AddSessionRoll(ctx, session.DefaultTenant, "missing", "a", session.RollOptions{}); !errors.Is(err, session.ErrNotFound) {
+		t.Errorf("expected error: %v, got: %v", session.ErrNotFound, err)
+	}
+	if _, err := svc.CancelSession(ctx, session.DefaultTenant, cancelled.ID, session.Actor{PlayerID: "x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for testutil.ToFloat64(m.SessionsClosed.WithLabelValues("all_players"))+testutil.ToFloat64(m.SessionsClosed.WithLabelValues("cancelled")) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if got := testutil.ToFloat64(openSessionsCollector{keeper: svc}); got != 0 {
+		t.Errorf("expected no open sessions, got: %v", got)
+	}
+	// Sessions not created through the wrapper, e.g. by another replica,
+	// are open sessions all the same.
+	if _, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(openSessionsCollector{keeper: svc}); got != 1 {
+		t.Errorf("expected 1 open session, got: %v", got)
+	}
+	type testcase struct {
+		Name     string
+		Got      float64
+		Expected float64
+	}
+	tests := []testcase{
+		{Name: "created", Got: testutil.ToFloat64(m.SessionsCreated), Expected: 2},
+		{Name: "closed by all players", Got: testutil.ToFloat64(m.SessionsClosed.WithLabelValues("all_players")), Expected: 1},
+		{Name: "cancelled", Got: testutil.ToFloat64(m.SessionsClosed.WithLabelValues("cancelled")), Expected: 1},
+		{Name: "accepted rolls", Got: testutil.ToFloat64(m.RollsAccepted), Expected: 2},
+		{Name: "rolls rejected for player already rolled", Got: testutil.ToFloat64(m.RollsRejected.WithLabelValues("player_already_rolled")), Expected: 1},
+		{Name: "rolls rejected for session not found", Got: testutil.ToFloat64(m.RollsRejected.WithLabelValues("not_found")), Expected: 1},
+		{Name: "session lifetimes", Got: float64(testutil.CollectAndCount(m.SessionLifetime)), Expected: 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			if tc.Got != tc.Expected {
+				t.Errorf("expected: %v, got: %v", tc.Expected, tc.Got)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New()
+	router := mux.NewRouter()
+	router.Use(m.Middleware)
+	router.HandleFunc("/sessions/{sessionID}/events", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher.Flush()
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/sessions/{sessionID}/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}).Methods(http.MethodGet)
+	router.Handle("/metrics", m.Handler()).Methods(http.MethodGet)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/sessions/abc/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("expected event stream, got: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/sessions/abc/ws", nil)
+	if err != nil {
+		t.Fatalf("expected websocket upgrade through the middleware, got: %v", err)
+	}
+	conn.Close()
+
+	// The websocket request is recorded once its handler returns.
+	var body []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if body = scrape(t, srv.URL+"/metrics"); strings.Contains(string(body), `route="/sessions/{sessionID}/ws"`) {
+			break
+		}
+	}
+	for _, expected := range []string{
+		`dice_http_request_duration_seconds_count{code="200",method="GET",route="/sessions/{sessionID}/events"} 1`,
+		`dice_http_request_duration_seconds_count{code="101",method="GET",route="/sessions/{sessionID}/ws"} 1`,
+		`dice_sessions_created_total 0`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected metrics to contain: %s, got:\n%s", expected, body)
+		}
+	}
+}
+
+func scrape(t *testing.T, url string) []byte {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestWatchRateLimits(t *testing.T) {
+	m := New()
+	limiter := middleware.NewRateLimiter(middleware.RateLimit{Rate: 1, Burst: 1})
+	m.WatchRateLimits(middleware.RateLimits{"create_session": limiter})
+	limiter.Allow("a")
+	limiter.Allow("a")
+	limiter.Allow("b")
+
+	srv := httptest.NewServer(m.Handler())
+	defer srv.Close()
+	body := scrape(t, srv.URL)
+	for _, expected := range []string{
+		`dice_rate_limit_clients{route="create_session"} 2`,
+		`dice_rate_limit_requests_total{result="allowed",route="create_session"} 2`,
+		`dice_rate_limit_requests_total{result="limited",route="create_session"} 1`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected metrics to contain: %s, got:\n%s", expected, body)
+		}
+	}
+}
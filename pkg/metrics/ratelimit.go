@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rgynn/dice/pkg/middleware"
+)
+
+var (
+	rateLimitClientsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "rate_limit_clients"),
+		"Clients with a rate limit bucket that hasn't filled up again, by route.",
+		[]string{"route"}, nil,
+	)
+	rateLimitRequestsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "rate_limit_requests_total"),
+		"Requests checked against a rate limit, by route and result: allowed or limited.",
+		[]string{"route", "result"}, nil,
+	)
+)
+
+// rateLimitCollector reads the state of rate limiters when scraped.
+type rateLimitCollector struct {
+	limits middleware.RateLimits
+}
+
+func (c rateLimitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rateLimitClientsDesc
+	ch <- rateLimitRequestsDesc
+}
+
+func (c rateLimitCollector) Collect(ch chan<- prometheus.Metric) {
+	for route, limiter := range c.limits {
+		stats := limiter.Stats()
+		ch <- prometheus.MustNewConstMetric(rateLimitClientsDesc, prometheus.GaugeValue, float64(stats.Clients), route)
+		ch <- prometheus.MustNewConstMetric(rateLimitRequestsDesc, prometheus.CounterValue, float64(stats.Allowed), route, "allowed")
+		ch <- prometheus.MustNewConstMetric(rateLimitRequestsDesc, prometheus.CounterValue, float64(stats.Limited), route, "limited")
+	}
+}
+
+// WatchRateLimits exposes the clients and requests of every rate limiter.
+func (m *Metrics) WatchRateLimits(limits middleware.RateLimits) {
+	m.Registry.MustRegister(rateLimitCollector{limits: limits})
+}
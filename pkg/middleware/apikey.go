@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rgynn/dice/pkg/helper"
+	"github.com/rgynn/dice/pkg/random"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey is what is stored for a key, the key itself is only known to its holder.
+type APIKey struct {
+	Hash     string  `json:"hash"`
+	PlayerID string  `json:"player_id"`
+	Scopes   []Scope `json:"scopes"`
+}
+
+// APIKeyStore looks up API keys by the hash of the key.
+type APIKeyStore interface {
+	GetAPIKey(ctx context.Context, hash string) (*APIKey, error)
+}
+
+// NewAPIKey returns a random key and its hash, the key is shown once to its
+// holder and only the hash is stored.
+func NewAPIKey() (key, hash string) {
+	key = "dk_" + helper.RandomStringFrom(random.NewCrypto().Intn, 40)
+	return key, HashAPIKey(key)
+}
+
+// HashAPIKey returns the hex encoded SHA-256 of the key. Keys are random, so
+// unlike passwords they need no salt or slow hash.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryAPIKeyStore keeps API keys in memory.
+type MemoryAPIKeyStore struct {
+	keys map[string]APIKey
+	sync.RWMutex
+}
+
+func NewMemoryAPIKeyStore(keys ...APIKey) (*MemoryAPIKeyStore, error) {
+	store := &MemoryAPIKeyStore{keys: map[string]APIKey{}}
+	for _, key := range keys {
+		if err := store.AddAPIKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// LoadAPIKeys reads a JSON array of API keys from the file at path.
+func LoadAPIKeys(path string) (*MemoryAPIKeyStore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to read api keys from %s: %w", path, err)
+	}
+	return NewMemoryAPIKeyStore(keys...)
+}
+
+func (store *MemoryAPIKeyStore) AddAPIKey(key APIKey) error {
+	if len(key.Hash) != sha256.Size*2 {
+		return fmt.Errorf("api key for %q: hash must be a hex encoded sha256", key.PlayerID)
+	}
+	for _, scope := range key.Scopes {
+		if !scope.Valid() {
+			return fmt.Errorf("api key for %q: unknown scope: %s", key.PlayerID, scope)
+		}
+	}
+	store.Lock()
+	store.keys[strings.ToLower(key.Hash)] = key
+	store.Unlock()
+	return nil
+}
+
+func (store *MemoryAPIKeyStore) GetAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	store.RLock()
+	key, ok := store.keys[hash]
+	store.RUnlock()
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &key, nil
+}
+
+// APIKeyMiddleware identifies callers by the API key sent as a bearer token
+// or in the X-API-Key header, requests without a known key are rejected. The
+// player is the one the key was issued to, whatever the request claims.
+func APIKeyMiddleware(store APIKeyStore, onError ErrorFunc) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := apiKeyFromRequest(r)
+			if key == "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				onError(w, r, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+			apiKey, err := store.GetAPIKey(r.Context(), HashAPIKey(key))
+			if errors.Is(err, ErrAPIKeyNotFound) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				onError(w, r, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+			if err != nil {
+				onError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			identity := &Identity{
+				PlayerID: apiKey.PlayerID,
+				Verified: true,
+				Scopes:   apiKey.Scopes,
+			}
+			for _, scope := range apiKey.Scopes {
+				if scope == ScopeAdmin {
+					identity.Admin = true
+				}
+			}
+			h.ServeHTTP(w, r.WithContext(IdentityContext(r.Context(), identity)))
+		})
+	}
+}
+
+// apiKeyFromRequest returns the API key sent in the X-API-Key header or as a
+// bearer token, empty if there is none.
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	playerKey, playerHash := NewAPIKey()
+	watcherKey, watcherHash := NewAPIKey()
+	adminKey, adminHash := NewAPIKey()
+	store, err := NewMemoryAPIKeyStore(
+		APIKey{Hash: playerHash, PlayerID: "alice", Scopes: []Scope{ScopeSessionCreate, ScopeSessionRoll}},
+		APIKey{Hash: watcherHash, PlayerID: "bob"},
+		APIKey{Hash: adminHash, Scopes: []Scope{ScopeAdmin}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onError := func(w http.ResponseWriter, r *http.Request, status int, err error) {
+		http.Error(w, err.Error(), status)
+	}
+	handler := APIKeyMiddleware(store, onError)(RequireScope(ScopeSessionRoll, onError)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := IdentityFromContext(r.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(w, "%+v", *identity)
+	})))
+
+	type testcase struct {
+		Name           string
+		Header         http.Header
+		ExpectedStatus int
+		ExpectedBody   string
+	}
+	testcases := []testcase{
+		{
+			Name:           "Bearer token",
+			Header:         http.Header{"Authorization": {"Bearer " + playerKey}},
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   "{PlayerID:alice Admin:false Verified:true Scopes:[session:create session:roll]}",
+		},
+		{
+			Name:           "X-API-Key header",
+			Header:         http.Header{"X-Api-Key": {playerKey}, "X-Player-Id": {"mallory"}},
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   "{PlayerID:alice Admin:false Verified:true Scopes:[session:create session:roll]}",
+		},
+		{
+			Name:           "Admin",
+			Header:         http.Header{"Authorization": {"Bearer " + adminKey}},
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   "{PlayerID: Admin:true Verified:true Scopes:[admin]}",
+		},
+		{
+			Name:           "Missing scope",
+			Header:         http.Header{"Authorization": {"Bearer " + watcherKey}},
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedBody:   ErrInsufficientScope.Error() + "\n",
+		},
+		{
+			Name:           "Unknown key",
+			Header:         http.Header{"Authorization": {"Bearer dk_unknown"}},
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedBody:   ErrUnauthorized.Error() + "\n",
+		},
+		{
+			Name:           "No key",
+			Header:         http.Header{"X-Player-Id": {"alice"}},
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedBody:   ErrUnauthorized.Error() + "\n",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.Header = tc.Header
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if want, got := tc.ExpectedStatus, w.Code; want != got {
+				t.Errorf("expected http status code: %v, got: %v", want, got)
+			}
+			if want, got := tc.ExpectedBody, w.Body.String(); want != got {
+				t.Errorf("expected http response body: %s, got: %s", want, got)
+			}
+		})
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	key, hash := NewAPIKey()
+	type testcase struct {
+		Name          string
+		Input         string
+		ExpectedError bool
+	}
+	testcases := []testcase{
+		{Name: "Valid", Input: `[{"hash":"` + hash + `","player_id":"alice","scopes":["session:roll"]}]`},
+		{Name: "Unknown scope", Input: `[{"hash":"` + hash + `","player_id":"alice","scopes":["session:delete"]}]`, ExpectedError: true},
+		{Name: "Plain key instead of hash", Input: `[{"hash":"` + key + `","player_id":"alice"}]`, ExpectedError: true},
+		{Name: "Not json", Input: `alice`, ExpectedError: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.json")
+			if err := os.WriteFile(path, []byte(tc.Input), 0600); err != nil {
+				t.Fatal(err)
+			}
+			store, err := LoadAPIKeys(path)
+			if tc.ExpectedError {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			apiKey, err := store.GetAPIKey(context.Background(), HashAPIKey(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (&APIKey{Hash: hash, PlayerID: "alice", Scopes: []Scope{ScopeSessionRoll}}); !reflect.DeepEqual(want, apiKey) {
+				t.Errorf("expected api key: %+v, got: %+v", want, apiKey)
+			}
+		})
+	}
+}
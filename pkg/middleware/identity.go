@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+// Scope is something an identity is allowed to do.
+type Scope string
+
+const (
+	ScopeSessionCreate Scope = "session:create"
+	ScopeSessionRoll   Scope = "session:roll"
+	ScopeAdmin         Scope = "admin"
+)
+
+func (scope Scope) Valid() bool {
+	switch scope {
+	case ScopeSessionCreate, ScopeSessionRoll, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+var ErrUnauthorized = errors.New("missing or invalid credentials")
+var ErrInsufficientScope = errors.New("not allowed to do this")
+var ErrPlayerMismatch = errors.New("not allowed to act as this player")
+
+// Identity of the caller. Verified is set when PlayerID was proven, e.g. by
+// an API key, rather than claimed by the X-Player-ID header. Admin may act
+// as any player and has every scope.
+type Identity struct {
+	PlayerID string
+	Admin    bool
+	Verified bool
+	Scopes   []Scope
+}
+
+func (identity *Identity) HasScope(scope Scope) bool {
+	if identity.Admin {
+		return true
+	}
+	for _, s := range identity.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ActAs returns ErrPlayerMismatch when a verified identity other than an
+// admin tries to act as another player, claimed identities may act as anyone.
+func (identity *Identity) ActAs(playerID string) error {
+	if identity.Verified && !identity.Admin && identity.PlayerID != playerID {
+		return ErrPlayerMismatch
+	}
+	return nil
+}
+
+type IdentityContextKey struct{}
+
+func IdentityContext(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, IdentityContextKey{}, identity)
+}
+
+func IdentityFromContext(ctx context.Context) (*Identity, error) {
+	identity, ok := ctx.Value(IdentityContextKey{}).(*Identity)
+	if !ok {
+		return nil, errors.New("failed to type assert *Identity from context")
+	}
+	return identity, nil
+}
+
+// HeaderIdentityMiddleware trusts the X-Player-ID header, so anyone may create
+// sessions and roll as any player. Admin is set when the X-Admin-Token header
+// matches the configured admin token.
+func HeaderIdentityMiddleware(adminToken string) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get("X-Admin-Token")
+			identity := &Identity{
+				PlayerID: r.Header.Get("X-Player-ID"),
+				Admin:    adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1,
+				Scopes:   []Scope{ScopeSessionCreate, ScopeSessionRoll},
+			}
+			h.ServeHTTP(w, r.WithContext(IdentityContext(r.Context(), identity)))
+		})
+	}
+}
+
+// ErrorFunc writes an error response, e.g. api.NewErrorResponse.
+type ErrorFunc func(w http.ResponseWriter, r *http.Request, status int, err error)
+
+// RequireScope only lets requests through whose identity has the scope.
+func RequireScope(scope Scope, onError ErrorFunc) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, err := IdentityFromContext(r.Context())
+			if err != nil {
+				onError(w, r, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+			if !identity.HasScope(scope) {
+				onError(w, r, http.StatusForbidden, ErrInsufficientScope)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// DefaultJWKSRefreshInterval is how often a JWKS fetched from a URL may be
+// fetched again when a token is signed with a key it doesn't hold.
+const DefaultJWKSRefreshInterval = time.Minute
+
+var ErrUnknownKey = errors.New("token signed with an unknown key")
+
+// JWK is a public key in a JSON Web Key Set, see RFC 7517. RSA, EC (P-256,
+// P-384 and P-521) and OKP (Ed25519) keys are supported.
+type JWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS holds the keys tokens are verified with by key id, read from a file
+// or fetched from a URL. Keys fetched from a URL are fetched again, at most
+// once per RefreshInterval, when a token names a key they don't hold, so the
+// identity provider can rotate its keys.
+type JWKS struct {
+	URL             string
+	RefreshInterval time.Duration
+	HTTPClient      *http.Client
+	keys            map[string]interface{}
+	fetchedAt       time.Time
+	sync.Mutex
+}
+
+// NewJWKSFromFile reads a JSON Web Key Set from the file at path.
+func NewJWKSFromFile(path string) (*JWKS, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks from %s: %w", path, err)
+	}
+	return &JWKS{keys: keys}, nil
+}
+
+// NewJWKSFromURL fetches a JSON Web Key Set from url, e.g. the jwks_uri of an
+// OpenID Connect provider.
+func NewJWKSFromURL(ctx context.Context, url string) (*JWKS, error) {
+	jwks := &JWKS{
+		URL:             url,
+		RefreshInterval: DefaultJWKSRefreshInterval,
+		HTTPClient:      &http.Client{Timeout: 10 * time.Second},
+	}
+	if err := jwks.fetch(ctx); err != nil {
+		return nil, err
+	}
+	return jwks, nil
+}
+
+// Key returns the key a token is verified with, it is a jwt.Keyfunc. Tokens
+// without a key id may be verified with the only key of a set.
+func (jwks *JWKS) Key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	jwks.Lock()
+	defer jwks.Unlock()
+	if key, ok := jwks.lookup(kid); ok {
+		return key, nil
+	}
+	if jwks.URL == "" || time.Since(jwks.fetchedAt) < jwks.RefreshInterval {
+		return nil, ErrUnknownKey
+	}
+	if err := jwks.fetchLocked(context.Background()); err != nil {
+		return nil, err
+	}
+	if key, ok := jwks.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// lookup must be called with the set locked.
+func (jwks *JWKS) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(jwks.keys) == 1 {
+		for _, key := range jwks.keys {
+			return key, true
+		}
+	}
+	key, ok := jwks.keys[kid]
+	return key, ok
+}
+
+func (jwks *JWKS) fetch(ctx context.Context) error {
+	jwks.Lock()
+	defer jwks.Unlock()
+	return jwks.fetchLocked(ctx)
+}
+
+func (jwks *JWKS) fetchLocked(ctx context.Context) error {
+	jwks.fetchedAt = time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwks.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := jwks.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch jwks from %s: %w", jwks.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch jwks from %s: %s", jwks.URL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("failed to read jwks from %s: %w", jwks.URL, err)
+	}
+	jwks.keys = keys
+	return nil
+}
+
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// PublicKey returns the *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+// the JWK describes.
+func (jwk JWK) PublicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", jwk.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
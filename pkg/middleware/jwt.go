@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// DefaultPlayerClaim is the claim holding the player ID unless configured otherwise.
+const DefaultPlayerClaim = "sub"
+
+// jwtMethods are the signing algorithms accepted, all of them asymmetric so a
+// public key can never be used as an HMAC secret.
+var jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// JWTConfig configures JWTMiddleware. Issuer and Audience are checked when
+// set, PlayerClaim defaults to DefaultPlayerClaim.
+type JWTConfig struct {
+	Keys        *JWKS
+	Issuer      string
+	Audience    string
+	PlayerClaim string
+}
+
+// JWTMiddleware identifies callers by a bearer JWT signed with one of the
+// configured keys, requests without a valid token are rejected. Tokens must
+// have an expiry so a leaked one doesn't stay valid forever. The player is
+// the PlayerClaim of the token, whatever the request claims. Every token may
+// create sessions and roll, admin is granted by an "admin" entry in the
+// space separated scope claim.
+func JWTMiddleware(cfg JWTConfig, onError ErrorFunc) func(h http.Handler) http.Handler {
+	playerClaim := cfg.PlayerClaim
+	if playerClaim == "" {
+		playerClaim = DefaultPlayerClaim
+	}
+	parser := jwt.NewParser(jwt.WithValidMethods(jwtMethods))
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				onError(w, r, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+			claims := jwt.MapClaims{}
+			_, err := parser.ParseWithClaims(strings.TrimPrefix(auth, "Bearer "), claims, cfg.Keys.Key)
+			playerID, _ := claims[playerClaim].(string)
+			switch {
+			case err != nil,
+				!claims.VerifyExpiresAt(time.Now().Unix(), true),
+				cfg.Issuer != "" && !claims.VerifyIssuer(cfg.Issuer, true),
+				cfg.Audience != "" && !claims.VerifyAudience(cfg.Audience, true),
+				playerID == "":
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				onError(w, r, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+			identity := &Identity{
+				PlayerID: playerID,
+				Verified: true,
+				Scopes:   []Scope{ScopeSessionCreate, ScopeSessionRoll},
+			}
+			if scope, ok := claims["scope"].(string); ok {
+				for _, s := range strings.Fields(scope) {
+					if Scope(s) == ScopeAdmin {
+						identity.Admin = true
+						identity.Scopes = append(identity.Scopes, ScopeAdmin)
+					}
+				}
+			}
+			h.ServeHTTP(w, r.WithContext(IdentityContext(r.Context(), identity)))
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// testKey is a signing key along with its public JWK.
+type testKey struct {
+	Method  jwt.SigningMethod
+	Private interface{}
+	JWK     JWK
+}
+
+func newRSATestKey(t *testing.T, kid string) testKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{Method: jwt.SigningMethodRS256, Private: key, JWK: JWK{
+		Kid: kid,
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}
+}
+
+func newECTestKey(t *testing.T, kid string) testKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{Method: jwt.SigningMethodES256, Private: key, JWK: JWK{
+		Kid: kid,
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}}
+}
+
+func newEd25519TestKey(t *testing.T, kid string) testKey {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{Method: jwt.SigningMethodEdDSA, Private: private, JWK: JWK{
+		Kid: kid,
+		Kty: "OKP",
+		Crv: "Ed25519",
+		X:   base64.RawURLEncoding.EncodeToString(public),
+	}}
+}
+
+func (key testKey) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.JWK.Kid
+	signed, err := token.SignedString(key.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// jwksServer serves a JSON Web Key Set that can be swapped, counting fetches.
+type jwksServer struct {
+	*httptest.Server
+	keys    []JWK
+	fetches int
+	sync.Mutex
+}
+
+func newJWKSServer(keys ...testKey) *jwksServer {
+	srv := &jwksServer{}
+	srv.setKeys(keys...)
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.Lock()
+		defer srv.Unlock()
+		srv.fetches++
+		_ = json.NewEncoder(w).Encode(map[string][]JWK{"keys": srv.keys})
+	}))
+	return srv
+}
+
+func (srv *jwksServer) setKeys(keys ...testKey) {
+	srv.Lock()
+	defer srv.Unlock()
+	srv.keys = nil
+	for _, key := range keys {
+		srv.keys = append(srv.keys, key.JWK)
+	}
+}
+
+func (srv *jwksServer) numFetches() int {
+	srv.Lock()
+	defer srv.Unlock()
+	return srv.fetches
+}
+
+func identityHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := IdentityFromContext(r.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(w, "%+v", *identity)
+	})
+}
+
+func testOnError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	http.Error(w, err.Error(), status)
+}
+
+func TestJWTMiddleware(t *testing.T) {
+	rsaKey := newRSATestKey(t, "rsa")
+	ecKey := newECTestKey(t, "ec")
+	edKey := newEd25519TestKey(t, "ed")
+	unknownKey := newECTestKey(t, "unknown")
+	srv := newJWKSServer(rsaKey, ecKey, edKey)
+	defer srv.Close()
+	keys, err := NewJWKSFromURL(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.RefreshInterval = time.Hour
+	handler := JWTMiddleware(JWTConfig{Keys: keys, Issuer: "https://id.example.com", Audience: "dice"}, testOnError)(identityHandler(t))
+
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"iss": "https://id.example.com",
+			"aud": "dice",
+			"sub": "alice",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(claims, k)
+				continue
+			}
+			claims[k] = v
+		}
+		return claims
+	}
+	hmacToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims(nil)).SignedString([]byte(rsaKey.JWK.N))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noneToken, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims(nil)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const alice = "{PlayerID:alice Admin:false Verified:true Scopes:[session:create session:roll]}"
+	type testcase struct {
+		Name           string
+		Authorization  string
+		ExpectedStatus int
+		ExpectedBody   string
+	}
+	testcases := []testcase{
+		{Name: "RS256", Authorization: "Bearer " + rsaKey.sign(t, claims(nil)), ExpectedStatus: http.StatusOK, ExpectedBody: alice},
+		{Name: "ES256", Authorization: "Bearer " + ecKey.sign(t, claims(nil)), ExpectedStatus: http.StatusOK, ExpectedBody: alice},
+		{Name: "EdDSA", Authorization: "Bearer " + edKey.sign(t, claims(nil)), ExpectedStatus: http.StatusOK, ExpectedBody: alice},
+		{Name: "Audience list", Authorization: "Bearer " + rsaKey.sign(t, claims(jwt.MapClaims{"aud": []string{"web", "dice"}})), ExpectedStatus: http.StatusOK, ExpectedBody: alice},
+		{
+			Name:           "Admin scope",
+			Authorization:  "Bearer " + rsaKey.sign(t, claims(jwt.MapClaims{"scope": "openid admin"})),
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   "{PlayerID:alice Admin:true Verified:true Scopes:[session:create session:roll admin]}",
+		},
+		{Name: "Expired", Authorization: "Bearer " + rsaKey.sign(t, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), ExpectedStatus: http.StatusUnauthorized},
+		{Name: "No expiry", Authorization: "Bearer " + rsaKey.sign(t, claims(jwt.MapClaims{"exp": nil})), ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Not yet valid", Authorization: "Bearer " + rsaKey.sign(t, claims(jwt.MapClaims{"nbf": time.Now().Add(time.Hour).Unix()})), ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Wrong issuer", Authorization: "Bearer " + rsaKey.sign(t, claims(jwt.MapClaims{"iss": "https://evil.example.com"})), ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Wrong audience", Authorization: "Bearer " + rsaKey.sign(t, claims(jwt.MapClaims{"aud": "other"})), ExpectedStatus: http.StatusUnauthorized},
+		{Name: "No subject", Authorization: "Bearer " + rsaKey.sign(t, claims(jwt.MapClaims{"sub": nil})), ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Unknown key", Authorization: "Bearer " + unknownKey.sign(t, claims(nil)), ExpectedStatus: http.StatusUnauthorized},
+		{Name: "HMAC with the public key", Authorization: "Bearer " + hmacToken, ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Unsigned", Authorization: "Bearer " + noneToken, ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Malformed", Authorization: "Bearer alice", ExpectedStatus: http.StatusUnauthorized},
+		{Name: "No token", ExpectedStatus: http.StatusUnauthorized},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tc.Authorization != "" {
+				r.Header.Set("Authorization", tc.Authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if want, got := tc.ExpectedStatus, w.Code; want != got {
+				t.Errorf("expected http status code: %v, got: %v", want, got)
+			}
+			expectedBody := tc.ExpectedBody
+			if tc.ExpectedStatus == http.StatusUnauthorized {
+				expectedBody = ErrUnauthorized.Error() + "\n"
+			}
+			if want, got := expectedBody, w.Body.String(); want != got {
+				t.Errorf("expected http response body: %s, got: %s", want, got)
+			}
+		})
+	}
+	if n := srv.numFetches(); n != 1 {
+		t.Errorf("expected unknown keys not to be fetched again within the refresh interval, got %d fetches", n)
+	}
+}
+
+func TestJWTMiddleware_PlayerClaim(t *testing.T) {
+	key := newEd25519TestKey(t, "")
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	data, err := json.Marshal(map[string][]JWK{"keys": {key.JWK}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewJWKSFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := JWTMiddleware(JWTConfig{Keys: keys, PlayerClaim: "preferred_username"}, testOnError)(identityHandler(t))
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+key.sign(t, jwt.MapClaims{"sub": "f3a1", "preferred_username": "alice", "exp": time.Now().Add(time.Hour).Unix()}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if want, got := "{PlayerID:alice Admin:false Verified:true Scopes:[session:create session:roll]}", w.Body.String(); want != got {
+		t.Errorf("expected identity: %s, got: %s", want, got)
+	}
+}
+
+func TestJWKS_Rotation(t *testing.T) {
+	old, rotated := newECTestKey(t, "2021-01"), newECTestKey(t, "2021-02")
+	srv := newJWKSServer(old)
+	defer srv.Close()
+	keys, err := NewJWKSFromURL(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.RefreshInterval = 0
+	handler := JWTMiddleware(JWTConfig{Keys: keys}, testOnError)(identityHandler(t))
+
+	srv.setKeys(old, rotated)
+	for _, key := range []testKey{old, rotated} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+key.sign(t, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected token signed with %s to be accepted, got: %d %s", key.JWK.Kid, w.Code, w.Body)
+		}
+	}
+	if n := srv.numFetches(); n != 2 {
+		t.Errorf("expected the set to be fetched again once for the rotated key, got %d fetches", n)
+	}
+}
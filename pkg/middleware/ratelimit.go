@@ -0,0 +1,316 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rgynn/dice/pkg/clock"
+)
+
+// DefaultRateLimitRoute names the limit of routes without one of their own.
+const DefaultRateLimitRoute = "default"
+
+// UnauthorizedRateLimitRoute names the limit on requests rejected for missing
+// or invalid credentials, always counted by IP.
+const UnauthorizedRateLimitRoute = "unauthorized"
+
+// DefaultUnauthorizedRateLimit applies to requests rejected for missing or
+// invalid credentials unless UnauthorizedRateLimitRoute has a limit.
+var DefaultUnauthorizedRateLimit = RateLimit{Rate: 10.0 / 60, Burst: 10, By: RateLimitByIP}
+
+// rateLimitEvictInterval is how often buckets that have filled up again are
+// forgotten, a full bucket is the same as none.
+const rateLimitEvictInterval = time.Minute
+
+var ErrRateLimited = errors.New("too many requests")
+
+// RateLimitBy is what requests are told apart by when rate limiting.
+type RateLimitBy string
+
+const (
+	// RateLimitByIP limits every remote address on its own.
+	RateLimitByIP RateLimitBy = "ip"
+	// RateLimitByAPIKey limits every API key or bearer token on its own,
+	// requests without one by IP.
+	RateLimitByAPIKey RateLimitBy = "api_key"
+	// RateLimitByPlayer limits every verified player on its own, requests
+	// without a verified identity by IP.
+	RateLimitByPlayer RateLimitBy = "player"
+)
+
+func (by RateLimitBy) Valid() bool {
+	switch by {
+	case RateLimitByIP, RateLimitByAPIKey, RateLimitByPlayer:
+		return true
+	}
+	return false
+}
+
+// RateLimit lets every client make Burst requests at once and then Rate
+// requests per second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+	By    RateLimitBy
+}
+
+// RateLimiter is a token bucket per client, holding Burst tokens and
+// refilled at Rate tokens per second. Clock is the system clock and may be
+// replaced before the first request.
+type RateLimiter struct {
+	RateLimit
+	Clock     clock.Clock
+	buckets   map[string]*bucket
+	evictedAt time.Time
+	allowed   uint64
+	limited   uint64
+	sync.Mutex
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// RateLimitStats are the number of clients a RateLimiter is tracking and the
+// requests it has allowed and limited.
+type RateLimitStats struct {
+	Clients int
+	Allowed uint64
+	Limited uint64
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		RateLimit: limit,
+		Clock:     clock.New(),
+		buckets:   map[string]*bucket{},
+	}
+}
+
+// Allow takes a token from the client's bucket, when it is empty it returns
+// how long until the next token.
+func (limiter *RateLimiter) Allow(client string) (bool, time.Duration) {
+	return limiter.allow(client, true)
+}
+
+// Check is Allow without taking a token, for limits on requests counted once
+// their outcome is known.
+func (limiter *RateLimiter) Check(client string) (bool, time.Duration) {
+	return limiter.allow(client, false)
+}
+
+func (limiter *RateLimiter) allow(client string, take bool) (bool, time.Duration) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	now := limiter.Clock.Now()
+	if now.Sub(limiter.evictedAt) >= rateLimitEvictInterval {
+		limiter.evict(now)
+	}
+	b, ok := limiter.buckets[client]
+	if !ok && !take {
+		return true, 0
+	}
+	if !ok {
+		b = &bucket{tokens: float64(limiter.Burst), updatedAt: now}
+		limiter.buckets[client] = b
+	}
+	b.tokens = limiter.refill(b, now)
+	b.updatedAt = now
+	if b.tokens >= 1 {
+		if take {
+			b.tokens--
+			limiter.allowed++
+		}
+		return true, 0
+	}
+	limiter.limited++
+	return false, time.Duration((1 - b.tokens) / limiter.Rate * float64(time.Second))
+}
+
+func (limiter *RateLimiter) Stats() RateLimitStats {
+	limiter.Lock()
+	defer limiter.Unlock()
+	return RateLimitStats{
+		Clients: len(limiter.buckets),
+		Allowed: limiter.allowed,
+		Limited: limiter.limited,
+	}
+}
+
+func (limiter *RateLimiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(float64(limiter.Burst), b.tokens+now.Sub(b.updatedAt).Seconds()*limiter.Rate)
+}
+
+// evict must be called with the limiter locked.
+func (limiter *RateLimiter) evict(now time.Time) {
+	limiter.evictedAt = now
+	for client, b := range limiter.buckets {
+		if limiter.refill(b, now) >= float64(limiter.Burst) {
+			delete(limiter.buckets, client)
+		}
+	}
+}
+
+// RateLimits are the limiters of routes by route name, DefaultRateLimitRoute
+// applies to every route without one of its own.
+type RateLimits map[string]*RateLimiter
+
+// For returns the limiter of the route, nil if it isn't limited.
+func (limits RateLimits) For(route string) *RateLimiter {
+	if limiter, ok := limits[route]; ok {
+		return limiter
+	}
+	return limits[DefaultRateLimitRoute]
+}
+
+// LoadRateLimits reads rate limits from a JSON object at path keyed by route
+// name, rates are a number of requests per second, minute or hour, e.g.
+// {"create_session": {"rate": "10/m", "burst": 5, "by": "api_key"}}.
+func LoadRateLimits(path string) (RateLimits, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]struct {
+		Rate  string      `json:"rate"`
+		Burst int         `json:"burst"`
+		By    RateLimitBy `json:"by"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to read rate limits from %s: %w", path, err)
+	}
+	limits := RateLimits{}
+	for route, entry := range entries {
+		rate, err := parseRate(entry.Rate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit for %s in %s: %w", route, path, err)
+		}
+		if entry.By == "" {
+			entry.By = RateLimitByIP
+		}
+		if !entry.By.Valid() {
+			return nil, fmt.Errorf("invalid rate limit for %s in %s: unknown by: %s", route, path, entry.By)
+		}
+		if route == UnauthorizedRateLimitRoute && entry.By != RateLimitByIP {
+			return nil, fmt.Errorf("invalid rate limit for %s in %s: can only be by ip", route, path)
+		}
+		if entry.Burst == 0 {
+			entry.Burst = int(math.Max(1, math.Ceil(rate)))
+		}
+		if entry.Burst < 0 {
+			return nil, fmt.Errorf("invalid rate limit for %s in %s: negative burst", route, path)
+		}
+		limits[route] = NewRateLimiter(RateLimit{Rate: rate, Burst: entry.Burst, By: entry.By})
+	}
+	return limits, nil
+}
+
+// parseRate returns the requests per second of a rate like 5/s, 10/m or 100/h.
+func parseRate(rate string) (float64, error) {
+	parts := strings.SplitN(rate, "/", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("rate must be requests per s, m or h, e.g. 10/m: %q", rate)
+	}
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid number of requests: %q", parts[0])
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[parts[1]]
+	if per == 0 {
+		return 0, fmt.Errorf("invalid unit, must be s, m or h: %q", parts[1])
+	}
+	return n / per.Seconds(), nil
+}
+
+// RateLimitMiddleware limits requests by the limit of their route, named on
+// the mux route, answering those over it with 429 and a Retry-After header.
+// It runs after the identity middleware to limit by player.
+func RateLimitMiddleware(limits RateLimits, onError ErrorFunc) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var route string
+			if current := mux.CurrentRoute(r); current != nil {
+				route = current.GetName()
+			}
+			limiter := limits.For(route)
+			if limiter == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if ok, retryAfter := limiter.Allow(rateLimitClient(r, limiter.By)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				onError(w, r, http.StatusTooManyRequests, ErrRateLimited)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// UnauthorizedRateLimitMiddleware answers 429 to IPs over the limit before
+// their credentials are checked, it runs before the identity middleware. The
+// identity middleware counts the requests it rejects with CountUnauthorized,
+// so credentials can't be guessed at the pace of the route limits, which only
+// apply to requests it let through.
+func UnauthorizedRateLimitMiddleware(limiter *RateLimiter, onError ErrorFunc) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, retryAfter := limiter.Check(ipClient(r)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				onError(w, r, http.StatusTooManyRequests, ErrRateLimited)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CountUnauthorized wraps onError to take a token from the IP's bucket for
+// every request rejected for missing or invalid credentials.
+func CountUnauthorized(limiter *RateLimiter, onError ErrorFunc) ErrorFunc {
+	return func(w http.ResponseWriter, r *http.Request, status int, err error) {
+		if status == http.StatusUnauthorized {
+			limiter.Allow(ipClient(r))
+		}
+		onError(w, r, status, err)
+	}
+}
+
+// rateLimitClient tells clients apart by what the limit is by, falling back
+// to their IP. Only verified identities count, a client making up API keys or
+// players would otherwise get a fresh bucket on every request. API keys are
+// hashed so they aren't held in memory.
+func rateLimitClient(r *http.Request, by RateLimitBy) string {
+	identity, err := IdentityFromContext(r.Context())
+	verified := err == nil && identity.Verified
+	switch by {
+	case RateLimitByAPIKey:
+		if key := apiKeyFromRequest(r); verified && key != "" {
+			return "api_key:" + HashAPIKey(key)
+		}
+	case RateLimitByPlayer:
+		if verified {
+			return "player:" + identity.PlayerID
+		}
+	}
+	return ipClient(r)
+}
+
+func ipClient(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
@@ -0,0 +1,254 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rgynn/dice/pkg/clock"
+)
+
+func TestRateLimiter(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	limiter := NewRateLimiter(RateLimit{Rate: 0.5, Burst: 2})
+	limiter.Clock = fake
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("expected request %d within the burst to be allowed", i+1)
+		}
+	}
+	ok, retryAfter := limiter.Allow("a")
+	if ok {
+		t.Fatal("expected request over the burst to be limited")
+	}
+	if retryAfter != 2*time.Second {
+		t.Errorf("expected retry after: %s, got: %s", 2*time.Second, retryAfter)
+	}
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Error("expected another client to have a bucket of its own")
+	}
+	fake.Advance(time.Second)
+	if ok, retryAfter := limiter.Allow("a"); ok || retryAfter != time.Second {
+		t.Errorf("expected request half a token later to be limited for: %s, got: %v %s", time.Second, ok, retryAfter)
+	}
+	fake.Advance(time.Second)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Error("expected request once a token was refilled to be allowed")
+	}
+	if want, got := (RateLimitStats{Clients: 2, Allowed: 4, Limited: 2}), limiter.Stats(); want != got {
+		t.Errorf("expected stats: %+v, got: %+v", want, got)
+	}
+
+	// Buckets that filled up again are forgotten.
+	fake.Advance(time.Minute)
+	limiter.Allow("a")
+	if want, got := 1, limiter.Stats().Clients; want != got {
+		t.Errorf("expected clients after eviction: %d, got: %d", want, got)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	type request struct {
+		RemoteAddr     string
+		APIKey         string
+		Identity       *Identity
+		ExpectedStatus int
+	}
+	type testcase struct {
+		Name     string
+		Route    string
+		Limit    RateLimit
+		Requests []request
+	}
+	alice := &Identity{PlayerID: "alice", Verified: true}
+	testcases := []testcase{
+		{
+			Name:  "By IP",
+			Route: "roll",
+			Limit: RateLimit{Rate: 1, Burst: 1, By: RateLimitByIP},
+			Requests: []request{
+				{RemoteAddr: "10.0.0.1:1234", ExpectedStatus: http.StatusOK},
+				{RemoteAddr: "10.0.0.1:5678", ExpectedStatus: http.StatusTooManyRequests},
+				{RemoteAddr: "10.0.0.2:1234", ExpectedStatus: http.StatusOK},
+			},
+		},
+		{
+			Name:  "By API key",
+			Route: "roll",
+			Limit: RateLimit{Rate: 1, Burst: 1, By: RateLimitByAPIKey},
+			Requests: []request{
+				{RemoteAddr: "10.0.0.1:1234", APIKey: "a", Identity: alice, ExpectedStatus: http.StatusOK},
+				{RemoteAddr: "10.0.0.2:1234", APIKey: "a", Identity: alice, ExpectedStatus: http.StatusTooManyRequests},
+				{RemoteAddr: "10.0.0.1:1234", APIKey: "b", Identity: alice, ExpectedStatus: http.StatusOK},
+				{RemoteAddr: "10.0.0.1:1234", ExpectedStatus: http.StatusOK},
+				{RemoteAddr: "10.0.0.1:1234", ExpectedStatus: http.StatusTooManyRequests},
+				// Keys nobody verified are limited by IP.
+				{RemoteAddr: "10.0.0.2:1234", APIKey: "c", ExpectedStatus: http.StatusOK},
+				{RemoteAddr: "10.0.0.2:1234", APIKey: "d", ExpectedStatus: http.StatusTooManyRequests},
+				{RemoteAddr: "10.0.0.2:1234", APIKey: "e", Identity: &Identity{PlayerID: "alice"}, ExpectedStatus: http.StatusTooManyRequests},
+			},
+		},
+		{
+			Name:  "By player",
+			Route: "roll",
+			Limit: RateLimit{Rate: 1, Burst: 1, By: RateLimitByPlayer},
+			Requests: []request{
+				{RemoteAddr: "10.0.0.1:1234", Identity: alice, ExpectedStatus: http.StatusOK},
+				{RemoteAddr: "10.0.0.2:1234", Identity: alice, ExpectedStatus: http.StatusTooManyRequests},
+				{RemoteAddr: "10.0.0.2:1234", Identity: &Identity{PlayerID: "alice"}, ExpectedStatus: http.StatusOK},
+				{RemoteAddr: "10.0.0.2:1234", Identity: &Identity{PlayerID: "bob"}, ExpectedStatus: http.StatusTooManyRequests},
+			},
+		},
+		{
+			Name:  "Default route",
+			Route: DefaultRateLimitRoute,
+			Limit: RateLimit{Rate: 1, Burst: 1, By: RateLimitByIP},
+			Requests: []request{
+				{RemoteAddr: "10.0.0.1:1234", ExpectedStatus: http.StatusOK},
+				{RemoteAddr: "10.0.0.1:1234", ExpectedStatus: http.StatusTooManyRequests},
+			},
+		},
+		{
+			Name:  "Other route",
+			Route: "create_session",
+			Limit: RateLimit{Rate: 1, Burst: 1, By: RateLimitByIP},
+			Requests: []request{
+				{RemoteAddr: "10.0.0.1:1234", ExpectedStatus: http.StatusOK},
+				{RemoteAddr: "10.0.0.1:1234", ExpectedStatus: http.StatusOK},
+			},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			limiter := NewRateLimiter(tc.Limit)
+			limiter.Clock = clock.NewFake(time.Unix(0, 0))
+			router := mux.NewRouter()
+			router.Use(RateLimitMiddleware(RateLimits{tc.Route: limiter}, testOnError))
+			router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {}).Name("roll")
+			for i, req := range tc.Requests {
+				r := httptest.NewRequest(http.MethodPost, "/", nil)
+				r.RemoteAddr = req.RemoteAddr
+				if req.APIKey != "" {
+					r.Header.Set("X-API-Key", req.APIKey)
+				}
+				if req.Identity != nil {
+					r = r.WithContext(IdentityContext(r.Context(), req.Identity))
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+				if want, got := req.ExpectedStatus, w.Code; want != got {
+					t.Errorf("request %d: expected http status code: %v, got: %v", i+1, want, got)
+				}
+				if w.Code == http.StatusTooManyRequests {
+					if want, got := "1", w.Header().Get("Retry-After"); want != got {
+						t.Errorf("request %d: expected Retry-After: %s, got: %s", i+1, want, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUnauthorizedRateLimitMiddleware(t *testing.T) {
+	type request struct {
+		RemoteAddr     string
+		APIKey         string
+		ExpectedStatus int
+	}
+	limiter := NewRateLimiter(RateLimit{Rate: 1, Burst: 2, By: RateLimitByIP})
+	limiter.Clock = clock.NewFake(time.Unix(0, 0))
+	store, err := NewMemoryAPIKeyStore(APIKey{Hash: HashAPIKey("good"), PlayerID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := UnauthorizedRateLimitMiddleware(limiter, testOnError)(
+		APIKeyMiddleware(store, CountUnauthorized(limiter, testOnError))(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	requests := []request{
+		{RemoteAddr: "10.0.0.1:1234", APIKey: "good", ExpectedStatus: http.StatusOK},
+		{RemoteAddr: "10.0.0.1:1234", APIKey: "guess1", ExpectedStatus: http.StatusUnauthorized},
+		{RemoteAddr: "10.0.0.1:1234", APIKey: "good", ExpectedStatus: http.StatusOK},
+		{RemoteAddr: "10.0.0.1:1234", APIKey: "guess2", ExpectedStatus: http.StatusUnauthorized},
+		// Out of guesses, not even the right key is checked.
+		{RemoteAddr: "10.0.0.1:1234", APIKey: "guess3", ExpectedStatus: http.StatusTooManyRequests},
+		{RemoteAddr: "10.0.0.1:1234", APIKey: "good", ExpectedStatus: http.StatusTooManyRequests},
+		{RemoteAddr: "10.0.0.2:1234", APIKey: "good", ExpectedStatus: http.StatusOK},
+	}
+	for i, req := range requests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = req.RemoteAddr
+		r.Header.Set("X-API-Key", req.APIKey)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if want, got := req.ExpectedStatus, w.Code; want != got {
+			t.Errorf("request %d: expected http status code: %v, got: %v", i+1, want, got)
+		}
+	}
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	type testcase struct {
+		Name          string
+		Input         string
+		Route         string
+		ExpectedLimit RateLimit
+		ExpectedLoad  bool
+	}
+	testcases := []testcase{
+		{
+			Name:          "Per minute",
+			Input:         `{"create_session": {"rate": "30/m", "burst": 5, "by": "api_key"}}`,
+			Route:         "create_session",
+			ExpectedLimit: RateLimit{Rate: 0.5, Burst: 5, By: RateLimitByAPIKey},
+		},
+		{
+			Name:          "Defaults",
+			Input:         `{"default": {"rate": "10/s"}}`,
+			Route:         "roll",
+			ExpectedLimit: RateLimit{Rate: 10, Burst: 10, By: RateLimitByIP},
+		},
+		{
+			Name:          "Burst at least one",
+			Input:         `{"default": {"rate": "60/h"}}`,
+			Route:         "roll",
+			ExpectedLimit: RateLimit{Rate: 1.0 / 60, Burst: 1, By: RateLimitByIP},
+		},
+		{Name: "No rate", Input: `{"default": {"burst": 1}}`, ExpectedLoad: true},
+		{Name: "Zero rate", Input: `{"default": {"rate": "0/s"}}`, ExpectedLoad: true},
+		{Name: "Unknown unit", Input: `{"default": {"rate": "1/d"}}`, ExpectedLoad: true},
+		{Name: "Negative burst", Input: `{"default": {"rate": "1/s", "burst": -1}}`, ExpectedLoad: true},
+		{Name: "Unknown by", Input: `{"default": {"rate": "1/s", "by": "session"}}`, ExpectedLoad: true},
+		{Name: "Unauthorized not by ip", Input: `{"unauthorized": {"rate": "1/s", "by": "api_key"}}`, ExpectedLoad: true},
+		{Name: "Not json", Input: `default`, ExpectedLoad: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rate_limits.json")
+			if err := os.WriteFile(path, []byte(tc.Input), 0600); err != nil {
+				t.Fatal(err)
+			}
+			limits, err := LoadRateLimits(path)
+			if tc.ExpectedLoad {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			limiter := limits.For(tc.Route)
+			if limiter == nil {
+				t.Fatalf("expected a limit for route: %s", tc.Route)
+			}
+			if want, got := tc.ExpectedLimit, limiter.RateLimit; want != got {
+				t.Errorf("expected limit: %+v, got: %+v", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Package random implements the session.Randomness sources the Keeper can be configured with.
+package random
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sync"
+
+	"github.com/rgynn/dice/pkg/session"
+)
+
+const (
+	SourceCrypto   = "crypto"
+	SourceSeeded   = "seeded"
+	SourceSequence = "sequence"
+)
+
+var ErrUnknownSource = errors.New("unknown randomness source")
+var ErrEmptySequence = errors.New("randomness sequence is empty")
+
+// New returns the randomness source with the given name, defaulting to crypto.
+func New(source string, seed int64, sequence []int) (session.Randomness, error) {
+	switch source {
+	case "", SourceCrypto:
+		return NewCrypto(), nil
+	case SourceSeeded:
+		return NewSeeded(seed), nil
+	case SourceSequence:
+		return NewSequence(sequence)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownSource, source)
+}
+
+// Crypto reads from crypto/rand.
+type Crypto struct{}
+
+func NewCrypto() *Crypto {
+	return &Crypto{}
+}
+
+func (rnd *Crypto) Intn(n int) int {
+	if n <= 0 {
+		panic("invalid argument to Intn")
+	}
+	v, err := crand.Int(crand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(fmt.Sprintf("failed to read from crypto/rand: %v", err))
+	}
+	return int(v.Int64())
+}
+
+// Seeded is a deterministic PRNG, the same seed always yields the same numbers.
+type Seeded struct {
+	rand *rand.Rand
+	sync.Mutex
+}
+
+func NewSeeded(seed int64) *Seeded {
+	return &Seeded{
+		rand: rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (rnd *Seeded) Intn(n int) int {
+	rnd.Lock()
+	defer rnd.Unlock()
+	return rnd.rand.Intn(n)
+}
+
+// Sequence replays a precomputed sequence of numbers, starting over when it runs out.
+// Numbers are reduced modulo n.
+type Sequence struct {
+	sequence []int
+	next     int
+	sync.Mutex
+}
+
+func NewSequence(sequence []int) (*Sequence, error) {
+	if len(sequence) == 0 {
+		return nil, ErrEmptySequence
+	}
+	return &Sequence{
+		sequence: sequence,
+	}, nil
+}
+
+func (rnd *Sequence) Intn(n int) int {
+	if n <= 0 {
+		panic("invalid argument to Intn")
+	}
+	rnd.Lock()
+	defer rnd.Unlock()
+	v := rnd.sequence[rnd.next]
+	rnd.next = (rnd.next + 1) % len(rnd.sequence)
+	if v < 0 {
+		v = -v
+	}
+	return v % n
+}
@@ -0,0 +1,49 @@
+package session
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrWebhooksDisabled = errors.New("webhooks are not enabled on this server")
+var ErrInvalidWebhook = errors.New("invalid webhook url")
+
+// MaxNumWebhooks caps the number of webhook URLs per session.
+const MaxNumWebhooks = 5
+
+// Notifier is told about every session with webhooks once it is closed.
+// Notify must not block, see webhook.Notifier.
+type Notifier interface {
+	Notify(sess *Session)
+}
+
+// Delivery is one attempt at posting the result of a session to one of its webhooks.
+type Delivery struct {
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Delivered  bool      `json:"delivered"`
+	Time       time.Time `json:"time"`
+}
+
+// AddDelivery appends an attempt to the session's delivery log and hands it
+// to OnDelivery, if set, for Keepers that store the log elsewhere.
+func (sess *Session) AddDelivery(delivery Delivery) {
+	sess.Lock()
+	sess.deliveries = append(sess.deliveries, delivery)
+	onDelivery := sess.OnDelivery
+	sess.Unlock()
+	if onDelivery != nil {
+		onDelivery(delivery)
+	}
+}
+
+// Deliveries returns the session's delivery log, oldest attempt first.
+func (sess *Session) Deliveries() []Delivery {
+	sess.Lock()
+	defer sess.Unlock()
+	deliveries := make([]Delivery, len(sess.deliveries))
+	copy(deliveries, sess.deliveries)
+	return deliveries
+}
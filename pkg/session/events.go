@@ -0,0 +1,79 @@
+package session
+
+import "context"
+
+// EventBufferSize is how many events a subscriber may fall behind before events are dropped.
+const EventBufferSize = 64
+
+type EventType string
+
+const (
+	EventPlayerRolled  EventType = "player_rolled"
+	EventTimerTick     EventType = "timer_tick"
+	EventTieBreak      EventType = "tie_break"
+	EventSessionClosed EventType = "session_closed"
+)
+
+// Event is published to subscribers as things happen in an open session.
+type Event struct {
+	Type             EventType   `json:"type"`
+	SessionID        string      `json:"session_id"`
+	Roll             *Roll       `json:"roll,omitempty"`
+	RemainingSeconds int         `json:"remaining_seconds,omitempty"`
+	TieBreak         *TieBreak   `json:"tie_break,omitempty"`
+	Result           *Result     `json:"result,omitempty"`
+	Reason           CloseReason `json:"reason,omitempty"`
+}
+
+// Subscribe returns a channel receiving the session's events, anyone may
+// subscribe without having rolled. The channel is closed after the
+// session_closed event or when ctx is done, subscribing to a closed session
+// only yields its session_closed event.
+func (sess *Session) Subscribe(ctx context.Context) chan Event {
+	eventC := make(chan Event, EventBufferSize)
+	sess.Lock()
+	defer sess.Unlock()
+	if sess.closed {
+		eventC <- Event{Type: EventSessionClosed, SessionID: sess.ID, Result: sess.result, Reason: sess.closeReason}
+		close(eventC)
+		return eventC
+	}
+	if sess.subscribers == nil {
+		sess.subscribers = map[chan Event]struct{}{}
+	}
+	sess.subscribers[eventC] = struct{}{}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-sess.Done:
+			return
+		}
+		sess.Lock()
+		defer sess.Unlock()
+		if _, ok := sess.subscribers[eventC]; ok {
+			delete(sess.subscribers, eventC)
+			close(eventC)
+		}
+	}()
+	return eventC
+}
+
+// publish must be called with the session locked. Subscribers that
+// are too far behind miss the event rather than block the session.
+func (sess *Session) publish(event Event) {
+	event.SessionID = sess.ID
+	for eventC := range sess.subscribers {
+		select {
+		case eventC <- event:
+		default:
+		}
+	}
+}
+
+// closeSubscribers must be called with the session locked.
+func (sess *Session) closeSubscribers() {
+	for eventC := range sess.subscribers {
+		close(eventC)
+	}
+	sess.subscribers = nil
+}
@@ -0,0 +1,118 @@
+package session
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type ListOptions struct {
+	State         State
+	Creator       string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Cursor        string
+	Limit         int
+}
+
+type List struct {
+	Sessions   []*Status `json:"sessions"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// PageSize returns the number of sessions a page holds, opts.Limit bounded
+// by MaxListLimit and DefaultListLimit when unset.
+func (opts ListOptions) PageSize() int {
+	if opts.Limit <= 0 {
+		return DefaultListLimit
+	}
+	if opts.Limit > MaxListLimit {
+		return MaxListLimit
+	}
+	return opts.Limit
+}
+
+// Match reports whether the status passes the filters of opts, the cursor
+// aside.
+func (opts ListOptions) Match(status *Status) bool {
+	switch {
+	case opts.State != "" && status.State != opts.State:
+	case opts.Creator != "" && status.Creator != opts.Creator:
+	case !opts.CreatedAfter.IsZero() && !status.CreatedAt.After(opts.CreatedAfter):
+	case !opts.CreatedBefore.IsZero() && !status.CreatedAt.Before(opts.CreatedBefore):
+	default:
+		return true
+	}
+	return false
+}
+
+// NewList filters statuses by opts and returns the page after opts.Cursor,
+// ordered by creation time and ID.
+func NewList(statuses []*Status, opts ListOptions) (*List, error) {
+	limit := opts.PageSize()
+	var after *Status
+	if opts.Cursor != "" {
+		createdAt, id, err := DecodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after = &Status{Session: &Session{ID: id, CreatedAt: createdAt}}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return before(statuses[i], statuses[j])
+	})
+	list := &List{Sessions: []*Status{}}
+	for _, status := range statuses {
+		switch {
+		case after != nil && !before(after, status):
+		case !opts.Match(status):
+		case len(list.Sessions) == limit:
+			last := list.Sessions[limit-1]
+			list.NextCursor = encodeCursor(last.CreatedAt, last.ID)
+			return list, nil
+		default:
+			list.Sessions = append(list.Sessions, status)
+		}
+	}
+	return list, nil
+}
+
+func before(a, b *Status) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.ID < b.ID
+}
+
+func encodeCursor(createdAt time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", createdAt.UnixNano(), id)))
+}
+
+// DecodeCursor returns the creation time and ID of the last session of the
+// page the cursor follows.
+func DecodeCursor(cursor string) (time.Time, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	nsec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return time.Unix(0, nsec), parts[1], nil
+}
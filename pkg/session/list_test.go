@@ -0,0 +1,91 @@
+package session
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewList(t *testing.T) {
+	now := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	newStatuses := func() []*Status {
+		return []*Status{
+			{Session: &Session{ID: "d", Creator: "bob", CreatedAt: now.Add(2 * time.Minute)}, State: StateOpen},
+			{Session: &Session{ID: "a", Creator: "alice", CreatedAt: now}, State: StateClosed},
+			{Session: &Session{ID: "c", Creator: "alice", CreatedAt: now.Add(time.Minute)}, State: StateOpen},
+			{Session: &Session{ID: "b", Creator: "bob", CreatedAt: now}, State: StateOpen},
+		}
+	}
+	type testcase struct {
+		Name          string
+		Input         ListOptions
+		ExpectedIDs   []string
+		ExpectedError error
+	}
+	testcases := []testcase{
+		{
+			Name:        "All in creation order",
+			ExpectedIDs: []string{"a", "b", "c", "d"},
+		},
+		{
+			Name:        "By state",
+			Input:       ListOptions{State: StateOpen},
+			ExpectedIDs: []string{"b", "c", "d"},
+		},
+		{
+			Name:        "By creator",
+			Input:       ListOptions{Creator: "alice"},
+			ExpectedIDs: []string{"a", "c"},
+		},
+		{
+			Name:        "By creation time",
+			Input:       ListOptions{CreatedAfter: now, CreatedBefore: now.Add(2 * time.Minute)},
+			ExpectedIDs: []string{"c"},
+		},
+		{
+			Name:          "Invalid cursor",
+			Input:         ListOptions{Cursor: "!"},
+			ExpectedError: ErrInvalidCursor,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			list, err := NewList(newStatuses(), tc.Input)
+			if !errors.Is(err, tc.ExpectedError) {
+				t.Fatalf("expected error: %v, got: %v", tc.ExpectedError, err)
+			}
+			if err != nil {
+				return
+			}
+			var ids []string
+			for _, status := range list.Sessions {
+				ids = append(ids, status.ID)
+			}
+			if !reflect.DeepEqual(tc.ExpectedIDs, ids) {
+				t.Errorf("expected sessions: %v, got: %v", tc.ExpectedIDs, ids)
+			}
+		})
+	}
+
+	t.Run("Pagination", func(t *testing.T) {
+		var ids []string
+		opts := ListOptions{Limit: 3}
+		for pages := 0; pages < 10; pages++ {
+			list, err := NewList(newStatuses(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, status := range list.Sessions {
+				ids = append(ids, status.ID)
+			}
+			if list.NextCursor == "" {
+				break
+			}
+			opts.Cursor = list.NextCursor
+		}
+		if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(want, ids) {
+			t.Errorf("expected sessions: %v, got: %v", want, ids)
+		}
+	})
+}
@@ -5,6 +5,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/rgynn/dice/pkg/clock"
+	"github.com/rgynn/dice/pkg/fair"
 	"github.com/rgynn/dice/pkg/helper"
 	"github.com/rgynn/dice/pkg/session"
 )
@@ -12,87 +14,303 @@ import (
 type Keeper struct {
 	MaxNumSessions int
 	MaxRollNumber  int
+	Retention      time.Duration
+	Tenants        session.Tenants
+	Randomness     session.Randomness
+	Notifier       session.Notifier
+	OnClose        func(sess *session.Session)
+	HandOff        bool
+	Clock          clock.Clock
 	Sessions       map[string]*session.Session
-	NewC           chan *session.Session
 	CloseC         chan string
+	shuttingDown   bool
 	sync.Mutex
 }
 
-func NewKeeper(maxNumSessions, maxRandom int) (session.Keeper, error) {
+// NewKeeper returns a Keeper holding sessions in memory. Sessions may only
+// have webhooks when a notifier is given. OnClose may be set before Run to be
+// told about every session once it has closed, e.g. to persist it. Clock
+// is the system clock and may be replaced before any session is created.
+// Shutdown resolves open sessions with the rolls they have unless HandOff is
+// set, by keepers that persist them, in which case they are left open.
+// The limits given are those of the default tenant, other tenants may be set
+// before any session is created. Sessions are held by their session.Key.
+func NewKeeper(maxNumSessions, maxRandom int, retention time.Duration, rnd session.Randomness, notifier session.Notifier) (*Keeper, error) {
 	return &Keeper{
 		MaxNumSessions: maxNumSessions,
 		MaxRollNumber:  maxRandom,
+		Retention:      retention,
+		Randomness:     rnd,
+		Notifier:       notifier,
+		Clock:          clock.New(),
 		Sessions:       map[string]*session.Session{},
-		NewC:           make(chan *session.Session, 1),
 		CloseC:         make(chan string, 1),
 	}, nil
 }
 
-func (svc *Keeper) NewSession(ctx context.Context, maxNumPlayers, maxDurationSeconds int) (*session.Session, error) {
-	if maxDurationSeconds == 0 {
-		maxDurationSeconds = 10
+func (svc *Keeper) NewSession(ctx context.Context, tenant string, opts session.Options) (*session.Session, error) {
+	limits, err := svc.Limits(tenant)
+	if err != nil {
+		return nil, err
 	}
-	if len(svc.Sessions) >= svc.MaxNumSessions {
+	opts, err = opts.Validate(limits.MaxRollNumber, svc.Notifier != nil)
+	if err != nil {
+		return nil, err
+	}
+	svc.Lock()
+	defer svc.Unlock()
+	if svc.shuttingDown {
+		return nil, session.ErrShuttingDown
+	}
+	if svc.numOpenSessions(tenant) >= limits.MaxNumSessions {
 		return nil, session.ErrMaxNumSessionsReached
 	}
-	if maxNumPlayers < 2 {
-		return nil, session.ErrNotEnoughPlayers
+	sessionID, err := svc.newSessionID(tenant, 20)
+	if err != nil {
+		return nil, err
 	}
-	svc.Lock()
-	id := svc.newSessionID(20)
-	svc.Unlock()
-	sess := &session.Session{
-		ID:            id,
-		MaxNumPlayers: maxNumPlayers,
-		Timer:         time.NewTimer(time.Duration(maxDurationSeconds) * time.Second),
-		Players:       map[string]chan session.Roll{},
-		Rolls:         make(chan session.Roll, maxNumPlayers),
-		Done:          make(chan struct{}),
+	serverSeed, err := fair.NewSeed()
+	if err != nil {
+		return nil, err
 	}
+	sess := session.New(sessionID, serverSeed, opts, svc.Clock, svc.Clock.Now())
+	sess.Tenant = tenant
+	svc.Sessions[session.Key(tenant, sess.ID)] = sess
 	go sess.Open(svc.CloseC)
-	svc.NewC <- sess
 	return sess, nil
 }
 
-func (svc *Keeper) AddSessionRoll(ctx context.Context, sessionID, playerID string) (chan session.Roll, *session.Roll, error) {
+func (svc *Keeper) GetSession(ctx context.Context, tenant, sessionID string) (*session.Status, error) {
+	sess, err := svc.Session(tenant, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return sess.Status(), nil
+}
+
+func (svc *Keeper) CancelSession(ctx context.Context, tenant, sessionID string, actor session.Actor) (*session.Status, error) {
+	sess, err := svc.Session(tenant, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := sess.Authorize(actor); err != nil {
+		return nil, err
+	}
+	if err := sess.Cancel(svc.CloseC); err != nil {
+		return nil, err
+	}
+	return sess.Status(), nil
+}
+
+func (svc *Keeper) CloseSession(ctx context.Context, tenant, sessionID string, actor session.Actor) (*session.Status, error) {
+	sess, err := svc.Session(tenant, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := sess.Authorize(actor); err != nil {
+		return nil, err
+	}
+	if err := sess.Close(svc.CloseC); err != nil {
+		return nil, err
+	}
+	return sess.Status(), nil
+}
+
+func (svc *Keeper) SubscribeSession(ctx context.Context, tenant, sessionID string) (chan session.Event, error) {
+	sess, err := svc.Session(tenant, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return sess.Subscribe(ctx), nil
+}
+
+func (svc *Keeper) ListSessions(ctx context.Context, tenant string, opts session.ListOptions) (*session.List, error) {
+	if _, err := svc.Limits(tenant); err != nil {
+		return nil, err
+	}
+	return session.NewList(svc.Statuses(tenant), opts)
+}
+
+func (svc *Keeper) CountOpenSessions(ctx context.Context, tenant string) (int, error) {
+	if _, err := svc.Limits(tenant); err != nil {
+		return 0, err
+	}
+	svc.Lock()
+	defer svc.Unlock()
+	return svc.numOpenSessions(tenant), nil
+}
+
+// Statuses returns the status of every session of the tenant held in memory.
+func (svc *Keeper) Statuses(tenant string) []*session.Status {
+	svc.Lock()
+	defer svc.Unlock()
+	statuses := make([]*session.Status, 0, len(svc.Sessions))
+	for _, sess := range svc.Sessions {
+		if sess.Tenant == tenant {
+			statuses = append(statuses, sess.Status())
+		}
+	}
+	return statuses
+}
+
+// Limits returns the limits of a tenant or session.ErrTenantNotFound.
+func (svc *Keeper) Limits(tenant string) (session.Limits, error) {
+	return svc.Tenants.Limits(tenant, session.Limits{
+		MaxNumSessions: svc.MaxNumSessions,
+		MaxRollNumber:  svc.MaxRollNumber,
+		Retention:      svc.Retention,
+	})
+}
+
+// Session returns a session of the tenant held in memory.
+func (svc *Keeper) Session(tenant, sessionID string) (*session.Session, error) {
+	if _, err := svc.Limits(tenant); err != nil {
+		return nil, err
+	}
 	svc.Lock()
-	sess, ok := svc.Sessions[sessionID]
+	sess, ok := svc.Sessions[session.Key(tenant, sessionID)]
 	svc.Unlock()
 	if !ok {
-		return nil, nil, session.ErrNotFound
+		return nil, session.ErrNotFound
 	}
-	return sess.AddRoll(ctx, sessionID, playerID, svc.MaxRollNumber)
+	return sess, nil
+}
+
+func (svc *Keeper) AddSessionRoll(ctx context.Context, tenant, sessionID, playerID string, opts session.RollOptions) (chan session.Result, *session.Roll, error) {
+	sess, err := svc.Session(tenant, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sess.AddRoll(ctx, sessionID, playerID, opts)
+}
+
+func (svc *Keeper) GetSessionResult(ctx context.Context, tenant, sessionID, playerID string) (*session.PlayerResult, error) {
+	sess, err := svc.Session(tenant, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return sess.PlayerResult(playerID)
+}
+
+func (svc *Keeper) GetSessionDeliveries(ctx context.Context, tenant, sessionID string, actor session.Actor) ([]session.Delivery, error) {
+	sess, err := svc.Session(tenant, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := sess.Authorize(actor); err != nil {
+		return nil, err
+	}
+	return sess.Deliveries(), nil
 }
 
-func (svc *Keeper) Run() {
+// Run hands closed sessions to OnClose and the notifier and retains them until
+// ctx is done. Sessions that closed by then, e.g. those resolved by Shutdown,
+// are still handed over before it returns.
+func (svc *Keeper) Run(ctx context.Context) {
 	for {
 		select {
-		case sess := <-svc.NewC:
-			svc.storeSession(sess)
-		case sessionID := <-svc.CloseC:
-			svc.removeSession(sessionID)
+		case <-ctx.Done():
+			for {
+				select {
+				case key := <-svc.CloseC:
+					svc.closed(key)
+				default:
+					return
+				}
+			}
+		case key := <-svc.CloseC:
+			svc.closed(key)
+			svc.retainSession(key)
 		}
 	}
 }
 
-func (svc *Keeper) newSessionID(n int) string {
-	new := helper.RandomString(n)
-	for k := range svc.Sessions {
-		if k == new {
-			return svc.newSessionID(n)
+func (svc *Keeper) Shutdown(ctx context.Context) error {
+	svc.Lock()
+	svc.shuttingDown = true
+	open := make([]*session.Session, 0, len(svc.Sessions))
+	for _, sess := range svc.Sessions {
+		if !sess.Closed() {
+			open = append(open, sess)
 		}
 	}
-	return new
+	svc.Unlock()
+	if svc.HandOff {
+		return nil
+	}
+	for _, sess := range open {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Sessions closing on their own meanwhile return ErrSessionClosed.
+		_ = sess.Shutdown(svc.CloseC)
+	}
+	return nil
 }
 
-func (svc *Keeper) storeSession(sess *session.Session) {
+// closed hands a closed session to OnClose and, when it has webhooks, to the notifier.
+func (svc *Keeper) closed(key string) {
 	svc.Lock()
-	svc.Sessions[sess.ID] = sess
+	sess, ok := svc.Sessions[key]
 	svc.Unlock()
+	if !ok {
+		return
+	}
+	if svc.OnClose != nil {
+		svc.OnClose(sess)
+	}
+	if len(sess.Webhooks) > 0 && svc.Notifier != nil {
+		svc.Notifier.Notify(sess)
+	}
+}
+
+// newSessionID returns an ID no other session of the tenant has, or
+// session.ErrNoSessionID after session.MaxSessionIDAttempts taken ones. It
+// must be called with the keeper locked.
+func (svc *Keeper) newSessionID(tenant string, n int) (string, error) {
+	for i := 0; i < session.MaxSessionIDAttempts; i++ {
+		id := helper.RandomStringFrom(svc.Randomness.Intn, n)
+		if _, ok := svc.Sessions[session.Key(tenant, id)]; !ok {
+			return id, nil
+		}
+	}
+	return "", session.ErrNoSessionID
+}
+
+// retainSession keeps a closed session around for the Retention of its
+// tenant so its result can still be read.
+func (svc *Keeper) retainSession(key string) {
+	svc.Lock()
+	sess, ok := svc.Sessions[key]
+	svc.Unlock()
+	if !ok {
+		return
+	}
+	limits, err := svc.Limits(sess.Tenant)
+	if err != nil || limits.Retention <= 0 {
+		svc.removeSession(key)
+		return
+	}
+	timer := svc.Clock.NewTimer(limits.Retention)
+	go func() {
+		<-timer.C()
+		svc.removeSession(key)
+	}()
+}
+
+// numOpenSessions must be called with the keeper locked.
+func (svc *Keeper) numOpenSessions(tenant string) int {
+	n := 0
+	for _, sess := range svc.Sessions {
+		if sess.Tenant == tenant && !sess.Closed() {
+			n++
+		}
+	}
+	return n
 }
 
-func (svc *Keeper) removeSession(sessionID string) {
+func (svc *Keeper) removeSession(key string) {
 	svc.Lock()
-	delete(svc.Sessions, sessionID)
+	delete(svc.Sessions, key)
 	svc.Unlock()
 }
@@ -0,0 +1,282 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rgynn/dice/pkg/clock"
+	"github.com/rgynn/dice/pkg/random"
+	"github.com/rgynn/dice/pkg/session"
+	"github.com/rgynn/dice/pkg/session/sessiontest"
+)
+
+func TestKeeper_SeededRandomness(t *testing.T) {
+	var sessionIDs []string
+	for i := 0; i < 2; i++ {
+		keeper, err := NewKeeper(10, 100, 0, random.NewSeeded(42), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess, err := keeper.NewSession(context.Background(), session.DefaultTenant, session.Options{MaxNumPlayers: 2, MaxDurationSeconds: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionIDs = append(sessionIDs, sess.ID)
+	}
+	if sessionIDs[0] != sessionIDs[1] {
+		t.Errorf("expected equal session ids from equally seeded keepers, got: %s and %s", sessionIDs[0], sessionIDs[1])
+	}
+}
+
+func TestKeeper_ServerSeedsIgnoreRandomness(t *testing.T) {
+	rnd, err := random.NewSequence([]int{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keeper, err := NewKeeper(10, 100, 0, rnd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seedHashes []string
+	for i := 0; i < 2; i++ {
+		sess, err := keeper.NewSession(context.Background(), session.DefaultTenant, session.Options{MaxNumPlayers: 2, MaxDurationSeconds: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seedHashes = append(seedHashes, sess.ServerSeedHash)
+	}
+	if seedHashes[0] == seedHashes[1] {
+		t.Errorf("expected different server seeds under a replayed sequence, got: %s twice", seedHashes[0])
+	}
+}
+
+func TestKeeper_Conformance(t *testing.T) {
+	sessiontest.TestKeeper(t, func(t *testing.T, maxNumSessions, maxRollNumber int, tenants session.Tenants) session.Keeper {
+		keeper, err := NewKeeper(maxNumSessions, maxRollNumber, time.Minute, random.NewCrypto(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keeper.Tenants = tenants
+		return keeper
+	})
+}
+
+// zeroRandomness makes every session ID the same.
+type zeroRandomness struct{}
+
+func (zeroRandomness) Intn(n int) int { return 0 }
+
+func TestKeeper_Tenants(t *testing.T) {
+	ctx := context.Background()
+	keeper, err := NewKeeper(10, 100, time.Minute, zeroRandomness{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keeper.Tenants = session.Tenants{"guild": {Retention: time.Millisecond}}
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go keeper.Run(runCtx)
+
+	var sessionIDs []string
+	for _, tenant := range []string{session.DefaultTenant, "guild"} {
+		sess, err := keeper.NewSession(ctx, tenant, session.Options{MaxNumPlayers: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionIDs = append(sessionIDs, sess.ID)
+		if _, err := keeper.CancelSession(ctx, tenant, sess.ID, session.Actor{Admin: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sessionIDs[0] != sessionIDs[1] {
+		t.Fatalf("expected the same session ID in both tenants, got: %v", sessionIDs)
+	}
+
+	// Closed sessions of the tenant are kept for its own retention only.
+	for {
+		if _, err := keeper.GetSession(ctx, "guild", sessionIDs[1]); errors.Is(err, session.ErrNotFound) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if status, err := keeper.GetSession(ctx, session.DefaultTenant, sessionIDs[0]); err != nil || status.State != session.StateCancelled {
+		t.Errorf("expected cancelled session of the default tenant to be retained, got: %+v, %v", status, err)
+	}
+}
+
+func TestKeeper_FakeClock(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	keeper, err := NewKeeper(10, 100, time.Minute, random.NewSeeded(42), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keeper.Clock = fake
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go keeper.Run(runCtx)
+
+	sess, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 3, MaxDurationSeconds: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sess.CreatedAt.Equal(start) || !sess.ExpiresAt.Equal(start.Add(10*time.Second)) {
+		t.Errorf("expected session from %s to %s, got: %s to %s", start, start.Add(10*time.Second), sess.CreatedAt, sess.ExpiresAt)
+	}
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eventC, err := keeper.SubscribeSession(subCtx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultC, roll, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-eventC // player_rolled
+
+	// The session timer and the ticker started by the session.
+	fake.BlockUntil(2)
+	fake.Advance(time.Second)
+	if event := <-eventC; event.Type != session.EventTimerTick || event.RemainingSeconds != 9 {
+		t.Errorf("expected timer tick with 9 seconds remaining, got: %+v", event)
+	}
+	fake.Advance(3 * time.Second)
+	status, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != session.StateOpen || status.RemainingSeconds != 6 {
+		t.Errorf("expected open session with 6 seconds remaining, got: %+v", status)
+	}
+	select {
+	case result := <-resultC:
+		t.Fatalf("expected no result before the session expired, got: %+v", result)
+	default:
+	}
+
+	fake.Advance(6 * time.Second)
+	if result := <-resultC; !reflect.DeepEqual(result.Winner, *roll) {
+		t.Errorf("expected the only player to win: %+v, got: %+v", *roll, result)
+	}
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "b", session.RollOptions{}); !errors.Is(err, session.ErrSessionClosed) {
+		t.Errorf("expected error: %v, got: %v", session.ErrSessionClosed, err)
+	}
+
+	// Closed sessions are retained until the retention timer fires.
+	fake.BlockUntil(1)
+	fake.Advance(time.Minute - time.Second)
+	if _, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID); err != nil {
+		t.Errorf("expected closed session to be retained, got: %v", err)
+	}
+	fake.Advance(time.Second)
+	for {
+		if _, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID); errors.Is(err, session.ErrNotFound) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKeeper_Shutdown(t *testing.T) {
+	ctx := context.Background()
+	keeper, err := NewKeeper(10, 100, time.Minute, random.NewSeeded(42), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedC := make(chan string, 2)
+	keeper.OnClose = func(sess *session.Session) {
+		closedC <- sess.ID
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go keeper.Run(runCtx)
+
+	rolled, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 3, MaxDurationSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 3, MaxDurationSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventC, err := keeper.SubscribeSession(ctx, session.DefaultTenant, rolled.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultC, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, rolled.ID, "a", session.RollOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keeper.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if result := <-resultC; result.Winner.PlayerID != "a" {
+		t.Errorf("expected a to win the session resolved early, got: %+v", result)
+	}
+	var reason session.CloseReason
+	for event := range eventC {
+		if event.Type == session.EventSessionClosed {
+			reason = event.Reason
+		}
+	}
+	if reason != session.CloseReasonShutdown {
+		t.Errorf("expected close reason: %s, got: %s", session.CloseReasonShutdown, reason)
+	}
+	closed := map[string]bool{<-closedC: true, <-closedC: true}
+	if !closed[rolled.ID] || !closed[empty.ID] {
+		t.Errorf("expected both sessions handed to OnClose, got: %v", closed)
+	}
+}
+
+func TestKeeper_RunHandsOverClosedSessions(t *testing.T) {
+	ctx := context.Background()
+	keeper, err := NewKeeper(10, 100, time.Minute, random.NewSeeded(42), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var closed []string
+	keeper.OnClose = func(sess *session.Session) {
+		closed = append(closed, sess.ID)
+	}
+	sess, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keeper.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session closed before Run was stopped is still handed over.
+	runCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	keeper.Run(runCtx)
+	if !reflect.DeepEqual(closed, []string{sess.ID}) {
+		t.Errorf("expected OnClose with: %s, got: %v", sess.ID, closed)
+	}
+}
+
+func TestKeeper_RepeatingRandomness(t *testing.T) {
+	ctx := context.Background()
+	// Every session draws 52 numbers, a sequence whose length divides that
+	// draws the same ID for every session.
+	rnd, err := random.NewSequence([]int{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keeper, err := NewKeeper(10, 100, time.Minute, rnd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2}); !errors.Is(err, session.ErrNoSessionID) {
+		t.Errorf("expected error: %v, got: %v", session.ErrNoSessionID, err)
+	}
+}
@@ -0,0 +1,126 @@
+package session
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/rgynn/dice/pkg/clock"
+	"github.com/rgynn/dice/pkg/fair"
+)
+
+// DefaultDurationSeconds is how long a session stays open when no duration is given.
+const DefaultDurationSeconds = 10
+
+// MaxNumPlayers caps the number of players per session, each player holds a
+// buffered roll until the session closes.
+const MaxNumPlayers = 1000
+
+// Validate returns the options with defaults applied, checked against the
+// highest roll the Keeper allows. Sessions may only have webhooks when the
+// Keeper can deliver them.
+func (opts Options) Validate(maxRollNumber int, webhooksEnabled bool) (Options, error) {
+	if opts.MaxDurationSeconds == 0 {
+		opts.MaxDurationSeconds = DefaultDurationSeconds
+	}
+	if opts.MaxDurationSeconds < 0 {
+		return opts, fmt.Errorf("%w: duration must be positive", ErrInvalidDuration)
+	}
+	if opts.MaxNumPlayers < 2 {
+		return opts, ErrNotEnoughPlayers
+	}
+	if opts.MaxNumPlayers > MaxNumPlayers {
+		return opts, fmt.Errorf("%w: at most %d players per session", ErrTooManyPlayers, MaxNumPlayers)
+	}
+	if err := opts.validateRollRange(maxRollNumber); err != nil {
+		return opts, err
+	}
+	if opts.Dice == nil {
+		if opts.MinRoll == 0 {
+			opts.MinRoll = 1
+		}
+		if opts.MaxRoll == 0 {
+			opts.MaxRoll = maxRollNumber
+		}
+	}
+	if opts.TiePolicy == "" {
+		opts.TiePolicy = TiePolicyFirst
+	}
+	if !opts.TiePolicy.Valid() {
+		return opts, ErrInvalidTiePolicy
+	}
+	if err := validateWebhooks(opts.Webhooks, webhooksEnabled); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// validateRollRange checks the inclusive range rolls should fall within,
+// defaulting to 1..maxRollNumber. Sessions rolling dice have no range.
+func (opts Options) validateRollRange(maxRollNumber int) error {
+	minRoll, maxRoll := opts.MinRoll, opts.MaxRoll
+	if opts.Dice != nil {
+		if minRoll != 0 || maxRoll != 0 {
+			return fmt.Errorf("%w: cannot combine roll range with dice expression", ErrInvalidRollRange)
+		}
+		return nil
+	}
+	if minRoll == 0 {
+		minRoll = 1
+	}
+	if maxRoll == 0 {
+		maxRoll = maxRollNumber
+	}
+	if minRoll < 1 || minRoll > maxRoll {
+		return fmt.Errorf("%w: min roll must be between 1 and max roll", ErrInvalidRollRange)
+	}
+	if maxRoll > maxRollNumber {
+		return fmt.Errorf("%w: max roll must not exceed %d", ErrInvalidRollRange, maxRollNumber)
+	}
+	return nil
+}
+
+// validateWebhooks requires absolute http(s) URLs.
+func validateWebhooks(webhooks []string, enabled bool) error {
+	if len(webhooks) == 0 {
+		return nil
+	}
+	if !enabled {
+		return ErrWebhooksDisabled
+	}
+	if len(webhooks) > MaxNumWebhooks {
+		return fmt.Errorf("%w: at most %d webhooks per session", ErrInvalidWebhook, MaxNumWebhooks)
+	}
+	for _, webhook := range webhooks {
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: %s", ErrInvalidWebhook, webhook)
+		}
+	}
+	return nil
+}
+
+// New returns a session created at the given time with options that passed
+// Validate, ready to be opened. Its timer runs on clk.
+func New(id, serverSeed string, opts Options, clk clock.Clock, createdAt time.Time) *Session {
+	expiresAt := createdAt.Add(time.Duration(opts.MaxDurationSeconds) * time.Second)
+	return &Session{
+		ID:             id,
+		Creator:        opts.Creator,
+		MaxNumPlayers:  opts.MaxNumPlayers,
+		MinRoll:        opts.MinRoll,
+		MaxRoll:        opts.MaxRoll,
+		Dice:           opts.Dice,
+		TiePolicy:      opts.TiePolicy,
+		ServerSeedHash: fair.Hash(serverSeed),
+		ServerSeed:     serverSeed,
+		CreatedAt:      createdAt,
+		ExpiresAt:      expiresAt,
+		Clock:          clk,
+		Timer:          clk.NewTimer(expiresAt.Sub(clk.Now())),
+		Players:        map[string]chan Result{},
+		Webhooks:       opts.Webhooks,
+		Rolls:          make(chan Roll, opts.MaxNumPlayers),
+		Done:           make(chan struct{}),
+	}
+}
@@ -0,0 +1,793 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/rgynn/dice/pkg/clock"
+	"github.com/rgynn/dice/pkg/fair"
+	"github.com/rgynn/dice/pkg/helper"
+	"github.com/rgynn/dice/pkg/session"
+)
+
+// CloseGrace is how long session keys outlive the session's duration, giving
+// replicas time to close it before Redis expires it.
+const CloseGrace = time.Minute
+
+// DefaultSweepInterval is how often Run closes expired sessions.
+const DefaultSweepInterval = time.Second
+
+// keyPrefix namespaces the keys of a tenant, those of the default tenant are
+// the keys used before there were tenants.
+func keyPrefix(tenant string) string {
+	if tenant == session.DefaultTenant {
+		return "dice:"
+	}
+	return "dice:t:" + tenant + ":"
+}
+
+func openKey(tenant string) string               { return keyPrefix(tenant) + "open" }
+func sessionsKey(tenant string) string           { return keyPrefix(tenant) + "sessions" }
+func retainedKey(tenant string) string           { return keyPrefix(tenant) + "retained" }
+func sessionKey(tenant, sessionID string) string { return keyPrefix(tenant) + "session:" + sessionID }
+func stateKey(tenant, sessionID string) string   { return sessionKey(tenant, sessionID) + ":state" }
+func playersKey(tenant, sessionID string) string { return sessionKey(tenant, sessionID) + ":players" }
+func rollsKey(tenant, sessionID string) string   { return sessionKey(tenant, sessionID) + ":rolls" }
+func deliveriesKey(tenant, sessionID string) string {
+	return sessionKey(tenant, sessionID) + ":deliveries"
+}
+func eventsChannel(tenant, sessionID string) string { return sessionKey(tenant, sessionID) + ":events" }
+
+// eventsPattern matches the events channels of every tenant's sessions.
+const eventsPattern = "dice:*:events"
+
+// newSessionScript stores a new session unless the max number of open sessions
+// is reached (0) or the id is taken (-1).
+var newSessionScript = goredis.NewScript(`
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[1]) then
+	return 0
+end
+if not redis.call('SET', KEYS[3], ARGV[5], 'PX', ARGV[6], 'NX') then
+	return -1
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[4], ARGV[2])
+return 1
+`)
+
+// addRollScript adds a roll to an open session and returns the number of
+// rolls, or -1 not found, -2 closed, -3 already rolled, -4 max players reached.
+var addRollScript = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return -2
+end
+if redis.call('SISMEMBER', KEYS[3], ARGV[1]) == 1 then
+	return -3
+end
+if redis.call('SCARD', KEYS[3]) >= tonumber(ARGV[3]) then
+	return -4
+end
+local ttl = redis.call('PTTL', KEYS[1])
+redis.call('SADD', KEYS[3], ARGV[1])
+redis.call('PEXPIRE', KEYS[3], ttl)
+local n = redis.call('RPUSH', KEYS[4], ARGV[2])
+redis.call('PEXPIRE', KEYS[4], ttl)
+return n
+`)
+
+// closeSessionScript marks a session closed by storing the reason it closed
+// for under its state key, keeping it for the retention, and returns its
+// record and rolls. Retained sessions are noted to
+// be pruned from the index once they expire, others are pruned right away. It
+// returns 0 when the session was already closed and -1 when it does not exist.
+var closeSessionScript = goredis.NewScript(`
+local record = redis.call('GET', KEYS[1])
+if not record then
+	return -1
+end
+if not redis.call('SET', KEYS[2], ARGV[1], 'NX') then
+	return 0
+end
+local rolls = redis.call('LRANGE', KEYS[4], 0, -1)
+redis.call('ZREM', KEYS[6], ARGV[3])
+local retention = tonumber(ARGV[2])
+for i = 1, 5 do
+	if retention > 0 then
+		redis.call('PEXPIRE', KEYS[i], retention)
+	else
+		redis.call('DEL', KEYS[i])
+	end
+end
+if retention > 0 then
+	redis.call('ZADD', KEYS[8], ARGV[4], ARGV[3])
+else
+	redis.call('ZREM', KEYS[7], ARGV[3])
+end
+return {record, rolls}
+`)
+
+// addDeliveryScript appends to the delivery log of a session that still exists.
+var addDeliveryScript = goredis.NewScript(`
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+	return 0
+end
+redis.call('RPUSH', KEYS[2], ARGV[1])
+redis.call('PEXPIRE', KEYS[2], ttl)
+return 1
+`)
+
+// record is what is stored for a session, everything else is derived from it
+// and its rolls.
+type record struct {
+	ID         string          `json:"id"`
+	Tenant     string          `json:"tenant,omitempty"`
+	ServerSeed string          `json:"server_seed"`
+	Options    session.Options `json:"options"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// Keeper keeps sessions in Redis so any number of server replicas can share
+// them. Sessions are resolved by whichever replica adds the last roll, is
+// asked to close it or, once it expires, sweeps it in Run. Events, including
+// the result, reach waiting roll handlers and subscribers on every replica
+// through pub/sub, roll handlers share a single subscription and fall back to
+// reading the result should it be missed. The limits given to NewKeeper are
+// those of the default tenant, every tenant's sessions are kept under keys of
+// their own.
+type Keeper struct {
+	Client         *goredis.Client
+	MaxNumSessions int
+	MaxRollNumber  int
+	Retention      time.Duration
+	Tenants        session.Tenants
+	Randomness     session.Randomness
+	Notifier       session.Notifier
+	SweepInterval  time.Duration
+	Clock          clock.Clock
+	shuttingDown   int32
+	mu             sync.Mutex
+	subscription   *goredis.PubSub
+	waiters        map[string]map[*waiter]bool
+}
+
+// waiter is a roll handler waiting on the result of a session, poll asks it
+// to read the result in case it was published while unsubscribed.
+type waiter struct {
+	resultC chan session.Result
+	done    chan struct{}
+	poll    chan struct{}
+}
+
+func NewKeeper(client *goredis.Client, maxNumSessions, maxRandom int, retention time.Duration, rnd session.Randomness, notifier session.Notifier) (*Keeper, error) {
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, err
+	}
+	return &Keeper{
+		Client:         client,
+		MaxNumSessions: maxNumSessions,
+		MaxRollNumber:  maxRandom,
+		Retention:      retention,
+		Randomness:     rnd,
+		Notifier:       notifier,
+		SweepInterval:  DefaultSweepInterval,
+		Clock:          clock.New(),
+	}, nil
+}
+
+func (svc *Keeper) NewSession(ctx context.Context, tenant string, opts session.Options) (*session.Session, error) {
+	limits, err := svc.limits(tenant)
+	if err != nil {
+		return nil, err
+	}
+	opts, err = opts.Validate(limits.MaxRollNumber, svc.Notifier != nil)
+	if err != nil {
+		return nil, err
+	}
+	if atomic.LoadInt32(&svc.shuttingDown) == 1 {
+		return nil, session.ErrShuttingDown
+	}
+	serverSeed, err := fair.NewSeed()
+	if err != nil {
+		return nil, err
+	}
+	now := svc.Clock.Now()
+	for i := 0; i < session.MaxSessionIDAttempts; i++ {
+		sess := session.New(helper.RandomStringFrom(svc.Randomness.Intn, 20), serverSeed, opts, svc.Clock, now)
+		sess.Timer.Stop()
+		sess.Tenant = tenant
+		data, err := json.Marshal(&record{ID: sess.ID, Tenant: tenant, ServerSeed: sess.ServerSeed, Options: opts, CreatedAt: now})
+		if err != nil {
+			return nil, err
+		}
+		ttl := sess.ExpiresAt.Add(CloseGrace).Sub(now)
+		n, err := newSessionScript.Run(ctx, svc.Client, []string{openKey(tenant), sessionsKey(tenant), sessionKey(tenant, sess.ID)},
+			limits.MaxNumSessions, sess.ID, sess.ExpiresAt.UnixNano(), now.UnixNano(), data, ttl.Milliseconds()).Int()
+		if err != nil {
+			return nil, err
+		}
+		switch n {
+		case 0:
+			return nil, session.ErrMaxNumSessionsReached
+		case 1:
+			return sess, nil
+		}
+	}
+	return nil, session.ErrNoSessionID
+}
+
+func (svc *Keeper) GetSession(ctx context.Context, tenant, sessionID string) (*session.Status, error) {
+	sess, err := svc.load(ctx, tenant, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return sess.Status(), nil
+}
+
+func (svc *Keeper) CancelSession(ctx context.Context, tenant, sessionID string, actor session.Actor) (*session.Status, error) {
+	return svc.closeByActor(ctx, tenant, sessionID, actor, session.CloseReasonCancelled)
+}
+
+func (svc *Keeper) CloseSession(ctx context.Context, tenant, sessionID string, actor session.Actor) (*session.Status, error) {
+	return svc.closeByActor(ctx, tenant, sessionID, actor, session.CloseReasonClosed)
+}
+
+func (svc *Keeper) closeByActor(ctx context.Context, tenant, sessionID string, actor session.Actor, reason session.CloseReason) (*session.Status, error) {
+	sess, err := svc.load(ctx, tenant, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := sess.Authorize(actor); err != nil {
+		return nil, err
+	}
+	if sess, err = svc.closeSession(ctx, tenant, sessionID, reason); err != nil {
+		return nil, err
+	}
+	return sess.Status(), nil
+}
+
+func (svc *Keeper) SubscribeSession(ctx context.Context, tenant, sessionID string) (chan session.Event, error) {
+	pubsub := svc.Client.Subscribe(ctx, eventsChannel(tenant, sessionID))
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	sess, err := svc.load(ctx, tenant, sessionID)
+	if err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	eventC := make(chan session.Event, session.EventBufferSize)
+	if status := sess.Status(); status.Result != nil {
+		pubsub.Close()
+		eventC <- session.Event{Type: session.EventSessionClosed, SessionID: sessionID, Result: status.Result}
+		close(eventC)
+		return eventC, nil
+	}
+	go func() {
+		defer close(eventC)
+		defer pubsub.Close()
+		msgC := pubsub.Channel()
+		ticker := svc.Clock.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			var event session.Event
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				event = session.Event{Type: session.EventTimerTick, SessionID: sessionID, RemainingSeconds: remainingSeconds(sess.ExpiresAt.Sub(svc.Clock.Now()))}
+			case msg, ok := <-msgC:
+				if !ok {
+					return
+				}
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+					continue
+				}
+			}
+			select {
+			case eventC <- event:
+			default:
+			}
+			if event.Type == session.EventSessionClosed {
+				return
+			}
+		}
+	}()
+	return eventC, nil
+}
+
+// ListSessions reads the index of a tenant's sessions by creation time in
+// batches starting at the cursor, loading each batch in one round trip, until
+// the page is filled. Sessions gone since they were indexed are skipped, Run
+// prunes them from the index.
+func (svc *Keeper) ListSessions(ctx context.Context, tenant string, opts session.ListOptions) (*session.List, error) {
+	if _, err := svc.limits(tenant); err != nil {
+		return nil, err
+	}
+	rangeBy := &goredis.ZRangeBy{Min: "-inf", Max: "+inf", Count: int64(opts.PageSize() + 1)}
+	if !opts.CreatedAfter.IsZero() {
+		rangeBy.Min = "(" + strconv.FormatInt(opts.CreatedAfter.UnixNano(), 10)
+	}
+	if opts.Cursor != "" {
+		createdAt, _, err := session.DecodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if createdAt.After(opts.CreatedAfter) {
+			rangeBy.Min = strconv.FormatInt(createdAt.UnixNano(), 10)
+		}
+	}
+	if !opts.CreatedBefore.IsZero() {
+		rangeBy.Max = "(" + strconv.FormatInt(opts.CreatedBefore.UnixNano(), 10)
+	}
+	statuses := []*session.Status{}
+	for ; ; rangeBy.Offset += rangeBy.Count {
+		sessionIDs, err := svc.Client.ZRangeByScore(ctx, sessionsKey(tenant), rangeBy).Result()
+		if err != nil {
+			return nil, err
+		}
+		sessions, err := svc.loadAll(ctx, tenant, sessionIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, sess := range sessions {
+			if status := sess.Status(); opts.Match(status) {
+				statuses = append(statuses, status)
+			}
+		}
+		list, err := session.NewList(statuses, opts)
+		if err != nil || list.NextCursor != "" || int64(len(sessionIDs)) < rangeBy.Count {
+			return list, err
+		}
+	}
+}
+
+func (svc *Keeper) CountOpenSessions(ctx context.Context, tenant string) (int, error) {
+	if _, err := svc.limits(tenant); err != nil {
+		return 0, err
+	}
+	n, err := svc.Client.ZCard(ctx, openKey(tenant)).Result()
+	return int(n), err
+}
+
+func (svc *Keeper) AddSessionRoll(ctx context.Context, tenant, sessionID, playerID string, opts session.RollOptions) (chan session.Result, *session.Roll, error) {
+	if !opts.Type.Valid() {
+		return nil, nil, session.ErrInvalidRollType
+	}
+	sess, err := svc.load(ctx, tenant, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sess.Closed() {
+		return nil, nil, session.ErrSessionClosed
+	}
+	if !svc.Clock.Now().Before(sess.ExpiresAt) {
+		_, _ = svc.closeSession(ctx, tenant, sessionID, session.CloseReasonTimeout)
+		return nil, nil, session.ErrSessionClosed
+	}
+	roll := sess.Roll(playerID, opts)
+	data, err := json.Marshal(&roll)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Wait before rolling so the result can't be missed, the wait outlives
+	// the request when the handler doesn't.
+	if err := svc.subscribe(ctx); err != nil {
+		return nil, nil, err
+	}
+	w := svc.wait(eventsChannel(tenant, sessionID))
+	n, err := addRollScript.Run(ctx, svc.Client, []string{sessionKey(tenant, sessionID), stateKey(tenant, sessionID), playersKey(tenant, sessionID), rollsKey(tenant, sessionID)},
+		playerID, data, sess.MaxNumPlayers).Int()
+	if err == nil && n < 0 {
+		err = map[int]error{
+			-1: session.ErrNotFound,
+			-2: session.ErrSessionClosed,
+			-3: session.ErrPlayerAlreadyRolled,
+			-4: session.ErrMaxNumPlayersReached,
+		}[n]
+	}
+	if err != nil {
+		svc.unwait(eventsChannel(tenant, sessionID), w)
+		return nil, nil, err
+	}
+	svc.publish(ctx, tenant, session.Event{Type: session.EventPlayerRolled, SessionID: sessionID, Roll: &roll})
+	go svc.waitResult(sess, w)
+	if n >= sess.MaxNumPlayers {
+		_, _ = svc.closeSession(ctx, tenant, sessionID, session.CloseReasonAllPlayers)
+	}
+	return w.resultC, &roll, nil
+}
+
+func (svc *Keeper) GetSessionResult(ctx context.Context, tenant, sessionID, playerID string) (*session.PlayerResult, error) {
+	sess, err := svc.load(ctx, tenant, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return sess.PlayerResult(playerID)
+}
+
+func (svc *Keeper) GetSessionDeliveries(ctx context.Context, tenant, sessionID string, actor session.Actor) ([]session.Delivery, error) {
+	sess, err := svc.load(ctx, tenant, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := sess.Authorize(actor); err != nil {
+		return nil, err
+	}
+	values, err := svc.Client.LRange(ctx, deliveriesKey(tenant, sessionID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]session.Delivery, len(values))
+	for i, value := range values {
+		if err := json.Unmarshal([]byte(value), &deliveries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return deliveries, nil
+}
+
+// Run closes sessions that have expired, whichever replica created them,
+// until ctx is done.
+func (svc *Keeper) Run(ctx context.Context) {
+	ticker := svc.Clock.NewTicker(svc.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			svc.sweep(ctx)
+		}
+	}
+}
+
+// Close stops the subscription shared by the rolls waiting on a result, the
+// client is left open.
+func (svc *Keeper) Close() error {
+	svc.mu.Lock()
+	pubsub := svc.subscription
+	svc.subscription = nil
+	svc.mu.Unlock()
+	if pubsub == nil {
+		return nil
+	}
+	return pubsub.Close()
+}
+
+// Shutdown stops this replica from creating sessions, the open ones stay in
+// Redis for the other replicas, or this one once restarted, to resolve.
+func (svc *Keeper) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&svc.shuttingDown, 1)
+	return nil
+}
+
+// sweep closes expired sessions and prunes those no longer retained from the
+// index ListSessions reads.
+func (svc *Keeper) sweep(ctx context.Context) {
+	now := strconv.FormatInt(svc.Clock.Now().UnixNano(), 10)
+	for _, tenant := range append([]string{session.DefaultTenant}, svc.Tenants.Names()...) {
+		sessionIDs, err := svc.Client.ZRangeByScore(ctx, openKey(tenant), &goredis.ZRangeBy{Min: "-inf", Max: now}).Result()
+		if err != nil {
+			return
+		}
+		for _, sessionID := range sessionIDs {
+			if _, err := svc.closeSession(ctx, tenant, sessionID, session.CloseReasonTimeout); errors.Is(err, session.ErrNotFound) {
+				svc.prune(ctx, tenant, openKey(tenant), sessionID)
+			}
+		}
+		sessionIDs, err = svc.Client.ZRangeByScore(ctx, retainedKey(tenant), &goredis.ZRangeBy{Min: "-inf", Max: now}).Result()
+		if err != nil {
+			return
+		}
+		if len(sessionIDs) > 0 {
+			svc.prune(ctx, tenant, retainedKey(tenant), sessionIDs...)
+		}
+	}
+}
+
+// prune removes sessions from the index ListSessions reads and the given
+// index they were found in.
+func (svc *Keeper) prune(ctx context.Context, tenant, key string, sessionIDs ...string) {
+	members := make([]interface{}, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		members[i] = sessionID
+	}
+	_, _ = svc.Client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.ZRem(ctx, key, members...)
+		pipe.ZRem(ctx, sessionsKey(tenant), members...)
+		return nil
+	})
+}
+
+// limits returns the limits of a tenant or session.ErrTenantNotFound.
+func (svc *Keeper) limits(tenant string) (session.Limits, error) {
+	return svc.Tenants.Limits(tenant, session.Limits{
+		MaxNumSessions: svc.MaxNumSessions,
+		MaxRollNumber:  svc.MaxRollNumber,
+		Retention:      svc.Retention,
+	})
+}
+
+// closeSession resolves the session, publishes its result and notifies its
+// webhooks. Only one replica succeeds, the others get ErrSessionClosed.
+func (svc *Keeper) closeSession(ctx context.Context, tenant, sessionID string, reason session.CloseReason) (*session.Session, error) {
+	limits, err := svc.limits(tenant)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := closeSessionScript.Run(ctx, svc.Client, closeKeys(tenant, sessionID),
+		string(reason), limits.Retention.Milliseconds(), sessionID, svc.Clock.Now().Add(limits.Retention).UnixNano()).Result()
+	if err != nil {
+		return nil, err
+	}
+	switch reply {
+	case int64(-1):
+		return nil, session.ErrNotFound
+	case int64(0):
+		return nil, session.ErrSessionClosed
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return nil, errors.New("unexpected reply from redis when closing session")
+	}
+	data, _ := values[0].(string)
+	var rolls []string
+	if values, ok := values[1].([]interface{}); ok {
+		for _, value := range values {
+			roll, _ := value.(string)
+			rolls = append(rolls, roll)
+		}
+	}
+	sess, err := svc.newSession(data, rolls, reason)
+	if err != nil {
+		return nil, err
+	}
+	result := sess.Status().Result
+	for i := range result.TieBreaks {
+		svc.publish(ctx, tenant, session.Event{Type: session.EventTieBreak, SessionID: sessionID, TieBreak: &result.TieBreaks[i]})
+	}
+	svc.publish(ctx, tenant, session.Event{Type: session.EventSessionClosed, SessionID: sessionID, Result: result, Reason: reason})
+	if len(sess.Webhooks) > 0 && svc.Notifier != nil {
+		sess.OnDelivery = func(delivery session.Delivery) {
+			svc.addDelivery(tenant, sessionID, delivery)
+		}
+		svc.Notifier.Notify(sess)
+	}
+	return sess, nil
+}
+
+// closeKeys are the keys closeSessionScript works on.
+func closeKeys(tenant, sessionID string) []string {
+	return []string{sessionKey(tenant, sessionID), stateKey(tenant, sessionID), playersKey(tenant, sessionID), rollsKey(tenant, sessionID), deliveriesKey(tenant, sessionID),
+		openKey(tenant), sessionsKey(tenant), retainedKey(tenant)}
+}
+
+// subscribe starts the subscription to every session's events shared by the
+// rolls waiting on a result, unless it is running.
+func (svc *Keeper) subscribe(ctx context.Context) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.subscription != nil {
+		return nil
+	}
+	pubsub := svc.Client.PSubscribe(context.Background(), eventsPattern)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+	svc.subscription = pubsub
+	if svc.waiters == nil {
+		svc.waiters = map[string]map[*waiter]bool{}
+	}
+	go svc.listen(pubsub)
+	return nil
+}
+
+// listen hands published results to the rolls waiting on them until the
+// subscription is closed. The subscription reconnects by itself, results
+// published meanwhile are lost, so every waiting roll then polls its session.
+func (svc *Keeper) listen(pubsub *goredis.PubSub) {
+	for msg := range pubsub.ChannelWithSubscriptions(context.Background(), 100) {
+		switch msg := msg.(type) {
+		case *goredis.Subscription:
+			svc.pollAll()
+		case *goredis.Message:
+			var event session.Event
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				continue
+			}
+			if event.Type == session.EventSessionClosed && event.Result != nil {
+				svc.deliver(msg.Channel, *event.Result)
+			}
+		}
+	}
+}
+
+// wait adds a roll waiting on the result published on the events channel.
+func (svc *Keeper) wait(channel string) *waiter {
+	w := &waiter{
+		resultC: make(chan session.Result, 1),
+		done:    make(chan struct{}),
+		poll:    make(chan struct{}, 1),
+	}
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.waiters[channel] == nil {
+		svc.waiters[channel] = map[*waiter]bool{}
+	}
+	svc.waiters[channel][w] = true
+	return w
+}
+
+// unwait removes a roll that no longer waits on a result.
+func (svc *Keeper) unwait(channel string, w *waiter) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.waiters[channel][w] {
+		delete(svc.waiters[channel], w)
+		close(w.done)
+	}
+	if len(svc.waiters[channel]) == 0 {
+		delete(svc.waiters, channel)
+	}
+}
+
+// deliver hands the result to every roll waiting on the events channel, once.
+func (svc *Keeper) deliver(channel string, result session.Result) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	for w := range svc.waiters[channel] {
+		w.resultC <- result
+		close(w.done)
+	}
+	delete(svc.waiters, channel)
+}
+
+func (svc *Keeper) pollAll() {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	for _, waiters := range svc.waiters {
+		for w := range waiters {
+			select {
+			case w.poll <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// waitResult waits for the session's result to be delivered, closing the
+// session itself when it expires. In case the result was published but
+// missed, it reads the session when asked to and, once expired, every
+// SweepInterval until the result shows up.
+func (svc *Keeper) waitResult(sess *session.Session, w *waiter) {
+	channel := eventsChannel(sess.Tenant, sess.ID)
+	timer := svc.Clock.NewTimer(sess.ExpiresAt.Sub(svc.Clock.Now()))
+	defer func() { timer.Stop() }()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.poll:
+		case <-timer.C():
+			_, _ = svc.closeSession(context.Background(), sess.Tenant, sess.ID, session.CloseReasonTimeout)
+			timer = svc.Clock.NewTimer(svc.SweepInterval)
+		}
+		latest, err := svc.load(context.Background(), sess.Tenant, sess.ID)
+		if errors.Is(err, session.ErrNotFound) {
+			svc.unwait(channel, w)
+			return
+		}
+		if err == nil && latest.Status().Result != nil {
+			svc.deliver(channel, *latest.Status().Result)
+			return
+		}
+	}
+}
+
+func (svc *Keeper) publish(ctx context.Context, tenant string, event session.Event) {
+	data, err := json.Marshal(&event)
+	if err != nil {
+		return
+	}
+	svc.Client.Publish(ctx, eventsChannel(tenant, event.SessionID), data)
+}
+
+func (svc *Keeper) addDelivery(tenant, sessionID string, delivery session.Delivery) {
+	data, err := json.Marshal(&delivery)
+	if err != nil {
+		return
+	}
+	addDeliveryScript.Run(context.Background(), svc.Client, []string{sessionKey(tenant, sessionID), deliveriesKey(tenant, sessionID)}, data)
+}
+
+// load reads the session of a tenant with its rolls, closed sessions come back resolved.
+func (svc *Keeper) load(ctx context.Context, tenant, sessionID string) (*session.Session, error) {
+	if _, err := svc.limits(tenant); err != nil {
+		return nil, err
+	}
+	sessions, err := svc.loadAll(ctx, tenant, []string{sessionID})
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, session.ErrNotFound
+	}
+	return sessions[0], nil
+}
+
+// loadAll reads the sessions of a tenant in one round trip, skipping those
+// that do not exist.
+func (svc *Keeper) loadAll(ctx context.Context, tenant string, sessionIDs []string) ([]*session.Session, error) {
+	if len(sessionIDs) == 0 {
+		return nil, nil
+	}
+	data := make([]*goredis.StringCmd, len(sessionIDs))
+	reasons := make([]*goredis.StringCmd, len(sessionIDs))
+	rolls := make([]*goredis.StringSliceCmd, len(sessionIDs))
+	_, err := svc.Client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, sessionID := range sessionIDs {
+			data[i] = pipe.Get(ctx, sessionKey(tenant, sessionID))
+			rolls[i] = pipe.LRange(ctx, rollsKey(tenant, sessionID), 0, -1)
+			reasons[i] = pipe.Get(ctx, stateKey(tenant, sessionID))
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, goredis.Nil) {
+		return nil, err
+	}
+	sessions := make([]*session.Session, 0, len(sessionIDs))
+	for i := range sessionIDs {
+		if errors.Is(data[i].Err(), goredis.Nil) {
+			continue
+		}
+		sess, err := svc.newSession(data[i].Val(), rolls[i].Val(), session.CloseReason(reasons[i].Val()))
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, nil
+}
+
+// newSession rebuilds a session from its record and rolls, resolving it for
+// the reason it closed if it has been closed. The session is never opened.
+func (svc *Keeper) newSession(data string, rolls []string, reason session.CloseReason) (*session.Session, error) {
+	var rec record
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		return nil, err
+	}
+	sess := session.New(rec.ID, rec.ServerSeed, rec.Options, svc.Clock, rec.CreatedAt)
+	sess.Tenant = rec.Tenant
+	sess.Timer.Stop()
+	restored := make([]session.Roll, len(rolls))
+	for i, value := range rolls {
+		if err := json.Unmarshal([]byte(value), &restored[i]); err != nil {
+			return nil, err
+		}
+	}
+	sess.Restore(restored)
+	if reason != "" {
+		_ = sess.CloseWithReason(make(chan string, 1), reason)
+	}
+	return sess, nil
+}
+
+func remainingSeconds(remaining time.Duration) int {
+	if remaining <= 0 {
+		return 0
+	}
+	return int(math.Ceil(remaining.Seconds()))
+}
@@ -0,0 +1,390 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/rgynn/dice/pkg/random"
+	"github.com/rgynn/dice/pkg/session"
+	"github.com/rgynn/dice/pkg/session/sessiontest"
+)
+
+// newTestReplicas returns keepers sharing one Redis, as if run by separate
+// server replicas. Set DICE_TEST_REDIS_URL to test against a redis-server,
+// its database is flushed, otherwise an in-process stand-in is used.
+func newTestReplicas(t *testing.T, n, maxNumSessions int, notifier session.Notifier) []*Keeper {
+	opts := &goredis.Options{}
+	if url := os.Getenv("DICE_TEST_REDIS_URL"); url != "" {
+		var err error
+		if opts, err = goredis.ParseURL(url); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		opts.Addr = miniredis.RunT(t).Addr()
+	}
+	var keepers []*Keeper
+	for i := 0; i < n; i++ {
+		client := goredis.NewClient(opts)
+		t.Cleanup(func() { client.Close() })
+		if i == 0 {
+			if err := client.FlushDB(context.Background()).Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		keeper, err := NewKeeper(client, maxNumSessions, 100, time.Minute, random.NewCrypto(), notifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keeper.SweepInterval = 10 * time.Millisecond
+		keepers = append(keepers, keeper)
+	}
+	return keepers
+}
+
+type mockNotifier struct{}
+
+func (mockNotifier) Notify(sess *session.Session) {
+	for _, url := range sess.Webhooks {
+		sess.AddDelivery(session.Delivery{URL: url, Attempt: 1, StatusCode: 200, Delivered: true})
+	}
+}
+
+func TestKeeper_Replicas(t *testing.T) {
+	ctx := context.Background()
+	replicas := newTestReplicas(t, 2, 1, mockNotifier{})
+	a, b := replicas[0], replicas[1]
+
+	sess, err := a.NewSession(ctx, session.DefaultTenant, session.Options{Creator: "x", MaxNumPlayers: 2, MaxDurationSeconds: 60, TiePolicy: session.TiePolicySplit, Webhooks: []string{"http://bot.example/dice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2}); !errors.Is(err, session.ErrMaxNumSessionsReached) {
+		t.Errorf("expected error: %v, got: %v", session.ErrMaxNumSessionsReached, err)
+	}
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eventC, err := b.SubscribeSession(subCtx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resultA, rollA, err := a.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{ClientSeed: "seed-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{}); !errors.Is(err, session.ErrPlayerAlreadyRolled) {
+		t.Errorf("expected error: %v, got: %v", session.ErrPlayerAlreadyRolled, err)
+	}
+	status, err := b.GetSession(ctx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != session.StateOpen || !reflect.DeepEqual(status.Players, []string{"a"}) || status.ServerSeedHash != sess.ServerSeedHash {
+		t.Errorf("expected open session with player a, got: %+v", status)
+	}
+	resultB, rollB, err := b.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "b", session.RollOptions{ClientSeed: "seed-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-resultA
+	if other := <-resultB; !reflect.DeepEqual(result, other) {
+		t.Errorf("expected equal results on both replicas, got: %+v and %+v", result, other)
+	}
+	if !reflect.DeepEqual(result.Proof.Rolls, []session.Roll{*rollA, *rollB}) {
+		t.Errorf("expected rolls: %+v, got: %+v", []session.Roll{*rollA, *rollB}, result.Proof.Rolls)
+	}
+	if err := session.Verify(result); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := a.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "c", session.RollOptions{}); !errors.Is(err, session.ErrSessionClosed) {
+		t.Errorf("expected error: %v, got: %v", session.ErrSessionClosed, err)
+	}
+
+	var events []session.EventType
+	for event := range eventC {
+		if event.Type != session.EventTimerTick {
+			events = append(events, event.Type)
+		}
+	}
+	if expected := []session.EventType{session.EventPlayerRolled, session.EventPlayerRolled, session.EventSessionClosed}; !reflect.DeepEqual(expected, events) {
+		t.Errorf("expected events: %v, got: %v", expected, events)
+	}
+
+	for _, keeper := range replicas {
+		status, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != session.StateClosed || !reflect.DeepEqual(status.Result, &result) {
+			t.Errorf("expected closed session with result: %+v, got: %+v", result, status)
+		}
+		playerResult, err := keeper.GetSessionResult(ctx, session.DefaultTenant, sess.ID, "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(playerResult.Your, rollB) {
+			t.Errorf("expected roll: %+v, got: %+v", rollB, playerResult.Your)
+		}
+		deliveries, err := keeper.GetSessionDeliveries(ctx, session.DefaultTenant, sess.ID, session.Actor{PlayerID: "x"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != 1 || !deliveries[0].Delivered {
+			t.Errorf("expected a single successful delivery, got: %+v", deliveries)
+		}
+		list, err := keeper.ListSessions(ctx, session.DefaultTenant, session.ListOptions{State: session.StateClosed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Sessions) != 1 || list.Sessions[0].ID != sess.ID {
+			t.Errorf("expected closed session %s to be listed, got: %+v", sess.ID, list.Sessions)
+		}
+	}
+	if _, err := b.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2}); err != nil {
+		t.Errorf("expected a new session once the other closed, got: %v", err)
+	}
+}
+
+func TestKeeper_CancelOnOtherReplica(t *testing.T) {
+	ctx := context.Background()
+	replicas := newTestReplicas(t, 2, 10, nil)
+	a, b := replicas[0], replicas[1]
+
+	sess, err := a.NewSession(ctx, session.DefaultTenant, session.Options{Creator: "x", MaxNumPlayers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultC, _, err := a.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.CancelSession(ctx, session.DefaultTenant, sess.ID, session.Actor{PlayerID: "y"}); !errors.Is(err, session.ErrForbidden) {
+		t.Errorf("expected error: %v, got: %v", session.ErrForbidden, err)
+	}
+	status, err := b.CancelSession(ctx, session.DefaultTenant, sess.ID, session.Actor{PlayerID: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != session.StateCancelled {
+		t.Errorf("expected cancelled session, got: %+v", status)
+	}
+	if result := <-resultC; !result.Cancelled {
+		t.Errorf("expected cancelled result, got: %+v", result)
+	}
+	if _, err := a.CloseSession(ctx, session.DefaultTenant, sess.ID, session.Actor{Admin: true}); !errors.Is(err, session.ErrSessionClosed) {
+		t.Errorf("expected error: %v, got: %v", session.ErrSessionClosed, err)
+	}
+}
+
+func TestKeeper_Expiry(t *testing.T) {
+	ctx := context.Background()
+	replicas := newTestReplicas(t, 2, 10, nil)
+	a, b := replicas[0], replicas[1]
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go b.Run(runCtx)
+
+	sess, err := a.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 3, MaxDurationSeconds: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// Closed by either the roll waiting on this replica or the sweep on the other.
+	for {
+		status, err := a.GetSession(ctx, session.DefaultTenant, sess.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State == session.StateClosed {
+			if status.Result.Winner.PlayerID != "a" {
+				t.Errorf("expected a to win the expired session, got: %+v", status.Result)
+			}
+			break
+		}
+		if time.Since(sess.ExpiresAt) > 5*time.Second {
+			t.Fatal("expected expired session to be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeeper_MissedResult(t *testing.T) {
+	ctx := context.Background()
+	a := newTestReplicas(t, 1, 10, nil)[0]
+	defer a.Close()
+
+	var sessionIDs []string
+	var resultCs []chan session.Result
+	for i := 0; i < 2; i++ {
+		sess, err := a.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 3, MaxDurationSeconds: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resultC, _, err := a.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionIDs = append(sessionIDs, sess.ID)
+		resultCs = append(resultCs, resultC)
+	}
+	if n, err := a.Client.PubSubNumPat(ctx).Result(); err != nil || n != 1 {
+		t.Errorf("expected a single subscription shared by every roll, got: %d, %v", n, err)
+	}
+
+	// Close the first session without publishing its result, as if the
+	// message was lost.
+	keys := closeKeys(session.DefaultTenant, sessionIDs[0])
+	if err := closeSessionScript.Run(ctx, a.Client, keys, string(session.CloseReasonClosed), time.Minute.Milliseconds(), sessionIDs[0], time.Now().Add(time.Minute).UnixNano()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	for i, resultC := range resultCs {
+		select {
+		case result := <-resultC:
+			if result.Winner.PlayerID != "a" {
+				t.Errorf("expected a to win session %s, got: %+v", sessionIDs[i], result)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the result of session %s", sessionIDs[i])
+		}
+	}
+}
+
+func TestKeeper_ListPaged(t *testing.T) {
+	ctx := context.Background()
+	keeper := newTestReplicas(t, 1, 10, nil)[0]
+	keeper.Retention = 50 * time.Millisecond
+	var expected []*session.Session
+	for i := 0; i < 5; i++ {
+		sess, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2, MaxDurationSeconds: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, sess)
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		if !expected[i].CreatedAt.Equal(expected[j].CreatedAt) {
+			return expected[i].CreatedAt.Before(expected[j].CreatedAt)
+		}
+		return expected[i].ID < expected[j].ID
+	})
+	for _, sess := range expected[:2] {
+		if _, err := keeper.CancelSession(ctx, session.DefaultTenant, sess.ID, session.Actor{Admin: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(opts session.ListOptions) []string {
+		var sessionIDs []string
+		for {
+			list, err := keeper.ListSessions(ctx, session.DefaultTenant, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, status := range list.Sessions {
+				sessionIDs = append(sessionIDs, status.ID)
+			}
+			if list.NextCursor == "" {
+				return sessionIDs
+			}
+			opts.Cursor = list.NextCursor
+		}
+	}
+	var open []string
+	for _, sess := range expected[2:] {
+		open = append(open, sess.ID)
+	}
+	if sessionIDs := list(session.ListOptions{State: session.StateOpen, Limit: 2}); !reflect.DeepEqual(sessionIDs, open) {
+		t.Errorf("expected open sessions: %v, got: %v", open, sessionIDs)
+	}
+	if sessionIDs := list(session.ListOptions{Limit: 2}); len(sessionIDs) != len(expected) {
+		t.Errorf("expected %d sessions, got: %v", len(expected), sessionIDs)
+	}
+
+	// Cancelled sessions are pruned from the index once no longer retained.
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go keeper.Run(runCtx)
+	for {
+		n, err := keeper.Client.ZCard(ctx, sessionsKey(session.DefaultTenant)).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == int64(len(open)) {
+			break
+		}
+		if time.Since(expected[0].CreatedAt) > 5*time.Second {
+			t.Fatalf("expected cancelled sessions to be pruned, got: %d sessions", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeeper_CloseReasonRestored(t *testing.T) {
+	ctx := context.Background()
+	keeper := newTestReplicas(t, 1, 10, nil)[0]
+	type testcase struct {
+		Reason        session.CloseReason
+		ExpectedState session.State
+	}
+	tests := []testcase{
+		{Reason: session.CloseReasonAllPlayers, ExpectedState: session.StateClosed},
+		{Reason: session.CloseReasonTimeout, ExpectedState: session.StateClosed},
+		{Reason: session.CloseReasonClosed, ExpectedState: session.StateClosed},
+		{Reason: session.CloseReasonCancelled, ExpectedState: session.StateCancelled},
+	}
+	for _, tc := range tests {
+		t.Run(string(tc.Reason), func(t *testing.T) {
+			sess, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2, MaxDurationSeconds: 60})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := keeper.closeSession(ctx, session.DefaultTenant, sess.ID, tc.Reason); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := keeper.load(ctx, session.DefaultTenant, sess.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reason := loaded.CloseReason(); reason != tc.Reason {
+				t.Errorf("expected close reason: %v, got: %v", tc.Reason, reason)
+			}
+			if state := loaded.Status().State; state != tc.ExpectedState {
+				t.Errorf("expected state: %v, got: %v", tc.ExpectedState, state)
+			}
+		})
+	}
+}
+
+func TestKeeper_Conformance(t *testing.T) {
+	sessiontest.TestKeeper(t, func(t *testing.T, maxNumSessions, maxRollNumber int, tenants session.Tenants) session.Keeper {
+		keeper := newTestReplicas(t, 1, maxNumSessions, nil)[0]
+		keeper.Tenants = tenants
+		return keeper
+	})
+}
+
+func TestKeeper_RepeatingRandomness(t *testing.T) {
+	ctx := context.Background()
+	keeper := newTestReplicas(t, 1, 10, nil)[0]
+	rnd, err := random.NewSequence([]int{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keeper.Randomness = rnd
+	if _, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2}); !errors.Is(err, session.ErrNoSessionID) {
+		t.Errorf("expected error: %v, got: %v", session.ErrNoSessionID, err)
+	}
+}
@@ -3,67 +3,452 @@ package session
 import (
 	"context"
 	"errors"
-	"math/rand"
+	"math"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/rgynn/dice/pkg/clock"
+	"github.com/rgynn/dice/pkg/dice"
+	"github.com/rgynn/dice/pkg/fair"
 )
 
+// Keeper holds the sessions of every tenant. Sessions are only found through
+// the tenant they were created in, every method returns ErrTenantNotFound for
+// tenants the keeper doesn't know and ErrNotFound for sessions of another.
 type Keeper interface {
-	NewSession(ctx context.Context, maxNumPlayers, maxDurationSeconds int) (*Session, error)
-	AddSessionRoll(ctx context.Context, sessionID, playerID string) (chan Roll, *Roll, error)
-	Run()
+	NewSession(ctx context.Context, tenant string, opts Options) (*Session, error)
+	GetSession(ctx context.Context, tenant, sessionID string) (*Status, error)
+	CancelSession(ctx context.Context, tenant, sessionID string, actor Actor) (*Status, error)
+	CloseSession(ctx context.Context, tenant, sessionID string, actor Actor) (*Status, error)
+	SubscribeSession(ctx context.Context, tenant, sessionID string) (chan Event, error)
+	ListSessions(ctx context.Context, tenant string, opts ListOptions) (*List, error)
+	// CountOpenSessions returns the number of open sessions of the tenant
+	// without listing them.
+	CountOpenSessions(ctx context.Context, tenant string) (int, error)
+	AddSessionRoll(ctx context.Context, tenant, sessionID, playerID string, opts RollOptions) (chan Result, *Roll, error)
+	GetSessionResult(ctx context.Context, tenant, sessionID, playerID string) (*PlayerResult, error)
+	GetSessionDeliveries(ctx context.Context, tenant, sessionID string, actor Actor) ([]Delivery, error)
+	// Run does the keeper's background work until ctx is done.
+	Run(ctx context.Context)
+	// Shutdown stops the keeper from creating sessions, NewSession returns
+	// ErrShuttingDown from then on, and either resolves the open sessions
+	// with the rolls they have or leaves them for a persistent store or
+	// another replica to carry on. Run must still be running.
+	Shutdown(ctx context.Context) error
+}
+
+// Randomness is the source a Keeper draws session IDs from. Server seeds are
+// always read from crypto/rand so a replayed source cannot predict rolls.
+// Intn must return a number in the range [0,n) and be safe for concurrent use.
+type Randomness interface {
+	Intn(n int) int
 }
 
 var ErrMaxNumSessionsReached = errors.New("max number of sessions reached")
 var ErrMaxNumPlayersReached = errors.New("max number of players for this session reached")
 var ErrNotFound = errors.New("session not found")
 var ErrNotEnoughPlayers = errors.New("not enough players to start session")
+var ErrTooManyPlayers = errors.New("too many players for one session")
+var ErrInvalidDuration = errors.New("invalid session duration")
 var ErrPlayerAlreadyRolled = errors.New("player already rolled dice for this session")
+var ErrInvalidRollRange = errors.New("invalid roll range")
+var ErrInvalidTiePolicy = errors.New("invalid tie policy")
+var ErrSessionClosed = errors.New("session is closed")
+var ErrInvalidRollType = errors.New("invalid roll type")
+var ErrForbidden = errors.New("only the session creator or an admin may do this")
+var ErrPlayerNotFound = errors.New("player has not rolled in this session")
+var ErrShuttingDown = errors.New("server is shutting down")
+var ErrNoSessionID = errors.New("no free session id, the randomness keeps repeating taken ones")
+
+// MaxSessionIDAttempts caps the number of session IDs drawn before giving up
+// with ErrNoSessionID, a randomness replaying a short sequence may only ever
+// draw taken ones.
+const MaxSessionIDAttempts = 10
+
+// MaxTieBreakRounds caps the number of re-roll rounds before falling back to first come.
+const MaxTieBreakRounds = 100
+
+type TiePolicy string
+
+const (
+	// TiePolicyFirst lets the tied player who rolled first win.
+	TiePolicyFirst TiePolicy = "first"
+	// TiePolicyReroll re-rolls among the tied players until there is a single highest roll.
+	TiePolicyReroll TiePolicy = "reroll"
+	// TiePolicySplit lets all tied players share the win.
+	TiePolicySplit TiePolicy = "split"
+)
+
+func (policy TiePolicy) Valid() bool {
+	switch policy {
+	case TiePolicyFirst, TiePolicyReroll, TiePolicySplit:
+		return true
+	}
+	return false
+}
+
+// RollType is the loot category a player rolls for, any need beats every greed
+// regardless of number and a pass never wins. Plain rolls without a type rank
+// alongside need.
+type RollType string
+
+const (
+	RollTypeNeed  RollType = "need"
+	RollTypeGreed RollType = "greed"
+	RollTypePass  RollType = "pass"
+)
+
+func (rollType RollType) Valid() bool {
+	switch rollType {
+	case "", RollTypeNeed, RollTypeGreed, RollTypePass:
+		return true
+	}
+	return false
+}
+
+func (rollType RollType) rank() int {
+	switch rollType {
+	case RollTypePass:
+		return 0
+	case RollTypeGreed:
+		return 1
+	}
+	return 2
+}
+
+type Options struct {
+	Creator            string
+	MaxNumPlayers      int
+	MaxDurationSeconds int
+	MinRoll            int
+	MaxRoll            int
+	Dice               *dice.Expression
+	TiePolicy          TiePolicy
+	Webhooks           []string
+}
+
+// Actor is who asks to cancel or close a session.
+type Actor struct {
+	PlayerID string
+	Admin    bool
+}
+
+type RollOptions struct {
+	Type       RollType
+	ClientSeed string
+}
 
 type Roll struct {
-	PlayerID string `json:"player_id"`
-	Roll     int    `json:"roll"`
+	PlayerID   string   `json:"player_id"`
+	Type       RollType `json:"type,omitempty"`
+	ClientSeed string   `json:"client_seed,omitempty"`
+	Roll       int      `json:"roll"`
+	Dice       []int    `json:"dice,omitempty"`
+}
+
+// beats reports whether roll ranks above other, first by type then by number.
+func (roll Roll) beats(other Roll) bool {
+	if roll.Type.rank() != other.Type.rank() {
+		return roll.Type.rank() > other.Type.rank()
+	}
+	return roll.Roll > other.Roll
+}
+
+type TieBreak struct {
+	Round int    `json:"round"`
+	Rolls []Roll `json:"rolls"`
+}
+
+// Result of a closed session, Winner is empty when nobody rolled, everyone passed
+// or the session was Cancelled. Tied holds every player who shared the highest roll,
+// Shared is set when they all won (TiePolicySplit), otherwise Winner is decided
+// by TieBreaks or by who rolled first.
+type Result struct {
+	Winner    Roll       `json:"winner"`
+	Tied      []Roll     `json:"tied,omitempty"`
+	Shared    bool       `json:"shared,omitempty"`
+	TieBreaks []TieBreak `json:"tie_breaks,omitempty"`
+	Cancelled bool       `json:"cancelled,omitempty"`
+	Proof     *Proof     `json:"proof,omitempty"`
+}
+
+// Proof reveals the server seed of a closed session along with everything
+// else needed to recompute every roll, see Verify.
+type Proof struct {
+	ServerSeed     string           `json:"server_seed"`
+	ServerSeedHash string           `json:"server_seed_hash"`
+	MinRoll        int              `json:"min_roll,omitempty"`
+	MaxRoll        int              `json:"max_roll,omitempty"`
+	Dice           *dice.Expression `json:"dice,omitempty"`
+	TiePolicy      TiePolicy        `json:"tie_policy,omitempty"`
+	Rolls          []Roll           `json:"rolls"`
 }
 
 type Session struct {
-	ID            string               `json:"id"`
-	MaxNumPlayers int                  `json:"num_players"`
-	Highest       Roll                 `json:"-"`
-	Timer         *time.Timer          `json:"-"`
-	Done          chan struct{}        `json:"-"`
-	Rolls         chan Roll            `json:"-"`
-	Players       map[string]chan Roll `json:"-"`
+	ID             string                 `json:"id"`
+	Tenant         string                 `json:"tenant,omitempty"`
+	Creator        string                 `json:"creator,omitempty"`
+	MaxNumPlayers  int                    `json:"num_players"`
+	MinRoll        int                    `json:"min_roll,omitempty"`
+	MaxRoll        int                    `json:"max_roll,omitempty"`
+	Dice           *dice.Expression       `json:"dice,omitempty"`
+	TiePolicy      TiePolicy              `json:"tie_policy,omitempty"`
+	ServerSeedHash string                 `json:"server_seed_hash,omitempty"`
+	ServerSeed     string                 `json:"-"`
+	CreatedAt      time.Time              `json:"created_at"`
+	ExpiresAt      time.Time              `json:"expires_at"`
+	Clock          clock.Clock            `json:"-"`
+	Timer          clock.Timer            `json:"-"`
+	Done           chan struct{}          `json:"-"`
+	Rolls          chan Roll              `json:"-"`
+	Players        map[string]chan Result `json:"-"`
+	Webhooks       []string               `json:"-"`
+	OnDelivery     func(Delivery)         `json:"-"`
+	rolls          []Roll
+	result         *Result
+	closed         bool
+	closeReason    CloseReason
+	subscribers    map[chan Event]struct{}
+	deliveries     []Delivery
 	sync.Mutex
 }
 
+type State string
+
+const (
+	StateOpen      State = "open"
+	StateClosed    State = "closed"
+	StateCancelled State = "cancelled"
+)
+
+// CloseReason is why a session closed.
+type CloseReason string
+
+const (
+	// CloseReasonAllPlayers is set when the last player rolled.
+	CloseReasonAllPlayers CloseReason = "all_players"
+	// CloseReasonTimeout is set when the session ran out of time.
+	CloseReasonTimeout CloseReason = "timeout"
+	// CloseReasonClosed is set when the creator or an admin closed the session early.
+	CloseReasonClosed CloseReason = "closed"
+	// CloseReasonCancelled is set when the session was cancelled.
+	CloseReasonCancelled CloseReason = "cancelled"
+	// CloseReasonShutdown is set when the server resolved the session early to shut down.
+	CloseReasonShutdown CloseReason = "shutdown"
+)
+
+func (state State) Valid() bool {
+	switch state {
+	case StateOpen, StateClosed, StateCancelled:
+		return true
+	}
+	return false
+}
+
+// Status is a snapshot of a session. Rolls are not revealed until the session is closed.
+type Status struct {
+	*Session
+	State            State    `json:"state"`
+	Players          []string `json:"players"`
+	RemainingSeconds int      `json:"remaining_seconds"`
+	Result           *Result  `json:"result,omitempty"`
+}
+
+func (sess *Session) Status() *Status {
+	sess.Lock()
+	defer sess.Unlock()
+	status := &Status{
+		Session: sess,
+		State:   StateOpen,
+		Players: make([]string, 0, len(sess.Players)),
+		Result:  sess.result,
+	}
+	for playerID := range sess.Players {
+		status.Players = append(status.Players, playerID)
+	}
+	sort.Strings(status.Players)
+	if sess.closed && sess.result.Cancelled {
+		status.State = StateCancelled
+	} else if sess.closed {
+		status.State = StateClosed
+	} else {
+		status.RemainingSeconds = sess.remainingSeconds()
+	}
+	return status
+}
+
+// PlayerResult is what a player who rolled gets back when polling for the
+// result. Pending is set while the session is open, Your and the Result are
+// only revealed once it is closed.
+type PlayerResult struct {
+	State   State `json:"state"`
+	Pending bool  `json:"pending,omitempty"`
+	Your    *Roll `json:"your,omitempty"`
+	*Result
+}
+
+// PlayerResult returns ErrPlayerNotFound unless the player has rolled in the session.
+func (sess *Session) PlayerResult(playerID string) (*PlayerResult, error) {
+	sess.Lock()
+	defer sess.Unlock()
+	if _, ok := sess.Players[playerID]; !ok {
+		return nil, ErrPlayerNotFound
+	}
+	if !sess.closed {
+		return &PlayerResult{State: StateOpen, Pending: true}, nil
+	}
+	result := &PlayerResult{State: StateClosed, Result: sess.result}
+	if sess.result.Cancelled {
+		result.State = StateCancelled
+	}
+	for i := range sess.rolls {
+		if sess.rolls[i].PlayerID == playerID {
+			roll := sess.rolls[i]
+			result.Your = &roll
+		}
+	}
+	return result, nil
+}
+
+func (sess *Session) remainingSeconds() int {
+	remaining := sess.ExpiresAt.Sub(sess.clock().Now())
+	if remaining <= 0 {
+		return 0
+	}
+	return int(math.Ceil(remaining.Seconds()))
+}
+
+// clock returns the Clock the session runs on, the system clock unless set.
+func (sess *Session) clock() clock.Clock {
+	if sess.Clock == nil {
+		return clock.New()
+	}
+	return sess.Clock
+}
+
+func (sess *Session) Closed() bool {
+	sess.Lock()
+	defer sess.Unlock()
+	return sess.closed
+}
+
+// Open runs the session until it closes, then sends its Key on closeC.
 func (sess *Session) Open(closeC chan string) {
+	reason := CloseReasonClosed
 	defer func() {
-		sess.Close(closeC)
+		_ = sess.close(closeC, reason)
 	}()
+	ticker := sess.clock().NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-sess.Done:
 			return
-		case <-sess.Timer.C:
+		case <-sess.Timer.C():
+			reason = CloseReasonTimeout
 			return
-		case roll := <-sess.Rolls:
-			if roll.Roll > sess.Highest.Roll {
-				sess.Highest = roll
+		case <-ticker.C():
+			sess.Lock()
+			sess.publish(Event{Type: EventTimerTick, RemainingSeconds: sess.remainingSeconds()})
+			sess.Unlock()
+		case <-sess.Rolls:
+			sess.Lock()
+			full := len(sess.rolls) >= sess.MaxNumPlayers
+			sess.Unlock()
+			if full {
+				reason = CloseReasonAllPlayers
+				return
 			}
 		}
 	}
 }
 
-func (sess *Session) Close(closeC chan string) {
+// Close resolves the session with the rolls received so far and sends the
+// result to every player. It returns ErrSessionClosed if already closed.
+func (sess *Session) Close(closeC chan string) error {
+	return sess.close(closeC, CloseReasonClosed)
+}
+
+// Cancel closes the session without a winner.
+func (sess *Session) Cancel(closeC chan string) error {
+	return sess.close(closeC, CloseReasonCancelled)
+}
+
+// Shutdown resolves the session early, like Close, because the server is
+// shutting down.
+func (sess *Session) Shutdown(closeC chan string) error {
+	return sess.close(closeC, CloseReasonShutdown)
+}
+
+// CloseWithReason closes the session as Close does, or Cancel for
+// CloseReasonCancelled, recording the given reason. Keepers use it to rebuild
+// sessions closed elsewhere.
+func (sess *Session) CloseWithReason(closeC chan string, reason CloseReason) error {
+	return sess.close(closeC, reason)
+}
+
+// CloseReason returns why the session closed, empty while it is open.
+func (sess *Session) CloseReason() CloseReason {
+	sess.Lock()
+	defer sess.Unlock()
+	return sess.closeReason
+}
+
+func (sess *Session) close(closeC chan string, reason CloseReason) error {
+	sess.Lock()
+	if sess.closed {
+		sess.Unlock()
+		return ErrSessionClosed
+	}
+	sess.closed = true
+	sess.closeReason = reason
+	sess.Timer.Stop()
+	close(sess.Done)
+	result := Result{Cancelled: true}
+	if reason != CloseReasonCancelled {
+		result = sess.resolve()
+	}
+	result.Proof = &Proof{
+		ServerSeed:     sess.ServerSeed,
+		ServerSeedHash: sess.ServerSeedHash,
+		MinRoll:        sess.MinRoll,
+		MaxRoll:        sess.MaxRoll,
+		Dice:           sess.Dice,
+		TiePolicy:      sess.TiePolicy,
+		Rolls:          sess.rolls,
+	}
+	sess.result = &result
 	for _, resultC := range sess.Players {
-		resultC <- sess.Highest
+		resultC <- result
+	}
+	for i := range result.TieBreaks {
+		sess.publish(Event{Type: EventTieBreak, TieBreak: &result.TieBreaks[i]})
 	}
-	closeC <- sess.ID
+	sess.publish(Event{Type: EventSessionClosed, Result: &result, Reason: reason})
+	sess.closeSubscribers()
+	sess.Unlock()
+	closeC <- Key(sess.Tenant, sess.ID)
+	return nil
 }
 
-func (sess *Session) AddRoll(ctx context.Context, sessionID, playerID string, max int) (chan Roll, *Roll, error) {
+// Authorize returns ErrForbidden unless the actor created the session or is an admin.
+func (sess *Session) Authorize(actor Actor) error {
+	if actor.Admin || (sess.Creator != "" && actor.PlayerID == sess.Creator) {
+		return nil
+	}
+	return ErrForbidden
+}
+
+func (sess *Session) AddRoll(ctx context.Context, sessionID, playerID string, opts RollOptions) (chan Result, *Roll, error) {
+	if !opts.Type.Valid() {
+		return nil, nil, ErrInvalidRollType
+	}
 	sess.Lock()
 	defer sess.Unlock()
+	if sess.closed {
+		return nil, nil, ErrSessionClosed
+	}
 	if len(sess.Players) >= sess.MaxNumPlayers {
 		return nil, nil, ErrMaxNumPlayersReached
 	}
@@ -71,14 +456,92 @@ func (sess *Session) AddRoll(ctx context.Context, sessionID, playerID string, ma
 	if ok {
 		return nil, nil, ErrPlayerAlreadyRolled
 	}
-	sess.Players[playerID] = make(chan Roll)
-	roll := Roll{
-		PlayerID: playerID,
-		Roll:     rand.Intn(max),
-	}
+	sess.Players[playerID] = make(chan Result, 1)
+	roll := sess.Roll(playerID, opts)
+	// The roll is recorded here rather than by Open, so a session closing
+	// concurrently never resolves without it.
+	sess.rolls = append(sess.rolls, roll)
+	sess.publish(Event{Type: EventPlayerRolled, Roll: &roll})
 	sess.Rolls <- roll
-	if len(sess.Players) >= sess.MaxNumPlayers {
-		sess.Done <- struct{}{}
-	}
 	return sess.Players[playerID], &roll, nil
 }
+
+// Restore adds rolls received before the session was reloaded, e.g. after a
+// restart. It must be called before the session is opened.
+func (sess *Session) Restore(rolls []Roll) {
+	sess.Lock()
+	defer sess.Unlock()
+	for _, roll := range rolls {
+		sess.Players[roll.PlayerID] = make(chan Result, 1)
+		sess.rolls = append(sess.rolls, roll)
+	}
+}
+
+// Roll returns the player's initial roll without adding it to the session,
+// for Keepers that keep rolls elsewhere.
+func (sess *Session) Roll(playerID string, opts RollOptions) Roll {
+	return sess.roll(Roll{PlayerID: playerID, Type: opts.Type, ClientSeed: opts.ClientSeed}, 0)
+}
+
+// roll fills in the number for the player's roll in the given round, derived
+// from the server seed and the player's client seed. Round 0 is the initial
+// roll, every tie break round after that gets its own number.
+func (sess *Session) roll(roll Roll, round int) Roll {
+	if roll.Type == RollTypePass {
+		return roll
+	}
+	src := fair.NewSource(sess.ServerSeed, roll.ClientSeed, roll.PlayerID, round)
+	if sess.Dice != nil {
+		result := sess.Dice.Roll(src.Intn)
+		roll.Roll = result.Total
+		roll.Dice = result.Dice
+	} else {
+		roll.Roll = sess.MinRoll + src.Intn(sess.MaxRoll-sess.MinRoll+1)
+	}
+	return roll
+}
+
+// resolve decides the winner among the received rolls according to the tie policy.
+func (sess *Session) resolve() Result {
+	var result Result
+	tied := highest(sess.rolls)
+	if len(tied) == 0 {
+		return result
+	}
+	result.Winner = tied[0]
+	if len(tied) == 1 {
+		return result
+	}
+	result.Tied = tied
+	switch sess.TiePolicy {
+	case TiePolicySplit:
+		result.Shared = true
+	case TiePolicyReroll:
+		for round := 1; len(tied) > 1 && round <= MaxTieBreakRounds; round++ {
+			tiebreak := TieBreak{Round: round}
+			for _, roll := range tied {
+				tiebreak.Rolls = append(tiebreak.Rolls, sess.roll(Roll{PlayerID: roll.PlayerID, Type: roll.Type, ClientSeed: roll.ClientSeed}, round))
+			}
+			result.TieBreaks = append(result.TieBreaks, tiebreak)
+			tied = highest(tiebreak.Rolls)
+			result.Winner = tied[0]
+		}
+	}
+	return result
+}
+
+// highest returns all rolls sharing the highest type and number, in the order they were received.
+// Passes are never included.
+func highest(rolls []Roll) []Roll {
+	var tied []Roll
+	for _, roll := range rolls {
+		switch {
+		case roll.Type == RollTypePass:
+		case len(tied) == 0 || roll.beats(tied[0]):
+			tied = []Roll{roll}
+		case !tied[0].beats(roll):
+			tied = append(tied, roll)
+		}
+	}
+	return tied
+}
@@ -0,0 +1,201 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rgynn/dice/pkg/clock"
+	"github.com/rgynn/dice/pkg/dice"
+	"github.com/rgynn/dice/pkg/fair"
+)
+
+const testServerSeed = "9b1e7bf2c0b1f2c3d4e5f60718293a4b5c6d7e8f9012a3b4c5d6e7f8091a2b3c"
+
+// newTestSession returns an open session of numPlayers rolling within
+// minRoll..maxRoll, or expr when set.
+func newTestSession(t *testing.T, numPlayers, minRoll, maxRoll int, expr string, policy TiePolicy) *Session {
+	t.Helper()
+	sess := &Session{
+		ID:             "fakesession",
+		MaxNumPlayers:  numPlayers,
+		MinRoll:        minRoll,
+		MaxRoll:        maxRoll,
+		TiePolicy:      policy,
+		ServerSeed:     testServerSeed,
+		ServerSeedHash: fair.Hash(testServerSeed),
+		Timer:          clock.New().NewTimer(time.Minute),
+		Players:        map[string]chan Result{},
+		Rolls:          make(chan Roll, numPlayers),
+		Done:           make(chan struct{}),
+	}
+	if expr != "" {
+		var err error
+		if sess.Dice, err = dice.Parse(expr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go sess.Open(make(chan string, 1))
+	return sess
+}
+
+// rollAll rolls for every player in order and returns the result of the
+// session once it closed.
+func rollAll(t *testing.T, sess *Session, rolls []Roll) Result {
+	t.Helper()
+	var resultC chan Result
+	for _, roll := range rolls {
+		var err error
+		resultC, _, err = sess.AddRoll(context.Background(), sess.ID, roll.PlayerID, RollOptions{Type: roll.Type, ClientSeed: roll.ClientSeed})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case result := <-resultC:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to close once every player rolled")
+	}
+	return Result{}
+}
+
+// tiedSeeds returns client seeds for a and b whose initial rolls in a
+// minRoll..maxRoll session are equal.
+func tiedSeeds(t *testing.T, minRoll, maxRoll int) (string, string) {
+	t.Helper()
+	sess := &Session{MinRoll: minRoll, MaxRoll: maxRoll, ServerSeed: testServerSeed}
+	for i := 0; i < 1000; i++ {
+		a, b := fmt.Sprintf("a-%d", i), fmt.Sprintf("b-%d", i)
+		if sess.Roll("a", RollOptions{ClientSeed: a}).Roll == sess.Roll("b", RollOptions{ClientSeed: b}).Roll {
+			return a, b
+		}
+	}
+	t.Fatal("no tied client seeds found")
+	return "", ""
+}
+
+func TestSession_TiePolicies(t *testing.T) {
+	seedA, seedB := tiedSeeds(t, 1, 2)
+	type testcase struct {
+		Name               string
+		MinRoll            int
+		MaxRoll            int
+		Dice               string
+		TiePolicy          TiePolicy
+		SeedA              string
+		SeedB              string
+		ExpectedShared     bool
+		ExpectedTieBreaks  int
+		ExpectedFirstCome  bool
+		ExpectResolvedTies bool
+	}
+	testcases := []testcase{
+		{Name: "First", MinRoll: 1, MaxRoll: 1, TiePolicy: TiePolicyFirst, ExpectedFirstCome: true},
+		{Name: "Default is first", MinRoll: 1, MaxRoll: 1, ExpectedFirstCome: true},
+		{Name: "Split", MinRoll: 1, MaxRoll: 1, TiePolicy: TiePolicySplit, ExpectedShared: true, ExpectedFirstCome: true},
+		{Name: "Split dice", Dice: "1d1", TiePolicy: TiePolicySplit, ExpectedShared: true, ExpectedFirstCome: true},
+		{Name: "Reroll", MinRoll: 1, MaxRoll: 2, TiePolicy: TiePolicyReroll, SeedA: seedA, SeedB: seedB, ExpectResolvedTies: true},
+		{Name: "Reroll falls back to first come", MinRoll: 1, MaxRoll: 1, TiePolicy: TiePolicyReroll, ExpectedTieBreaks: MaxTieBreakRounds, ExpectedFirstCome: true},
+		{Name: "Reroll dice falls back to first come", Dice: "1d1", TiePolicy: TiePolicyReroll, ExpectedTieBreaks: MaxTieBreakRounds, ExpectedFirstCome: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			sess := newTestSession(t, 2, tc.MinRoll, tc.MaxRoll, tc.Dice, tc.TiePolicy)
+			result := rollAll(t, sess, []Roll{{PlayerID: "a", ClientSeed: tc.SeedA}, {PlayerID: "b", ClientSeed: tc.SeedB}})
+			if len(result.Tied) != 2 || result.Tied[0].PlayerID != "a" || result.Tied[1].PlayerID != "b" {
+				t.Fatalf("expected a and b tied, got: %+v", result.Tied)
+			}
+			if want, got := tc.ExpectedShared, result.Shared; want != got {
+				t.Errorf("expected shared: %v, got: %v", want, got)
+			}
+			if tc.ExpectResolvedTies {
+				if len(result.TieBreaks) == 0 {
+					t.Fatal("expected tie break rounds")
+				}
+				last := result.TieBreaks[len(result.TieBreaks)-1]
+				if tied := highest(last.Rolls); len(tied) != 1 || tied[0].PlayerID != result.Winner.PlayerID || tied[0].Roll != result.Winner.Roll {
+					t.Errorf("expected the last round to decide the winner, got: %+v winner: %+v", last, result.Winner)
+				}
+				for i, tiebreak := range result.TieBreaks {
+					if tiebreak.Round != i+1 {
+						t.Errorf("expected round %d, got: %d", i+1, tiebreak.Round)
+					}
+				}
+			} else if want, got := tc.ExpectedTieBreaks, len(result.TieBreaks); want != got {
+				t.Errorf("expected tie break rounds: %d, got: %d", want, got)
+			}
+			if tc.ExpectedFirstCome && result.Winner.PlayerID != "a" {
+				t.Errorf("expected the first to roll to win, got: %+v", result.Winner)
+			}
+			if err := Verify(result); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSession_RollTypes(t *testing.T) {
+	type testcase struct {
+		Name           string
+		Rolls          []Roll
+		ExpectedWinner string
+		ExpectedType   RollType
+	}
+	testcases := []testcase{
+		{
+			Name:           "Need beats greed",
+			Rolls:          []Roll{{PlayerID: "greedy", Type: RollTypeGreed}, {PlayerID: "needy", Type: RollTypeNeed}},
+			ExpectedWinner: "needy",
+			ExpectedType:   RollTypeNeed,
+		},
+		{
+			Name:           "Need beats greed rolled after it",
+			Rolls:          []Roll{{PlayerID: "needy", Type: RollTypeNeed}, {PlayerID: "greedy", Type: RollTypeGreed}},
+			ExpectedWinner: "needy",
+			ExpectedType:   RollTypeNeed,
+		},
+		{
+			Name:           "Plain roll ranks alongside need",
+			Rolls:          []Roll{{PlayerID: "greedy", Type: RollTypeGreed}, {PlayerID: "plain"}},
+			ExpectedWinner: "plain",
+		},
+		{
+			Name:           "Greed beats pass",
+			Rolls:          []Roll{{PlayerID: "passer", Type: RollTypePass}, {PlayerID: "greedy", Type: RollTypeGreed}},
+			ExpectedWinner: "greedy",
+			ExpectedType:   RollTypeGreed,
+		},
+		{
+			Name:  "Everyone passed",
+			Rolls: []Roll{{PlayerID: "a", Type: RollTypePass}, {PlayerID: "b", Type: RollTypePass}},
+		},
+		{
+			Name:           "Pass counts toward closing",
+			Rolls:          []Roll{{PlayerID: "passer", Type: RollTypePass}, {PlayerID: "needy", Type: RollTypeNeed}, {PlayerID: "other", Type: RollTypePass}},
+			ExpectedWinner: "needy",
+			ExpectedType:   RollTypeNeed,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			sess := newTestSession(t, len(tc.Rolls), 1, 1000, "", TiePolicyFirst)
+			result := rollAll(t, sess, tc.Rolls)
+			if want, got := CloseReasonAllPlayers, sess.CloseReason(); want != got {
+				t.Errorf("expected close reason: %s, got: %s", want, got)
+			}
+			if want, got := tc.ExpectedWinner, result.Winner.PlayerID; want != got {
+				t.Errorf("expected winner: %q, got: %q", want, got)
+			}
+			if want, got := tc.ExpectedType, result.Winner.Type; want != got {
+				t.Errorf("expected winning roll type: %q, got: %q", want, got)
+			}
+			for _, roll := range result.Proof.Rolls {
+				if roll.Type == RollTypePass && roll.Roll != 0 {
+					t.Errorf("expected passes not to roll, got: %+v", roll)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,623 @@
+// Package sessiontest is a conformance suite for session.Keeper implementations.
+package sessiontest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rgynn/dice/pkg/session"
+)
+
+// MaxRollNumber is the highest roll the suite asks keepers to allow.
+const MaxRollNumber = 100
+
+// Tenant is the tenant the suite asks keepers to know besides the default
+// one, with the limits in Tenants.
+const Tenant = "guild"
+
+// Tenants are the tenants the suite asks keepers to know.
+var Tenants = session.Tenants{Tenant: {MaxNumSessions: 1, MaxRollNumber: 10}}
+
+// NewKeeper returns a fresh Keeper allowing maxNumSessions open sessions and
+// rolls up to maxRollNumber in the default tenant, along with the given
+// tenants, retaining closed sessions for at least a minute. The suite runs
+// it, cleanup is left to the caller via t.Cleanup.
+type NewKeeper func(t *testing.T, maxNumSessions, maxRollNumber int, tenants session.Tenants) session.Keeper
+
+// resultTimeout bounds every wait so a broken keeper fails rather than hangs.
+const resultTimeout = 30 * time.Second
+
+// TestKeeper runs the conformance suite against keepers from newKeeper, each
+// test in parallel with a keeper of its own. Run it with -race.
+func TestKeeper(t *testing.T, newKeeper NewKeeper) {
+	tests := []struct {
+		Name string
+		Test func(t *testing.T, keeper session.Keeper)
+	}{
+		{"Options", testOptions},
+		{"MaxNumSessions", testMaxNumSessions},
+		{"ConcurrentNewSessions", testConcurrentNewSessions},
+		{"DuplicatePlayer", testDuplicatePlayer},
+		{"MaxNumPlayers", testMaxNumPlayers},
+		{"ConcurrentRolls", testConcurrentRolls},
+		{"Timeout", testTimeout},
+		{"TimeoutWithoutRolls", testTimeoutWithoutRolls},
+		{"Close", testClose},
+		{"Cancel", testCancel},
+		{"NotFound", testNotFound},
+		{"Events", testEvents},
+		{"Shutdown", testShutdown},
+		{"Tenants", testTenants},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			keeper := newKeeper(t, 3, MaxRollNumber, Tenants)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go keeper.Run(ctx)
+			tc.Test(t, keeper)
+		})
+	}
+}
+
+func testOptions(t *testing.T, keeper session.Keeper) {
+	ctx := context.Background()
+	type testcase struct {
+		Name     string
+		Options  session.Options
+		Expected error
+	}
+	tests := []testcase{
+		{Name: "one player", Options: session.Options{MaxNumPlayers: 1}, Expected: session.ErrNotEnoughPlayers},
+		{Name: "too many players", Options: session.Options{MaxNumPlayers: session.MaxNumPlayers + 1}, Expected: session.ErrTooManyPlayers},
+		{Name: "negative duration", Options: session.Options{MaxNumPlayers: 2, MaxDurationSeconds: -1}, Expected: session.ErrInvalidDuration},
+		{Name: "max roll above limit", Options: session.Options{MaxNumPlayers: 2, MaxRoll: MaxRollNumber + 1}, Expected: session.ErrInvalidRollRange},
+		{Name: "min roll above max roll", Options: session.Options{MaxNumPlayers: 2, MinRoll: 10, MaxRoll: 5}, Expected: session.ErrInvalidRollRange},
+		{Name: "unknown tie policy", Options: session.Options{MaxNumPlayers: 2, TiePolicy: "coin"}, Expected: session.ErrInvalidTiePolicy},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			if _, err := keeper.NewSession(ctx, session.DefaultTenant, tc.Options); !errors.Is(err, tc.Expected) {
+				t.Errorf("expected error: %v, got: %v", tc.Expected, err)
+			}
+		})
+	}
+
+	sess := newSession(t, keeper, session.Options{MaxNumPlayers: 2, MinRoll: 5, MaxRoll: 6})
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{Type: "steal"}); !errors.Is(err, session.ErrInvalidRollType) {
+		t.Errorf("expected error: %v, got: %v", session.ErrInvalidRollType, err)
+	}
+	status, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != session.StateOpen || status.MinRoll != 5 || status.MaxRoll != 6 || status.TiePolicy != session.TiePolicyFirst {
+		t.Errorf("expected open session with roll range 5-6 and tie policy first, got: %+v", status)
+	}
+	result := rollAll(t, keeper, sess.ID, "a", "b")
+	for _, roll := range result.Proof.Rolls {
+		if roll.Roll < 5 || roll.Roll > 6 {
+			t.Errorf("expected roll within 5-6, got: %+v", roll)
+		}
+	}
+}
+
+func testMaxNumSessions(t *testing.T, keeper session.Keeper) {
+	ctx := context.Background()
+	var sessions []*session.Session
+	for i := 0; i < 3; i++ {
+		sessions = append(sessions, newSession(t, keeper, session.Options{Creator: "x", MaxNumPlayers: 2}))
+	}
+	if _, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2}); !errors.Is(err, session.ErrMaxNumSessionsReached) {
+		t.Errorf("expected error: %v, got: %v", session.ErrMaxNumSessionsReached, err)
+	}
+	if n, err := keeper.CountOpenSessions(ctx, session.DefaultTenant); err != nil || n != 3 {
+		t.Errorf("expected 3 open sessions, got: %d, %v", n, err)
+	}
+	if _, err := keeper.CancelSession(ctx, session.DefaultTenant, sessions[0].ID, session.Actor{PlayerID: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "2 open sessions once one closed", func() bool {
+		n, err := keeper.CountOpenSessions(ctx, session.DefaultTenant)
+		return err == nil && n == 2
+	})
+	// Closed sessions stop counting once the keeper has seen them close.
+	eventually(t, "a new session once another closed", func() bool {
+		sess, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2})
+		return err == nil && sess != nil
+	})
+}
+
+func testConcurrentNewSessions(t *testing.T, keeper session.Keeper) {
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created, rejected := 0, 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2, MaxDurationSeconds: 60})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				created++
+			case errors.Is(err, session.ErrMaxNumSessionsReached):
+				rejected++
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 3 || rejected != 97 {
+		t.Errorf("expected 3 sessions created and 97 rejected, got: %d and %d", created, rejected)
+	}
+}
+
+func testDuplicatePlayer(t *testing.T, keeper session.Keeper) {
+	ctx := context.Background()
+	sess := newSession(t, keeper, session.Options{MaxNumPlayers: 3})
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{}); !errors.Is(err, session.ErrPlayerAlreadyRolled) {
+		t.Errorf("expected error: %v, got: %v", session.ErrPlayerAlreadyRolled, err)
+	}
+	status, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(status.Players, []string{"a"}) {
+		t.Errorf("expected players: %v, got: %v", []string{"a"}, status.Players)
+	}
+}
+
+func testMaxNumPlayers(t *testing.T, keeper session.Keeper) {
+	ctx := context.Background()
+	sess := newSession(t, keeper, session.Options{MaxNumPlayers: 2})
+	result := rollAll(t, keeper, sess.ID, "a", "b")
+	if len(result.Proof.Rolls) != 2 {
+		t.Errorf("expected 2 rolls, got: %+v", result.Proof.Rolls)
+	}
+	// The session closes once full, a late player may see either error.
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "c", session.RollOptions{}); !errors.Is(err, session.ErrMaxNumPlayersReached) && !errors.Is(err, session.ErrSessionClosed) {
+		t.Errorf("expected error: %v or %v, got: %v", session.ErrMaxNumPlayersReached, session.ErrSessionClosed, err)
+	}
+}
+
+func testConcurrentRolls(t *testing.T, keeper session.Keeper) {
+	ctx := context.Background()
+	const numPlayers, numRolls = 200, 300
+	sess := newSession(t, keeper, session.Options{MaxNumPlayers: numPlayers, MaxDurationSeconds: 60})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var accepted []string
+	results := map[string]session.Result{}
+	for i := 0; i < numRolls; i++ {
+		playerID := fmt.Sprintf("player-%03d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resultC, roll, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, playerID, session.RollOptions{ClientSeed: playerID})
+			if errors.Is(err, session.ErrMaxNumPlayersReached) || errors.Is(err, session.ErrSessionClosed) {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if roll.PlayerID != playerID {
+				t.Errorf("expected roll for %s, got: %+v", playerID, roll)
+			}
+			mu.Lock()
+			accepted = append(accepted, playerID)
+			mu.Unlock()
+			result := waitResult(t, resultC)
+			mu.Lock()
+			results[playerID] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(accepted) != numPlayers || len(results) != numPlayers {
+		t.Fatalf("expected %d rolls accepted and results delivered, got: %d and %d", numPlayers, len(accepted), len(results))
+	}
+	expected := results[accepted[0]]
+	for playerID, result := range results {
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("expected every waiter to get the same result, %s got: %+v", playerID, result)
+		}
+	}
+	var rolled []string
+	for _, roll := range expected.Proof.Rolls {
+		rolled = append(rolled, roll.PlayerID)
+	}
+	sort.Strings(accepted)
+	sort.Strings(rolled)
+	if !reflect.DeepEqual(accepted, rolled) {
+		t.Errorf("expected proof to hold every accepted roll, got: %v", rolled)
+	}
+	if err := session.Verify(expected); err != nil {
+		t.Error(err)
+	}
+	status, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != session.StateClosed || !reflect.DeepEqual(status.Result, &expected) {
+		t.Errorf("expected closed session with result: %+v, got: %+v", expected, status)
+	}
+}
+
+func testTimeout(t *testing.T, keeper session.Keeper) {
+	ctx := context.Background()
+	sess := newSession(t, keeper, session.Options{MaxNumPlayers: 3, MaxDurationSeconds: 1})
+	resultC, roll, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := waitResult(t, resultC)
+	if time.Now().Before(sess.ExpiresAt) {
+		t.Errorf("expected result after the session expired at %s", sess.ExpiresAt)
+	}
+	if !reflect.DeepEqual(result.Winner, *roll) || result.Cancelled {
+		t.Errorf("expected the only player to win: %+v, got: %+v", *roll, result)
+	}
+	playerResult, err := keeper.GetSessionResult(ctx, session.DefaultTenant, sess.ID, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if playerResult.State != session.StateClosed || !reflect.DeepEqual(playerResult.Your, roll) || !reflect.DeepEqual(playerResult.Result, &result) {
+		t.Errorf("expected closed player result with roll: %+v, got: %+v", roll, playerResult)
+	}
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "b", session.RollOptions{}); !errors.Is(err, session.ErrSessionClosed) {
+		t.Errorf("expected error: %v, got: %v", session.ErrSessionClosed, err)
+	}
+}
+
+func testTimeoutWithoutRolls(t *testing.T, keeper session.Keeper) {
+	ctx := context.Background()
+	sess := newSession(t, keeper, session.Options{MaxNumPlayers: 2, MaxDurationSeconds: 1})
+	eventually(t, "the session to close on its own", func() bool {
+		status, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != session.StateClosed {
+			return false
+		}
+		if status.Result.Winner.PlayerID != "" || len(status.Result.Proof.Rolls) != 0 {
+			t.Errorf("expected no winner, got: %+v", status.Result)
+		}
+		return true
+	})
+}
+
+func testClose(t *testing.T, keeper session.Keeper) {
+	ctx := context.Background()
+	sess := newSession(t, keeper, session.Options{Creator: "x", MaxNumPlayers: 3, MaxDurationSeconds: 60})
+	resultA, rollA, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultB, rollB, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "b", session.RollOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	playerResult, err := keeper.GetSessionResult(ctx, session.DefaultTenant, sess.ID, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !playerResult.Pending || playerResult.Result != nil {
+		t.Errorf("expected pending result while open, got: %+v", playerResult)
+	}
+	if _, err := keeper.GetSessionResult(ctx, session.DefaultTenant, sess.ID, "c"); !errors.Is(err, session.ErrPlayerNotFound) {
+		t.Errorf("expected error: %v, got: %v", session.ErrPlayerNotFound, err)
+	}
+	if _, err := keeper.CloseSession(ctx, session.DefaultTenant, sess.ID, session.Actor{PlayerID: "a"}); !errors.Is(err, session.ErrForbidden) {
+		t.Errorf("expected error: %v, got: %v", session.ErrForbidden, err)
+	}
+	status, err := keeper.CloseSession(ctx, session.DefaultTenant, sess.ID, session.Actor{PlayerID: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != session.StateClosed {
+		t.Errorf("expected closed session, got: %+v", status)
+	}
+
+	result := waitResult(t, resultA)
+	if other := waitResult(t, resultB); !reflect.DeepEqual(result, other) {
+		t.Errorf("expected equal results for every player, got: %+v and %+v", result, other)
+	}
+	if result.Cancelled || !reflect.DeepEqual(result.Proof.Rolls, []session.Roll{*rollA, *rollB}) {
+		t.Errorf("expected result with rolls: %+v, got: %+v", []session.Roll{*rollA, *rollB}, result)
+	}
+	if err := session.Verify(result); err != nil {
+		t.Error(err)
+	}
+	if _, err := keeper.CloseSession(ctx, session.DefaultTenant, sess.ID, session.Actor{Admin: true}); !errors.Is(err, session.ErrSessionClosed) {
+		t.Errorf("expected error: %v, got: %v", session.ErrSessionClosed, err)
+	}
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "c", session.RollOptions{}); !errors.Is(err, session.ErrSessionClosed) {
+		t.Errorf("expected error: %v, got: %v", session.ErrSessionClosed, err)
+	}
+	playerResult, err = keeper.GetSessionResult(ctx, session.DefaultTenant, sess.ID, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if playerResult.Pending || !reflect.DeepEqual(playerResult.Your, rollB) || !reflect.DeepEqual(playerResult.Result, &result) {
+		t.Errorf("expected player result with roll: %+v, got: %+v", rollB, playerResult)
+	}
+}
+
+func testCancel(t *testing.T, keeper session.Keeper) {
+	ctx := context.Background()
+	sess := newSession(t, keeper, session.Options{Creator: "x", MaxNumPlayers: 3, MaxDurationSeconds: 60})
+	resultA, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keeper.CancelSession(ctx, session.DefaultTenant, sess.ID, session.Actor{PlayerID: "y"}); !errors.Is(err, session.ErrForbidden) {
+		t.Errorf("expected error: %v, got: %v", session.ErrForbidden, err)
+	}
+	status, err := keeper.CancelSession(ctx, session.DefaultTenant, sess.ID, session.Actor{Admin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != session.StateCancelled {
+		t.Errorf("expected cancelled session, got: %+v", status)
+	}
+	if result := waitResult(t, resultA); !result.Cancelled || result.Winner.PlayerID != "" {
+		t.Errorf("expected cancelled result without winner, got: %+v", result)
+	}
+	if _, err := keeper.CancelSession(ctx, session.DefaultTenant, sess.ID, session.Actor{PlayerID: "x"}); !errors.Is(err, session.ErrSessionClosed) {
+		t.Errorf("expected error: %v, got: %v", session.ErrSessionClosed, err)
+	}
+}
+
+func testNotFound(t *testing.T, keeper session.Keeper) {
+	ctx := context.Background()
+	admin := session.Actor{Admin: true}
+	calls := map[string]func() error{
+		"GetSession": func() error {
+			_, err := keeper.GetSession(ctx, session.DefaultTenant, "missing")
+			return err
+		},
+		"CancelSession": func() error {
+			_, err := keeper.CancelSession(ctx, session.DefaultTenant, "missing", admin)
+			return err
+		},
+		"CloseSession": func() error {
+			_, err := keeper.CloseSession(ctx, session.DefaultTenant, "missing", admin)
+			return err
+		},
+		"SubscribeSession": func() error {
+			_, err := keeper.SubscribeSession(ctx, session.DefaultTenant, "missing")
+			return err
+		},
+		"AddSessionRoll": func() error {
+			_, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, "missing", "a", session.RollOptions{})
+			return err
+		},
+		"GetSessionResult": func() error {
+			_, err := keeper.GetSessionResult(ctx, session.DefaultTenant, "missing", "a")
+			return err
+		},
+		"GetSessionDeliveries": func() error {
+			_, err := keeper.GetSessionDeliveries(ctx, session.DefaultTenant, "missing", admin)
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); !errors.Is(err, session.ErrNotFound) {
+			t.Errorf("%s: expected error: %v, got: %v", name, session.ErrNotFound, err)
+		}
+	}
+}
+
+func testEvents(t *testing.T, keeper session.Keeper) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sess := newSession(t, keeper, session.Options{MaxNumPlayers: 2, MaxDurationSeconds: 60})
+	eventC, err := keeper.SubscribeSession(ctx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := rollAll(t, keeper, sess.ID, "a", "b")
+
+	var events []session.Event
+	timeout := time.After(resultTimeout)
+	for done := false; !done; {
+		select {
+		case event, ok := <-eventC:
+			if !ok {
+				done = true
+			} else if event.Type != session.EventTimerTick {
+				events = append(events, event)
+			}
+		case <-timeout:
+			t.Fatal("expected events channel to be closed with the session")
+		}
+	}
+	var types []session.EventType
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	if expected := []session.EventType{session.EventPlayerRolled, session.EventPlayerRolled, session.EventSessionClosed}; !reflect.DeepEqual(expected, types) {
+		t.Fatalf("expected events: %v, got: %v", expected, types)
+	}
+	if !reflect.DeepEqual(events[2].Result, &result) || events[2].Reason != session.CloseReasonAllPlayers {
+		t.Errorf("expected closing event for all players with result: %+v, got: %+v", result, events[2])
+	}
+}
+
+// testShutdown checks that no session is created once shutting down and that
+// open sessions are either resolved with their rolls or carry on elsewhere.
+func testShutdown(t *testing.T, keeper session.Keeper) {
+	ctx := context.Background()
+	sess := newSession(t, keeper, session.Options{MaxNumPlayers: 3, MaxDurationSeconds: 60})
+	resultC, roll, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keeper.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2}); !errors.Is(err, session.ErrShuttingDown) {
+		t.Errorf("expected error: %v, got: %v", session.ErrShuttingDown, err)
+	}
+	status, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch status.State {
+	case session.StateClosed:
+		result := waitResult(t, resultC)
+		if result.Winner.PlayerID != "a" || !reflect.DeepEqual(result.Proof.Rolls, []session.Roll{*roll}) {
+			t.Errorf("expected session resolved with its rolls, got: %+v", result)
+		}
+	case session.StateOpen:
+		// Handed off, the session still takes rolls.
+		if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "b", session.RollOptions{}); err != nil {
+			t.Errorf("expected handed off session to take rolls, got: %v", err)
+		}
+	default:
+		t.Errorf("expected session resolved or handed off, got: %+v", status)
+	}
+}
+
+// testTenants checks that a tenant's sessions are held to its own limits and
+// can't be found through another tenant, and that unknown tenants are rejected.
+func testTenants(t *testing.T, keeper session.Keeper) {
+	ctx := context.Background()
+	if _, err := keeper.NewSession(ctx, "unknown", session.Options{MaxNumPlayers: 2}); !errors.Is(err, session.ErrTenantNotFound) {
+		t.Errorf("expected error: %v, got: %v", session.ErrTenantNotFound, err)
+	}
+	if _, err := keeper.ListSessions(ctx, "unknown", session.ListOptions{}); !errors.Is(err, session.ErrTenantNotFound) {
+		t.Errorf("expected error: %v, got: %v", session.ErrTenantNotFound, err)
+	}
+	if _, err := keeper.NewSession(ctx, Tenant, session.Options{MaxNumPlayers: 2, MaxRoll: 11}); !errors.Is(err, session.ErrInvalidRollRange) {
+		t.Errorf("expected error: %v, got: %v", session.ErrInvalidRollRange, err)
+	}
+	sess, err := keeper.NewSession(ctx, Tenant, session.Options{Creator: "x", MaxNumPlayers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.Tenant != Tenant || sess.MaxRoll != 10 {
+		t.Errorf("expected session of tenant %s rolling up to 10, got: %+v", Tenant, sess)
+	}
+	if _, err := keeper.NewSession(ctx, Tenant, session.Options{MaxNumPlayers: 2}); !errors.Is(err, session.ErrMaxNumSessionsReached) {
+		t.Errorf("expected error: %v, got: %v", session.ErrMaxNumSessionsReached, err)
+	}
+	other := newSession(t, keeper, session.Options{MaxNumPlayers: 2})
+
+	if _, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID); !errors.Is(err, session.ErrNotFound) {
+		t.Errorf("expected error: %v, got: %v", session.ErrNotFound, err)
+	}
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{}); !errors.Is(err, session.ErrNotFound) {
+		t.Errorf("expected error: %v, got: %v", session.ErrNotFound, err)
+	}
+	if _, err := keeper.CancelSession(ctx, Tenant, other.ID, session.Actor{Admin: true}); !errors.Is(err, session.ErrNotFound) {
+		t.Errorf("expected error: %v, got: %v", session.ErrNotFound, err)
+	}
+	if _, err := keeper.GetSession(ctx, "unknown", sess.ID); !errors.Is(err, session.ErrTenantNotFound) {
+		t.Errorf("expected error: %v, got: %v", session.ErrTenantNotFound, err)
+	}
+	for tenant, expected := range map[string]string{Tenant: sess.ID, session.DefaultTenant: other.ID} {
+		list, err := keeper.ListSessions(ctx, tenant, session.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Sessions) != 1 || list.Sessions[0].ID != expected {
+			t.Errorf("expected tenant %q to list only session %s, got: %+v", tenant, expected, list.Sessions)
+		}
+	}
+
+	var resultCs []chan session.Result
+	for _, playerID := range []string{"a", "b"} {
+		resultC, roll, err := keeper.AddSessionRoll(ctx, Tenant, sess.ID, playerID, session.RollOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if roll.Roll < 1 || roll.Roll > 10 {
+			t.Errorf("expected roll within 1-10, got: %+v", roll)
+		}
+		resultCs = append(resultCs, resultC)
+	}
+	waitResult(t, resultCs[0])
+	status, err := keeper.GetSession(ctx, Tenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != session.StateClosed || status.Tenant != Tenant {
+		t.Errorf("expected closed session of tenant %s, got: %+v", Tenant, status)
+	}
+	// The closed session stops counting against the tenant's cap.
+	eventually(t, "a new session of the tenant once the other closed", func() bool {
+		_, err := keeper.NewSession(ctx, Tenant, session.Options{MaxNumPlayers: 2})
+		return err == nil
+	})
+}
+
+func newSession(t *testing.T, keeper session.Keeper, opts session.Options) *session.Session {
+	t.Helper()
+	sess, err := keeper.NewSession(context.Background(), session.DefaultTenant, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+// rollAll rolls for every player and returns the result they all received.
+func rollAll(t *testing.T, keeper session.Keeper, sessionID string, playerIDs ...string) session.Result {
+	t.Helper()
+	var resultCs []chan session.Result
+	for _, playerID := range playerIDs {
+		resultC, _, err := keeper.AddSessionRoll(context.Background(), session.DefaultTenant, sessionID, playerID, session.RollOptions{ClientSeed: playerID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resultCs = append(resultCs, resultC)
+	}
+	result := waitResult(t, resultCs[0])
+	for _, resultC := range resultCs[1:] {
+		if other := waitResult(t, resultC); !reflect.DeepEqual(result, other) {
+			t.Errorf("expected equal results for every player, got: %+v and %+v", result, other)
+		}
+	}
+	return result
+}
+
+func waitResult(t *testing.T, resultC chan session.Result) session.Result {
+	t.Helper()
+	select {
+	case result := <-resultC:
+		return result
+	case <-time.After(resultTimeout):
+		t.Error("expected a result")
+		return session.Result{}
+	}
+}
+
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(resultTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
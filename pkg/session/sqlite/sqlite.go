@@ -0,0 +1,489 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rgynn/dice/pkg/dice"
+	"github.com/rgynn/dice/pkg/session"
+	"github.com/rgynn/dice/pkg/session/local"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id               TEXT PRIMARY KEY,
+	tenant           TEXT NOT NULL DEFAULT '',
+	creator          TEXT NOT NULL,
+	num_players      INTEGER NOT NULL,
+	min_roll         INTEGER NOT NULL,
+	max_roll         INTEGER NOT NULL,
+	dice             TEXT NOT NULL,
+	tie_policy       TEXT NOT NULL,
+	server_seed      TEXT NOT NULL,
+	server_seed_hash TEXT NOT NULL,
+	webhooks         TEXT NOT NULL,
+	created_at       INTEGER NOT NULL,
+	expires_at       INTEGER NOT NULL,
+	state            TEXT NOT NULL,
+	result           TEXT
+);
+CREATE INDEX IF NOT EXISTS sessions_state ON sessions (state);
+CREATE TABLE IF NOT EXISTS rolls (
+	session_id TEXT NOT NULL REFERENCES sessions (id),
+	player_id  TEXT NOT NULL,
+	roll       TEXT NOT NULL,
+	PRIMARY KEY (session_id, player_id)
+);
+`
+
+// indexes are created once migrations added the columns they cover.
+const indexes = `
+CREATE INDEX IF NOT EXISTS sessions_tenant_created ON sessions (tenant, created_at, id);
+`
+
+// migrations bring databases created by earlier versions up to schema.
+var migrations = []struct {
+	Column string
+	SQL    string
+}{
+	{Column: "tenant", SQL: `ALTER TABLE sessions ADD COLUMN tenant TEXT NOT NULL DEFAULT ''`},
+}
+
+// Keeper persists sessions, rolls and results to SQLite. Open sessions are run
+// in memory by the embedded local Keeper and reloaded with their remaining
+// time by NewKeeper after a restart, closed sessions are read back from the
+// database once they are no longer retained in memory. Shutdown leaves open
+// sessions for the next NewKeeper to carry on. Rows are keyed by session.Key,
+// so the IDs of different tenants never collide and rows of the default
+// tenant are keyed by their session ID as before tenants existed.
+type Keeper struct {
+	*local.Keeper
+	DB        *sql.DB
+	mu        sync.Mutex
+	rollLocks map[string]*rollLock
+}
+
+// rollLock serialises the rolls of a single session, it is dropped once no
+// roll holds or waits for it.
+type rollLock struct {
+	sync.Mutex
+	refs int
+}
+
+func NewKeeper(path string, maxNumSessions, maxRandom int, retention time.Duration, rnd session.Randomness, notifier session.Notifier) (*Keeper, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer at a time.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(indexes); err != nil {
+		db.Close()
+		return nil, err
+	}
+	keeper, err := local.NewKeeper(maxNumSessions, maxRandom, retention, rnd, notifier)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	keeper.HandOff = true
+	svc := &Keeper{Keeper: keeper, DB: db, rollLocks: map[string]*rollLock{}}
+	keeper.OnClose = func(sess *session.Session) {
+		_ = svc.saveSession(sess)
+	}
+	if err := svc.reload(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return svc, nil
+}
+
+// migrate adds the columns of schema missing from an existing database.
+func migrate(db *sql.DB) error {
+	for _, migration := range migrations {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('sessions') WHERE name = ?`, migration.Column).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := db.Exec(migration.SQL); err != nil {
+			return fmt.Errorf("failed to add column %s: %w", migration.Column, err)
+		}
+	}
+	return nil
+}
+
+func (svc *Keeper) NewSession(ctx context.Context, tenant string, opts session.Options) (*session.Session, error) {
+	sess, err := svc.Keeper.NewSession(ctx, tenant, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := svc.saveSession(sess); err != nil {
+		_ = sess.Cancel(svc.CloseC)
+		return nil, err
+	}
+	return sess, nil
+}
+
+func (svc *Keeper) GetSession(ctx context.Context, tenant, sessionID string) (*session.Status, error) {
+	status, err := svc.Keeper.GetSession(ctx, tenant, sessionID)
+	if errors.Is(err, session.ErrNotFound) {
+		return svc.loadStatus(ctx, tenant, sessionID)
+	}
+	return status, err
+}
+
+// ListSessions merges the sessions held in memory with a page of closed
+// sessions filtered, ordered and limited by the database. The page holds
+// enough rows to fill the list even when the in-memory sessions are skipped.
+func (svc *Keeper) ListSessions(ctx context.Context, tenant string, opts session.ListOptions) (*session.List, error) {
+	if _, err := svc.Limits(tenant); err != nil {
+		return nil, err
+	}
+	statuses := svc.Statuses(tenant)
+	if opts.State == session.StateOpen {
+		return session.NewList(statuses, opts)
+	}
+	inMemory := map[string]bool{}
+	for _, status := range statuses {
+		inMemory[status.ID] = true
+	}
+	closed, err := svc.listClosed(ctx, tenant, opts, opts.PageSize()+1+len(statuses))
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range closed {
+		if !inMemory[status.ID] {
+			statuses = append(statuses, status)
+		}
+	}
+	return session.NewList(statuses, opts)
+}
+
+func (svc *Keeper) CountOpenSessions(ctx context.Context, tenant string) (int, error) {
+	if _, err := svc.Limits(tenant); err != nil {
+		return 0, err
+	}
+	var n int
+	err := svc.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM sessions WHERE tenant = ? AND state = ?`, tenant, session.StateOpen).Scan(&n)
+	return n, err
+}
+
+// listClosed reads up to limit closed sessions matching opts along with the
+// players who rolled in them.
+func (svc *Keeper) listClosed(ctx context.Context, tenant string, opts session.ListOptions, limit int) ([]*session.Status, error) {
+	where := []string{"tenant = ?", "state != ?"}
+	args := []interface{}{tenant, session.StateOpen}
+	if opts.State != "" {
+		where = append(where, "state = ?")
+		args = append(args, opts.State)
+	}
+	if opts.Creator != "" {
+		where = append(where, "creator = ?")
+		args = append(args, opts.Creator)
+	}
+	if !opts.CreatedAfter.IsZero() {
+		where = append(where, "created_at > ?")
+		args = append(args, opts.CreatedAfter.UnixNano())
+	}
+	if !opts.CreatedBefore.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, opts.CreatedBefore.UnixNano())
+	}
+	if opts.Cursor != "" {
+		createdAt, sessionID, err := session.DecodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		where = append(where, "(created_at > ? OR (created_at = ? AND id > ?))")
+		args = append(args, createdAt.UnixNano(), createdAt.UnixNano(), session.Key(tenant, sessionID))
+	}
+	args = append(args, limit)
+	rows, err := svc.DB.QueryContext(ctx, `SELECT `+sessionColumns+`, r.player_id
+		FROM (SELECT * FROM sessions WHERE `+strings.Join(where, " AND ")+` ORDER BY created_at, id LIMIT ?) s
+		LEFT JOIN rolls r ON r.session_id = s.id
+		ORDER BY s.created_at, s.id, r.player_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var statuses []*session.Status
+	var last *session.Status
+	for rows.Next() {
+		var playerID sql.NullString
+		sess, state, result, err := scanSession(rows, &playerID)
+		if err != nil {
+			return nil, err
+		}
+		sess.ID = strings.TrimPrefix(sess.ID, session.Key(tenant, ""))
+		sess.Tenant = tenant
+		if last == nil || last.ID != sess.ID {
+			last = &session.Status{Session: sess, State: state, Players: []string{}, Result: result}
+			statuses = append(statuses, last)
+		}
+		if playerID.Valid {
+			last.Players = append(last.Players, playerID.String)
+		}
+	}
+	return statuses, rows.Err()
+}
+
+// AddSessionRoll stores the roll before adding it to the session, so a roll
+// is never counted without being persisted. Rolls of a session are added one
+// at a time and a stored roll the session then refuses is deleted again.
+func (svc *Keeper) AddSessionRoll(ctx context.Context, tenant, sessionID, playerID string, opts session.RollOptions) (chan session.Result, *session.Roll, error) {
+	sess, err := svc.Session(tenant, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(sess.Roll(playerID, opts))
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock := svc.lockRolls(session.Key(tenant, sessionID))
+	defer unlock()
+	res, err := svc.DB.ExecContext(ctx, `INSERT OR IGNORE INTO rolls (session_id, player_id, roll) VALUES (?, ?, ?)`, session.Key(tenant, sessionID), playerID, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return nil, nil, err
+	}
+	resultC, roll, err := sess.AddRoll(ctx, sessionID, playerID, opts)
+	if err != nil {
+		if inserted > 0 {
+			_, _ = svc.DB.ExecContext(context.Background(), `DELETE FROM rolls WHERE session_id = ? AND player_id = ?`, session.Key(tenant, sessionID), playerID)
+		}
+		return nil, nil, err
+	}
+	return resultC, roll, nil
+}
+
+// lockRolls locks the rolls of the session with the given key and returns the
+// func unlocking them.
+func (svc *Keeper) lockRolls(key string) func() {
+	svc.mu.Lock()
+	lock, ok := svc.rollLocks[key]
+	if !ok {
+		lock = &rollLock{}
+		svc.rollLocks[key] = lock
+	}
+	lock.refs++
+	svc.mu.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		svc.mu.Lock()
+		defer svc.mu.Unlock()
+		if lock.refs--; lock.refs == 0 {
+			delete(svc.rollLocks, key)
+		}
+	}
+}
+
+func (svc *Keeper) GetSessionResult(ctx context.Context, tenant, sessionID, playerID string) (*session.PlayerResult, error) {
+	result, err := svc.Keeper.GetSessionResult(ctx, tenant, sessionID, playerID)
+	if !errors.Is(err, session.ErrNotFound) {
+		return result, err
+	}
+	status, err := svc.loadStatus(ctx, tenant, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	result = &session.PlayerResult{State: status.State, Result: status.Result}
+	if status.Result != nil && status.Result.Proof != nil {
+		for i := range status.Result.Proof.Rolls {
+			if status.Result.Proof.Rolls[i].PlayerID == playerID {
+				result.Your = &status.Result.Proof.Rolls[i]
+			}
+		}
+	}
+	if result.Your == nil {
+		return nil, session.ErrPlayerNotFound
+	}
+	return result, nil
+}
+
+// Close closes the database, sessions still open are reloaded by the next NewKeeper.
+func (svc *Keeper) Close() error {
+	return svc.DB.Close()
+}
+
+// saveSession writes the current state of the session, creating it if need be.
+func (svc *Keeper) saveSession(sess *session.Session) error {
+	status := sess.Status()
+	var expr string
+	if sess.Dice != nil {
+		expr = sess.Dice.String()
+	}
+	webhooks, err := json.Marshal(sess.Webhooks)
+	if err != nil {
+		return err
+	}
+	var result []byte
+	if status.Result != nil {
+		if result, err = json.Marshal(status.Result); err != nil {
+			return err
+		}
+	}
+	_, err = svc.DB.Exec(`INSERT INTO sessions (id, tenant, creator, num_players, min_roll, max_roll, dice, tie_policy, server_seed, server_seed_hash, webhooks, created_at, expires_at, state, result)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET state = excluded.state, result = excluded.result`,
+		session.Key(sess.Tenant, sess.ID), sess.Tenant, sess.Creator, sess.MaxNumPlayers, sess.MinRoll, sess.MaxRoll, expr, sess.TiePolicy, sess.ServerSeed, sess.ServerSeedHash, webhooks,
+		sess.CreatedAt.UnixNano(), sess.ExpiresAt.UnixNano(), status.State, result)
+	return err
+}
+
+// reload opens every session left open by a previous run with the time it had
+// left, sessions that expired in the meantime close right away.
+func (svc *Keeper) reload() error {
+	rows, err := svc.DB.Query(`SELECT tenant, id FROM sessions WHERE state = ?`, session.StateOpen)
+	if err != nil {
+		return err
+	}
+	type tenantSession struct {
+		Tenant    string
+		SessionID string
+	}
+	var open []tenantSession
+	for rows.Next() {
+		var tenant, key string
+		if err := rows.Scan(&tenant, &key); err != nil {
+			rows.Close()
+			return err
+		}
+		open = append(open, tenantSession{Tenant: tenant, SessionID: strings.TrimPrefix(key, session.Key(tenant, ""))})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, ts := range open {
+		sess, _, _, err := svc.loadSession(context.Background(), ts.Tenant, ts.SessionID)
+		if err != nil {
+			return err
+		}
+		rolls, err := svc.loadRolls(context.Background(), ts.Tenant, ts.SessionID)
+		if err != nil {
+			return err
+		}
+		sess.Clock = svc.Clock
+		sess.Timer = svc.Clock.NewTimer(sess.ExpiresAt.Sub(svc.Clock.Now()))
+		sess.Players = map[string]chan session.Result{}
+		sess.Rolls = make(chan session.Roll, sess.MaxNumPlayers)
+		sess.Done = make(chan struct{})
+		sess.Restore(rolls)
+		svc.Lock()
+		svc.Sessions[session.Key(sess.Tenant, sess.ID)] = sess
+		svc.Unlock()
+		go sess.Open(svc.CloseC)
+	}
+	return nil
+}
+
+// loadStatus reads a closed session no longer retained in memory.
+func (svc *Keeper) loadStatus(ctx context.Context, tenant, sessionID string) (*session.Status, error) {
+	sess, state, result, err := svc.loadSession(ctx, tenant, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if state == session.StateOpen {
+		return nil, session.ErrNotFound
+	}
+	status := &session.Status{Session: sess, State: state, Players: []string{}, Result: result}
+	if result != nil && result.Proof != nil {
+		for _, roll := range result.Proof.Rolls {
+			status.Players = append(status.Players, roll.PlayerID)
+		}
+	}
+	return status, nil
+}
+
+func (svc *Keeper) loadSession(ctx context.Context, tenant, sessionID string) (*session.Session, session.State, *session.Result, error) {
+	row := svc.DB.QueryRowContext(ctx, `SELECT `+sessionColumns+` FROM sessions s WHERE id = ? AND tenant = ?`, session.Key(tenant, sessionID), tenant)
+	sess, state, result, err := scanSession(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", nil, session.ErrNotFound
+	}
+	if err != nil {
+		return nil, "", nil, err
+	}
+	sess.ID = sessionID
+	sess.Tenant = tenant
+	return sess, state, result, nil
+}
+
+// sessionColumns are the columns of the sessions table aliased s read by scanSession.
+const sessionColumns = `s.id, s.creator, s.num_players, s.min_roll, s.max_roll, s.dice, s.tie_policy, s.server_seed, s.server_seed_hash, s.webhooks, s.created_at, s.expires_at, s.state, s.result`
+
+// scanSession reads a row selecting sessionColumns followed by dest. The ID of
+// the session is its key.
+func scanSession(row interface{ Scan(...interface{}) error }, dest ...interface{}) (*session.Session, session.State, *session.Result, error) {
+	var sess session.Session
+	var expr, webhooks string
+	var createdAt, expiresAt int64
+	var state session.State
+	var result sql.NullString
+	err := row.Scan(append([]interface{}{&sess.ID, &sess.Creator, &sess.MaxNumPlayers, &sess.MinRoll, &sess.MaxRoll, &expr, &sess.TiePolicy, &sess.ServerSeed, &sess.ServerSeedHash, &webhooks,
+		&createdAt, &expiresAt, &state, &result}, dest...)...)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if expr != "" {
+		if sess.Dice, err = dice.Parse(expr); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	if err := json.Unmarshal([]byte(webhooks), &sess.Webhooks); err != nil {
+		return nil, "", nil, err
+	}
+	sess.CreatedAt = time.Unix(0, createdAt).UTC()
+	sess.ExpiresAt = time.Unix(0, expiresAt).UTC()
+	if !result.Valid {
+		return &sess, state, nil, nil
+	}
+	var res session.Result
+	if err := json.Unmarshal([]byte(result.String), &res); err != nil {
+		return nil, "", nil, err
+	}
+	return &sess, state, &res, nil
+}
+
+func (svc *Keeper) loadRolls(ctx context.Context, tenant, sessionID string) ([]session.Roll, error) {
+	rows, err := svc.DB.QueryContext(ctx, `SELECT roll FROM rolls WHERE session_id = ? ORDER BY rowid`, session.Key(tenant, sessionID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rolls []session.Roll
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var roll session.Roll
+		if err := json.Unmarshal([]byte(data), &roll); err != nil {
+			return nil, err
+		}
+		rolls = append(rolls, roll)
+	}
+	return rolls, rows.Err()
+}
@@ -0,0 +1,396 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rgynn/dice/pkg/dice"
+	"github.com/rgynn/dice/pkg/random"
+	"github.com/rgynn/dice/pkg/session"
+	"github.com/rgynn/dice/pkg/session/sessiontest"
+)
+
+func newTestKeeper(t *testing.T, path string) *Keeper {
+	keeper, err := NewKeeper(path, 10, 100, 0, random.NewSeeded(42), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go keeper.Run(ctx)
+	return keeper
+}
+
+func TestKeeper_Restart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dice.db")
+	expr, err := dice.Parse("2d6+3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keeper := newTestKeeper(t, path)
+	sess, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{Creator: "a", MaxNumPlayers: 2, MaxDurationSeconds: 60, Dice: expr, TiePolicy: session.TiePolicyReroll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, roll, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{Type: session.RollTypeNeed, ClientSeed: "seed-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keeper.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	keeper = newTestKeeper(t, path)
+	status, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != session.StateOpen || !reflect.DeepEqual(status.Players, []string{"a"}) || status.RemainingSeconds < 50 {
+		t.Errorf("expected reloaded open session with player a and its remaining time, got: %+v", status)
+	}
+	if status.ServerSeedHash != sess.ServerSeedHash || status.Dice.String() != expr.String() || status.TiePolicy != session.TiePolicyReroll {
+		t.Errorf("expected reloaded session to match %+v, got: %+v", sess, status.Session)
+	}
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{}); !errors.Is(err, session.ErrPlayerAlreadyRolled) {
+		t.Errorf("expected error: %v, got: %v", session.ErrPlayerAlreadyRolled, err)
+	}
+	resultC, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "b", session.RollOptions{ClientSeed: "seed-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := <-resultC
+	if !reflect.DeepEqual(result.Proof.Rolls[0], *roll) {
+		t.Errorf("expected roll from before the restart: %+v, got: %+v", *roll, result.Proof.Rolls[0])
+	}
+	if err := session.Verify(result); err != nil {
+		t.Error(err)
+	}
+	for {
+		if status, err := keeper.loadStatus(ctx, session.DefaultTenant, sess.ID); err == nil && status.State == session.StateClosed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := keeper.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	keeper = newTestKeeper(t, path)
+	defer keeper.Close()
+	status, err = keeper.GetSession(ctx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != session.StateClosed || !reflect.DeepEqual(status.Result, &result) || !reflect.DeepEqual(status.Players, []string{"a", "b"}) {
+		t.Errorf("expected closed session with result: %+v, got: %+v", result, status)
+	}
+	list, err := keeper.ListSessions(ctx, session.DefaultTenant, session.ListOptions{State: session.StateClosed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Sessions) != 1 || list.Sessions[0].ID != sess.ID {
+		t.Errorf("expected closed session %s to be listed, got: %+v", sess.ID, list.Sessions)
+	}
+	playerResult, err := keeper.GetSessionResult(ctx, session.DefaultTenant, sess.ID, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(playerResult.Your, roll) || !reflect.DeepEqual(playerResult.Result, &result) {
+		t.Errorf("expected player result with roll: %+v, got: %+v", roll, playerResult)
+	}
+}
+
+func TestKeeper_ShutdownHandOff(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dice.db")
+
+	keeper := newTestKeeper(t, path)
+	sess, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2, MaxDurationSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := keeper.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := keeper.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	keeper = newTestKeeper(t, path)
+	defer keeper.Close()
+	status, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != session.StateOpen || !reflect.DeepEqual(status.Players, []string{"a"}) {
+		t.Errorf("expected session handed off to the next run with player a, got: %+v", status)
+	}
+	if _, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2}); err != nil {
+		t.Errorf("expected the next run to create sessions, got: %v", err)
+	}
+}
+
+func TestKeeper_TenantsMigrated(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dice.db")
+	// A database created before there were tenants.
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(strings.Replace(schema, "\ttenant           TEXT NOT NULL DEFAULT '',\n", "", 1)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	tenants := session.Tenants{"guild": {}}
+	keeper := newTestKeeper(t, path)
+	keeper.Tenants = tenants
+	var sessionIDs []string
+	for _, tenant := range []string{session.DefaultTenant, "guild"} {
+		sess, err := keeper.NewSession(ctx, tenant, session.Options{MaxNumPlayers: 2, MaxDurationSeconds: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := keeper.AddSessionRoll(ctx, tenant, sess.ID, "a", session.RollOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		sessionIDs = append(sessionIDs, sess.ID)
+	}
+	if err := keeper.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	keeper = newTestKeeper(t, path)
+	keeper.Tenants = tenants
+	defer keeper.Close()
+	status, err := keeper.GetSession(ctx, "guild", sessionIDs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Tenant != "guild" || !reflect.DeepEqual(status.Players, []string{"a"}) {
+		t.Errorf("expected reloaded session of tenant guild with player a, got: %+v", status)
+	}
+	if _, err := keeper.GetSession(ctx, session.DefaultTenant, sessionIDs[1]); !errors.Is(err, session.ErrNotFound) {
+		t.Errorf("expected error: %v, got: %v", session.ErrNotFound, err)
+	}
+	if _, err := keeper.GetSession(ctx, session.DefaultTenant, sessionIDs[0]); err != nil {
+		t.Errorf("expected reloaded session of the default tenant, got: %v", err)
+	}
+}
+
+func TestKeeper_ReloadExpired(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dice.db")
+
+	keeper := newTestKeeper(t, path)
+	sess, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 3, MaxDurationSeconds: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// Stop the session from closing in this run, as if the server went down.
+	sess.Timer.Stop()
+	if err := keeper.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Until(sess.ExpiresAt))
+
+	keeper = newTestKeeper(t, path)
+	defer keeper.Close()
+	for {
+		status, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State == session.StateClosed {
+			if status.Result.Winner.PlayerID != "a" {
+				t.Errorf("expected a to win the expired session, got: %+v", status.Result)
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKeeper_RollsStoredFirst(t *testing.T) {
+	ctx := context.Background()
+	keeper := newTestKeeper(t, filepath.Join(t.TempDir(), "dice.db"))
+	defer keeper.Close()
+	if _, err := keeper.DB.Exec(`CREATE TRIGGER refuse_b BEFORE INSERT ON rolls WHEN NEW.player_id = 'b' BEGIN SELECT RAISE(ABORT, 'refused'); END`); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2, MaxDurationSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A roll the database refused isn't counted.
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "b", session.RollOptions{}); err == nil {
+		t.Fatal("expected the refused roll to fail")
+	}
+	status, err := keeper.GetSession(ctx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Players) != 0 {
+		t.Errorf("expected no players, got: %v", status.Players)
+	}
+
+	// A stored roll the session refused is deleted again.
+	if _, err := keeper.CancelSession(ctx, session.DefaultTenant, sess.ID, session.Actor{Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, "a", session.RollOptions{}); !errors.Is(err, session.ErrSessionClosed) {
+		t.Errorf("expected error: %v, got: %v", session.ErrSessionClosed, err)
+	}
+	rolls, err := keeper.loadRolls(ctx, session.DefaultTenant, sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rolls) != 0 {
+		t.Errorf("expected no stored rolls, got: %+v", rolls)
+	}
+}
+
+func TestKeeper_RollLocksPerSession(t *testing.T) {
+	ctx := context.Background()
+	keeper := newTestKeeper(t, filepath.Join(t.TempDir(), "dice.db"))
+	defer keeper.Close()
+	var sessionIDs []string
+	for i := 0; i < 2; i++ {
+		sess, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{MaxNumPlayers: 2, MaxDurationSeconds: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionIDs = append(sessionIDs, sess.ID)
+	}
+
+	// A roll held up in one session doesn't hold up the others.
+	unlock := keeper.lockRolls(session.Key(session.DefaultTenant, sessionIDs[0]))
+	rolled := make(chan error)
+	go func() {
+		_, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sessionIDs[1], "a", session.RollOptions{})
+		rolled <- err
+	}()
+	select {
+	case err := <-rolled:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected roll in another session to go through")
+	}
+	unlock()
+	if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sessionIDs[0], "a", session.RollOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	keeper.mu.Lock()
+	defer keeper.mu.Unlock()
+	if len(keeper.rollLocks) != 0 {
+		t.Errorf("expected roll locks to be dropped, got: %d", len(keeper.rollLocks))
+	}
+}
+
+func TestKeeper_ListClosed(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dice.db")
+
+	keeper := newTestKeeper(t, path)
+	var expected []*session.Session
+	var rolled string
+	for i, creator := range []string{"alice", "bob", "alice", "alice", "bob"} {
+		sess, err := keeper.NewSession(ctx, session.DefaultTenant, session.Options{Creator: creator, MaxNumPlayers: 3, MaxDurationSeconds: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			rolled = sess.ID
+			for _, playerID := range []string{"b", "a"} {
+				if _, _, err := keeper.AddSessionRoll(ctx, session.DefaultTenant, sess.ID, playerID, session.RollOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if _, err := keeper.CancelSession(ctx, session.DefaultTenant, sess.ID, session.Actor{Admin: true}); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if status, err := keeper.loadStatus(ctx, session.DefaultTenant, sess.ID); err == nil && status.State == session.StateCancelled {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if creator == "alice" {
+			expected = append(expected, sess)
+		}
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		if !expected[i].CreatedAt.Equal(expected[j].CreatedAt) {
+			return expected[i].CreatedAt.Before(expected[j].CreatedAt)
+		}
+		return expected[i].ID < expected[j].ID
+	})
+	if err := keeper.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closed sessions are no longer in memory after a restart.
+	keeper = newTestKeeper(t, path)
+	defer keeper.Close()
+	var listed []*session.Status
+	opts := session.ListOptions{State: session.StateCancelled, Creator: "alice", Limit: 2}
+	for {
+		list, err := keeper.ListSessions(ctx, session.DefaultTenant, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed = append(listed, list.Sessions...)
+		if list.NextCursor == "" {
+			break
+		}
+		opts.Cursor = list.NextCursor
+	}
+	if len(listed) != len(expected) {
+		t.Fatalf("expected %d sessions, got: %d", len(expected), len(listed))
+	}
+	for i := range expected {
+		if listed[i].ID != expected[i].ID {
+			t.Errorf("expected session %d: %s, got: %s", i, expected[i].ID, listed[i].ID)
+		}
+	}
+	for _, status := range listed {
+		if status.Creator != "alice" || status.State != session.StateCancelled {
+			t.Errorf("expected cancelled session of alice, got: %+v", status)
+		}
+		if status.ID == rolled && !reflect.DeepEqual(status.Players, []string{"a", "b"}) {
+			t.Errorf("expected players: %v, got: %v", []string{"a", "b"}, status.Players)
+		}
+	}
+}
+
+func TestKeeper_Conformance(t *testing.T) {
+	sessiontest.TestKeeper(t, func(t *testing.T, maxNumSessions, maxRollNumber int, tenants session.Tenants) session.Keeper {
+		keeper, err := NewKeeper(filepath.Join(t.TempDir(), "dice.db"), maxNumSessions, maxRollNumber, time.Minute, random.NewCrypto(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keeper.Tenants = tenants
+		t.Cleanup(func() { keeper.Close() })
+		return keeper
+	})
+}
@@ -0,0 +1,110 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+)
+
+// DefaultTenant is the tenant of sessions created without one, it is held to
+// the limits a Keeper was created with.
+const DefaultTenant = ""
+
+var ErrTenantNotFound = errors.New("tenant not found")
+
+var tenantNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// ValidTenant reports whether name may name a tenant, lower case letters,
+// digits and dashes so it is safe in URLs and store keys.
+func ValidTenant(name string) bool {
+	return tenantNameRegexp.MatchString(name)
+}
+
+// Limits are what the sessions of a tenant are held to, the number of open
+// sessions, the highest number they may roll up to and for how long they are
+// kept once closed.
+type Limits struct {
+	MaxNumSessions int
+	MaxRollNumber  int
+	Retention      time.Duration
+}
+
+// Tenants are the limits of every tenant other than DefaultTenant by name.
+// Every session belongs to a tenant and can only be found through it, so
+// tenants get their own session ID space.
+type Tenants map[string]Limits
+
+// Limits returns the limits of a tenant, defaults for DefaultTenant, or
+// ErrTenantNotFound. Limits a tenant leaves zero fall back to defaults.
+func (tenants Tenants) Limits(tenant string, defaults Limits) (Limits, error) {
+	if tenant == DefaultTenant {
+		return defaults, nil
+	}
+	limits, ok := tenants[tenant]
+	if !ok {
+		return Limits{}, ErrTenantNotFound
+	}
+	if limits.MaxNumSessions == 0 {
+		limits.MaxNumSessions = defaults.MaxNumSessions
+	}
+	if limits.MaxRollNumber == 0 {
+		limits.MaxRollNumber = defaults.MaxRollNumber
+	}
+	if limits.Retention == 0 {
+		limits.Retention = defaults.Retention
+	}
+	return limits, nil
+}
+
+// Names returns the name of every tenant other than DefaultTenant.
+func (tenants Tenants) Names() []string {
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	return names
+}
+
+// LoadTenants reads tenants from a JSON object at path keyed by name, e.g.
+// {"guild-a": {"max_num_sessions": 10, "max_roll_number": 100, "retention_seconds": 60}}.
+func LoadTenants(path string) (Tenants, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]struct {
+		MaxNumSessions   int `json:"max_num_sessions"`
+		MaxRollNumber    int `json:"max_roll_number"`
+		RetentionSeconds int `json:"retention_seconds"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to read tenants from %s: %w", path, err)
+	}
+	tenants := Tenants{}
+	for name, entry := range entries {
+		if !ValidTenant(name) {
+			return nil, fmt.Errorf("invalid tenant name in %s: %q", path, name)
+		}
+		if entry.MaxNumSessions < 0 || entry.MaxRollNumber < 0 || entry.RetentionSeconds < 0 {
+			return nil, fmt.Errorf("invalid limits for tenant %s in %s", name, path)
+		}
+		tenants[name] = Limits{
+			MaxNumSessions: entry.MaxNumSessions,
+			MaxRollNumber:  entry.MaxRollNumber,
+			Retention:      time.Duration(entry.RetentionSeconds) * time.Second,
+		}
+	}
+	return tenants, nil
+}
+
+// Key returns the key a session is held under, unique across tenants. Keys of
+// the DefaultTenant are the session ID itself.
+func Key(tenant, sessionID string) string {
+	if tenant == DefaultTenant {
+		return sessionID
+	}
+	return tenant + "/" + sessionID
+}
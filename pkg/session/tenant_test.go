@@ -0,0 +1,71 @@
+package session
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadTenants(t *testing.T) {
+	defaults := Limits{MaxNumSessions: 100, MaxRollNumber: 100, Retention: time.Minute}
+	type testcase struct {
+		Name           string
+		Input          string
+		Tenant         string
+		ExpectedLimits Limits
+		ExpectedError  error
+		ExpectedLoad   bool
+	}
+	testcases := []testcase{
+		{
+			Name:           "Limits",
+			Input:          `{"guild-a": {"max_num_sessions": 10, "max_roll_number": 6, "retention_seconds": 5}}`,
+			Tenant:         "guild-a",
+			ExpectedLimits: Limits{MaxNumSessions: 10, MaxRollNumber: 6, Retention: 5 * time.Second},
+		},
+		{
+			Name:           "Defaults",
+			Input:          `{"guild-a": {"max_num_sessions": 10}}`,
+			Tenant:         "guild-a",
+			ExpectedLimits: Limits{MaxNumSessions: 10, MaxRollNumber: 100, Retention: time.Minute},
+		},
+		{
+			Name:           "Default tenant",
+			Input:          `{"guild-a": {"max_num_sessions": 10}}`,
+			Tenant:         DefaultTenant,
+			ExpectedLimits: defaults,
+		},
+		{Name: "Unknown tenant", Input: `{"guild-a": {}}`, Tenant: "guild-b", ExpectedError: ErrTenantNotFound},
+		{Name: "Invalid name", Input: `{"Guild A": {}}`, ExpectedLoad: true},
+		{Name: "Negative limit", Input: `{"guild-a": {"max_num_sessions": -1}}`, ExpectedLoad: true},
+		{Name: "Not json", Input: `guild-a`, ExpectedLoad: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tenants.json")
+			if err := os.WriteFile(path, []byte(tc.Input), 0600); err != nil {
+				t.Fatal(err)
+			}
+			tenants, err := LoadTenants(path)
+			if tc.ExpectedLoad {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			limits, err := tenants.Limits(tc.Tenant, defaults)
+			if !errors.Is(err, tc.ExpectedError) {
+				t.Errorf("expected error: %v, got: %v", tc.ExpectedError, err)
+			}
+			if !reflect.DeepEqual(tc.ExpectedLimits, limits) {
+				t.Errorf("expected limits: %+v, got: %+v", tc.ExpectedLimits, limits)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/rgynn/dice/pkg/fair"
+)
+
+var ErrVerificationFailed = errors.New("verification failed")
+
+// Verify recomputes every roll and the winner of a closed session from its revealed proof.
+func Verify(result Result) error {
+	proof := result.Proof
+	if proof == nil {
+		return fmt.Errorf("%w: result has no proof", ErrVerificationFailed)
+	}
+	if fair.Hash(proof.ServerSeed) != proof.ServerSeedHash {
+		return fmt.Errorf("%w: server seed does not match committed hash %s", ErrVerificationFailed, proof.ServerSeedHash)
+	}
+	sess := &Session{
+		MinRoll:    proof.MinRoll,
+		MaxRoll:    proof.MaxRoll,
+		Dice:       proof.Dice,
+		TiePolicy:  proof.TiePolicy,
+		ServerSeed: proof.ServerSeed,
+	}
+	for _, roll := range proof.Rolls {
+		expected := sess.roll(Roll{PlayerID: roll.PlayerID, Type: roll.Type, ClientSeed: roll.ClientSeed}, 0)
+		if !reflect.DeepEqual(expected, roll) {
+			return fmt.Errorf("%w: expected roll %+v for player %s, got %+v", ErrVerificationFailed, expected, roll.PlayerID, roll)
+		}
+		sess.rolls = append(sess.rolls, roll)
+	}
+	expected := Result{Cancelled: true}
+	if !result.Cancelled {
+		expected = sess.resolve()
+	}
+	revealed := result
+	revealed.Proof = nil
+	if !reflect.DeepEqual(expected, revealed) {
+		return fmt.Errorf("%w: expected result %+v, got %+v", ErrVerificationFailed, expected, revealed)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rgynn/dice/pkg/clock"
+	"github.com/rgynn/dice/pkg/fair"
+)
+
+func TestVerify(t *testing.T) {
+	serverSeed := "9b1e7bf2c0b1f2c3d4e5f60718293a4b5c6d7e8f9012a3b4c5d6e7f8091a2b3c"
+	sess := &Session{
+		ID:             "fakesession",
+		MaxNumPlayers:  3,
+		MinRoll:        1,
+		MaxRoll:        2,
+		TiePolicy:      TiePolicyReroll,
+		ServerSeed:     serverSeed,
+		ServerSeedHash: fair.Hash(serverSeed),
+		Timer:          clock.New().NewTimer(time.Minute),
+		Players:        map[string]chan Result{},
+		Rolls:          make(chan Roll, 3),
+		Done:           make(chan struct{}),
+	}
+	closeC := make(chan string, 1)
+	go sess.Open(closeC)
+	var resultC chan Result
+	for _, playerID := range []string{"a", "b", "c"} {
+		var err error
+		resultC, _, err = sess.AddRoll(context.Background(), sess.ID, playerID, RollOptions{ClientSeed: "seed-" + playerID})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	body, err := json.Marshal(<-resultC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testcase struct {
+		Name          string
+		Tamper        func(result *Result)
+		ExpectedError error
+	}
+	testcases := []testcase{
+		{
+			Name:   "Untouched",
+			Tamper: func(result *Result) {},
+		},
+		{
+			Name:          "Missing proof",
+			Tamper:        func(result *Result) { result.Proof = nil },
+			ExpectedError: ErrVerificationFailed,
+		},
+		{
+			Name:          "Different server seed",
+			Tamper:        func(result *Result) { result.Proof.ServerSeed = "otherseed" },
+			ExpectedError: ErrVerificationFailed,
+		},
+		{
+			Name:          "Changed roll",
+			Tamper:        func(result *Result) { result.Proof.Rolls[0].Roll = 3 },
+			ExpectedError: ErrVerificationFailed,
+		},
+		{
+			Name:          "Changed winner",
+			Tamper:        func(result *Result) { result.Winner.PlayerID = "d" },
+			ExpectedError: ErrVerificationFailed,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var result Result
+			if err := json.Unmarshal(body, &result); err != nil {
+				t.Fatal(err)
+			}
+			tc.Tamper(&result)
+			if err := Verify(result); !errors.Is(err, tc.ExpectedError) {
+				t.Errorf("expected error: %v, got: %v", tc.ExpectedError, err)
+			}
+		})
+	}
+}
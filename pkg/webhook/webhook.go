@@ -0,0 +1,186 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rgynn/dice/pkg/session"
+)
+
+// SignatureHeader holds "sha256=" followed by the hex encoded HMAC-SHA256 of
+// the request body, keyed with the server's webhook secret.
+const SignatureHeader = "X-Dice-Signature"
+
+// Payload is the JSON body posted to every webhook of a closed session. The
+// result includes the proof with every roll.
+type Payload struct {
+	SessionID string          `json:"session_id"`
+	Tenant    string          `json:"tenant,omitempty"`
+	State     session.State   `json:"state"`
+	Result    *session.Result `json:"result"`
+}
+
+// ErrBlockedAddress is the error of deliveries to a webhook resolving to a
+// loopback, private or link-local address, which aren't retried.
+var ErrBlockedAddress = errors.New("webhook address is loopback, private or link-local")
+
+// Notifier posts the result of closed sessions to their webhooks, retrying
+// failed deliveries with exponential backoff and recording every attempt in
+// the session's delivery log. Anyone creating a session picks its webhooks, so
+// unless AllowPrivateAddresses is set they may only resolve to public
+// addresses, checked on every connection so redirects and DNS changes can't
+// get around it.
+type Notifier struct {
+	Secret                string
+	Client                *http.Client
+	MaxAttempts           int
+	Backoff               time.Duration
+	AllowPrivateAddresses bool
+	wg                    sync.WaitGroup
+}
+
+func NewNotifier(secret string) *Notifier {
+	notifier := &Notifier{
+		Secret:      secret,
+		MaxAttempts: 5,
+		Backoff:     time.Second,
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: notifier.checkAddress}
+	notifier.Client = &http.Client{
+		Timeout: 10 * time.Second,
+		// No proxy, the address dialed must be the webhook's own.
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	return notifier
+}
+
+// checkAddress rejects connections to non public addresses, once the
+// webhook's host has been resolved.
+func (notifier *Notifier) checkAddress(network, address string, conn syscall.RawConn) error {
+	if notifier.AllowPrivateAddresses {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return ErrBlockedAddress
+	}
+	return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// Notify delivers the session's result to each of its webhooks in the background.
+func (notifier *Notifier) Notify(sess *session.Session) {
+	status := sess.Status()
+	body, err := json.Marshal(&Payload{
+		SessionID: sess.ID,
+		Tenant:    sess.Tenant,
+		State:     status.State,
+		Result:    status.Result,
+	})
+	if err != nil {
+		return
+	}
+	for _, url := range sess.Webhooks {
+		notifier.wg.Add(1)
+		go func(url string) {
+			defer notifier.wg.Done()
+			notifier.deliver(sess, url, body)
+		}(url)
+	}
+}
+
+// Wait blocks until every delivery in progress has succeeded or given up.
+func (notifier *Notifier) Wait() {
+	notifier.wg.Wait()
+}
+
+func (notifier *Notifier) deliver(sess *session.Session, url string, body []byte) {
+	backoff := notifier.Backoff
+	for attempt := 1; attempt <= notifier.MaxAttempts; attempt++ {
+		delivery, err := notifier.post(url, body)
+		delivery.Attempt = attempt
+		sess.AddDelivery(delivery)
+		if delivery.Delivered || errors.Is(err, ErrBlockedAddress) || !retry(delivery.StatusCode) {
+			return
+		}
+		if attempt < notifier.MaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// post makes a single delivery attempt, the error is that of the request if
+// it couldn't be made.
+func (notifier *Notifier) post(url string, body []byte) (session.Delivery, error) {
+	delivery := session.Delivery{URL: url, Time: time.Now()}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(notifier.Secret, body))
+	resp, err := notifier.Client.Do(req)
+	if errors.Is(err, ErrBlockedAddress) {
+		delivery.Error = ErrBlockedAddress.Error()
+		return delivery, err
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery, err
+	}
+	defer resp.Body.Close()
+	delivery.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		delivery.Error = fmt.Sprintf("unexpected status: %s", resp.Status)
+		return delivery, nil
+	}
+	delivery.Delivered = true
+	return delivery, nil
+}
+
+// retry reports whether a failed delivery is worth another attempt, which is
+// the case for network errors, rate limiting and server errors.
+func retry(statusCode int) bool {
+	return statusCode == 0 || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// Sign returns the SignatureHeader value for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the SignatureHeader value for body,
+// receivers should use it to check the payload came from this server.
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
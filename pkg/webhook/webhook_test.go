@@ -0,0 +1,186 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rgynn/dice/pkg/random"
+	"github.com/rgynn/dice/pkg/session"
+	"github.com/rgynn/dice/pkg/session/local"
+)
+
+func TestNotifier_Notify(t *testing.T) {
+	type testcase struct {
+		Name               string
+		Responses          []int
+		BlockPrivate       bool
+		ExpectedDeliveries []session.Delivery
+	}
+	testcases := []testcase{
+		{
+			Name:      "Delivered",
+			Responses: []int{http.StatusOK},
+			ExpectedDeliveries: []session.Delivery{
+				{Attempt: 1, StatusCode: http.StatusOK, Delivered: true},
+			},
+		},
+		{
+			Name:      "Retried after server error",
+			Responses: []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusNoContent},
+			ExpectedDeliveries: []session.Delivery{
+				{Attempt: 1, StatusCode: http.StatusInternalServerError, Error: "unexpected status: 500 Internal Server Error"},
+				{Attempt: 2, StatusCode: http.StatusTooManyRequests, Error: "unexpected status: 429 Too Many Requests"},
+				{Attempt: 3, StatusCode: http.StatusNoContent, Delivered: true},
+			},
+		},
+		{
+			Name:      "Gives up after max attempts",
+			Responses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusOK},
+			ExpectedDeliveries: []session.Delivery{
+				{Attempt: 1, StatusCode: http.StatusBadGateway, Error: "unexpected status: 502 Bad Gateway"},
+				{Attempt: 2, StatusCode: http.StatusBadGateway, Error: "unexpected status: 502 Bad Gateway"},
+				{Attempt: 3, StatusCode: http.StatusBadGateway, Error: "unexpected status: 502 Bad Gateway"},
+			},
+		},
+		{
+			Name:      "No retry on client error",
+			Responses: []int{http.StatusBadRequest, http.StatusOK},
+			ExpectedDeliveries: []session.Delivery{
+				{Attempt: 1, StatusCode: http.StatusBadRequest, Error: "unexpected status: 400 Bad Request"},
+			},
+		},
+		{
+			Name:         "No delivery to loopback address",
+			Responses:    []int{http.StatusOK},
+			BlockPrivate: true,
+			ExpectedDeliveries: []session.Delivery{
+				{Attempt: 1, Error: ErrBlockedAddress.Error()},
+			},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var mu sync.Mutex
+			var payloads []Payload
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				if !Verify("secret", body, r.Header.Get(SignatureHeader)) {
+					t.Errorf("invalid signature: %s", r.Header.Get(SignatureHeader))
+				}
+				var payload Payload
+				if err := json.Unmarshal(body, &payload); err != nil {
+					t.Error(err)
+				}
+				mu.Lock()
+				payloads = append(payloads, payload)
+				w.WriteHeader(tc.Responses[len(payloads)-1])
+				mu.Unlock()
+			}))
+			defer receiver.Close()
+
+			notifier := NewNotifier("secret")
+			// The receiver listens on loopback.
+			notifier.AllowPrivateAddresses = !tc.BlockPrivate
+			notifier.MaxAttempts = 3
+			notifier.Backoff = time.Millisecond
+			keeper, err := local.NewKeeper(10, 100, time.Minute, random.NewSeeded(42), notifier)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go keeper.Run(ctx)
+			sess, err := keeper.NewSession(context.Background(), session.DefaultTenant, session.Options{
+				Creator:            "a",
+				MaxNumPlayers:      2,
+				MaxDurationSeconds: 10,
+				Webhooks:           []string{receiver.URL},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resultC chan session.Result
+			for _, playerID := range []string{"a", "b"} {
+				if resultC, _, err = keeper.AddSessionRoll(context.Background(), session.DefaultTenant, sess.ID, playerID, session.RollOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			result := <-resultC
+			for len(sess.Deliveries()) < len(tc.ExpectedDeliveries) {
+				time.Sleep(time.Millisecond)
+			}
+			notifier.Wait()
+
+			deliveries, err := keeper.GetSessionDeliveries(context.Background(), session.DefaultTenant, sess.ID, session.Actor{PlayerID: "a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := len(tc.ExpectedDeliveries), len(deliveries); want != got {
+				t.Fatalf("expected %d deliveries, got: %+v", want, deliveries)
+			}
+			for i, delivery := range deliveries {
+				expected := tc.ExpectedDeliveries[i]
+				expected.URL, expected.Time = receiver.URL, delivery.Time
+				if expected != delivery {
+					t.Errorf("expected delivery: %+v, got: %+v", expected, delivery)
+				}
+			}
+			if tc.BlockPrivate && len(payloads) != 0 {
+				t.Errorf("expected no payloads delivered, got: %+v", payloads)
+			}
+			for _, payload := range payloads {
+				if payload.SessionID != sess.ID || payload.State != session.StateClosed || !reflect.DeepEqual(payload.Result.Winner, result.Winner) || len(payload.Result.Proof.Rolls) != 2 {
+					t.Errorf("expected payload with result: %+v, got: %+v", result, payload)
+				}
+			}
+		})
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	for address, public := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.100.100.200": false,
+		"0.0.0.0":         false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+		"224.0.0.1":       false,
+	} {
+		if got := publicIP(net.ParseIP(address)); got != public {
+			t.Errorf("expected %s public: %v, got: %v", address, public, got)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"session_id":"fakesession"}`)
+	signature := Sign("secret", body)
+	if !Verify("secret", body, signature) {
+		t.Errorf("expected signature %s to verify", signature)
+	}
+	if Verify("othersecret", body, signature) {
+		t.Errorf("expected signature %s not to verify with another secret", signature)
+	}
+	if Verify("secret", []byte(`{"session_id":"othersession"}`), signature) {
+		t.Errorf("expected signature %s not to verify another body", signature)
+	}
+}